@@ -0,0 +1,273 @@
+package clownshoes
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"sort"
+)
+
+// Aggregations fold documents into groups as they're scanned, so only the
+// accumulator state for each group is held in memory, never the documents.
+// Key and value functions see payloads pointing into the mapping, like index
+// key functions, and must not hold on to them.
+
+type AggregateOp int
+
+const (
+	AggCount    AggregateOp = iota //Number of documents in the group
+	AggSum                         //Sum of Value
+	AggAvg                         //Mean of Value
+	AggMin                         //Smallest Value
+	AggMax                         //Largest Value
+	AggDistinct                    //Estimated number of distinct Key, with a HyperLogLog
+)
+
+type Accumulator struct {
+	Name  string
+	Op    AggregateOp
+	Value func(payload []byte) (float64, bool) //For sum, avg, min and max; documents returning false are skipped
+	Key   func(payload []byte) string          //For distinct counts
+}
+
+type Aggregation struct {
+	Where        Condition                   //Only JSON documents matching this, using indexes where possible
+	Index        string                      //Alternatively, only documents under Key in this index
+	Key          string                      //Index key to aggregate under, with Index
+	Filter       func(payload []byte) bool   //Further restricts the documents, if set
+	GroupBy      func(payload []byte) string //Everything goes into the group "" if nil
+	Accumulators []Accumulator
+	SortBy       string //Accumulator to order groups by; they're ordered by key if empty
+	Desc         bool
+	TopK         int //Only keep the first TopK groups after sorting, if nonzero
+}
+
+// One group's results.  Values holds each accumulator by name, leaving out
+// averages, minimums and maximums of groups with no values.
+type Group struct {
+	Key    string
+	Count  uint64
+	Values map[string]float64
+}
+
+// Precision of the HyperLogLogs used for distinct counts
+const aggregateHLLPrecision = 12
+
+type accState struct {
+	n        uint64
+	sum      float64
+	min, max float64
+	hll      *HyperLogLog
+}
+
+type groupState struct {
+	count uint64
+	accs  []accState
+}
+
+func (agg *Aggregation) check() error {
+	if agg.Where != nil {
+		if agg.Index != "" {
+			return errors.New("clownshoes: aggregation can't use both Where and Index")
+		}
+		if err := agg.Where.check(); err != nil {
+			return err
+		}
+	}
+	sortFound := agg.SortBy == ""
+	for _, acc := range agg.Accumulators {
+		switch acc.Op {
+		case AggCount:
+		case AggSum, AggAvg, AggMin, AggMax:
+			if acc.Value == nil {
+				return errors.New("clownshoes: accumulator " + acc.Name + " needs a Value function")
+			}
+		case AggDistinct:
+			if acc.Key == nil {
+				return errors.New("clownshoes: accumulator " + acc.Name + " needs a Key function")
+			}
+		default:
+			return errors.New("clownshoes: accumulator " + acc.Name + " has an unknown op")
+		}
+		if acc.Name == agg.SortBy {
+			sortFound = true
+		}
+	}
+	if !sortFound {
+		return errors.New("clownshoes: no accumulator named " + agg.SortBy + " to sort by")
+	}
+	return nil
+}
+
+func (agg *Aggregation) add(groups map[string]*groupState, payload []byte) {
+	if agg.Filter != nil && !agg.Filter(payload) {
+		return
+	}
+	key := ""
+	if agg.GroupBy != nil {
+		key = agg.GroupBy(payload)
+	}
+	g, found := groups[key]
+	if !found {
+		g = &groupState{accs: make([]accState, len(agg.Accumulators))}
+		groups[key] = g
+	}
+	g.count++
+	for i, acc := range agg.Accumulators {
+		st := &g.accs[i]
+		switch acc.Op {
+		case AggSum, AggAvg, AggMin, AggMax:
+			v, ok := acc.Value(payload)
+			if !ok {
+				continue
+			}
+			if st.n == 0 || v < st.min {
+				st.min = v
+			}
+			if st.n == 0 || v > st.max {
+				st.max = v
+			}
+			st.n++
+			st.sum += v
+		case AggDistinct:
+			if st.hll == nil {
+				st.hll = NewHyperLogLog(aggregateHLLPrecision)
+			}
+			st.hll.Add([]byte(acc.Key(payload)))
+		}
+	}
+}
+
+func (agg *Aggregation) result(key string, g *groupState) Group {
+	out := Group{Key: key, Count: g.count, Values: make(map[string]float64, len(agg.Accumulators))}
+	for i, acc := range agg.Accumulators {
+		st := g.accs[i]
+		switch acc.Op {
+		case AggCount:
+			out.Values[acc.Name] = float64(g.count)
+		case AggSum:
+			out.Values[acc.Name] = st.sum
+		case AggAvg:
+			if st.n != 0 {
+				out.Values[acc.Name] = st.sum / float64(st.n)
+			}
+		case AggMin:
+			if st.n != 0 {
+				out.Values[acc.Name] = st.min
+			}
+		case AggMax:
+			if st.n != 0 {
+				out.Values[acc.Name] = st.max
+			}
+		case AggDistinct:
+			if st.hll != nil {
+				out.Values[acc.Name] = float64(st.hll.Estimate())
+			} else {
+				out.Values[acc.Name] = 0
+			}
+		}
+	}
+	return out
+}
+
+// Whether a sorts before b.  Groups missing the sort value go last, and ties
+// are broken by key.
+func (agg *Aggregation) less(a, b Group) bool {
+	if agg.SortBy != "" {
+		av, aFound := a.Values[agg.SortBy]
+		bv, bFound := b.Values[agg.SortBy]
+		if aFound != bFound {
+			return aFound
+		}
+		if aFound && av != bv && !(math.IsNaN(av) || math.IsNaN(bv)) {
+			return (av < bv) != agg.Desc
+		}
+	}
+	if a.Key != b.Key {
+		return (a.Key < b.Key) != (agg.Desc && agg.SortBy == "")
+	}
+	return false
+}
+
+// Max-heap by sort order, so the worst of the best K so far is on top.
+type groupHeap struct {
+	agg    *Aggregation
+	groups []Group
+}
+
+func (h *groupHeap) Len() int           { return len(h.groups) }
+func (h *groupHeap) Less(i, j int) bool { return h.agg.less(h.groups[j], h.groups[i]) }
+func (h *groupHeap) Swap(i, j int)      { h.groups[i], h.groups[j] = h.groups[j], h.groups[i] }
+func (h *groupHeap) Push(x interface{}) { h.groups = append(h.groups, x.(Group)) }
+func (h *groupHeap) Pop() (x interface{}) {
+	x, h.groups = h.groups[len(h.groups)-1], h.groups[:len(h.groups)-1]
+	return x
+}
+
+// Run the aggregation over the collection, returning the groups in order.
+// Expired documents are skipped, as are non-JSON documents when Where is set.
+// If Index is set and doesn't exist, there are no groups.
+func (db *DocumentBundle) Aggregate(agg Aggregation) ([]Group, error) {
+	if err := agg.check(); err != nil {
+		return nil, err
+	}
+	groups := db.scanGroups(&agg)
+
+	if agg.TopK <= 0 || agg.TopK >= len(groups) {
+		out := make([]Group, 0, len(groups))
+		for key, g := range groups {
+			out = append(out, agg.result(key, g))
+		}
+		sort.Slice(out, func(i, j int) bool { return agg.less(out[i], out[j]) })
+		return out, nil
+	}
+
+	h := &groupHeap{agg: &agg}
+	for key, g := range groups {
+		group := agg.result(key, g)
+		if h.Len() < agg.TopK {
+			heap.Push(h, group)
+		} else if agg.less(group, h.groups[0]) {
+			h.groups[0] = group
+			heap.Fix(h, 0)
+		}
+	}
+	out := make([]Group, h.Len())
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = heap.Pop(h).(Group)
+	}
+	return out, nil
+}
+
+// Scan the documents the aggregation covers into groups, under the read lock,
+// which is released even if a key function or accumulator panics.
+func (db *DocumentBundle) scanGroups(agg *Aggregation) map[string]*groupState {
+	groups := make(map[string]*groupState)
+	db.readLock()
+	defer db.RUnlock()
+	now := timeNow().UnixNano()
+	switch {
+	case agg.Where != nil:
+		db.doMatch(agg.Where, func(offset uint64, doc Document, value interface{}) bool {
+			agg.add(groups, doc.Payload)
+			return true
+		})
+	case agg.Index != "":
+		if idx, found := db.indexes[agg.Index]; found {
+			for _, offset := range idx.get(agg.Key) {
+				if doc := db.doGetDocumentAt(offset); !doc.expiredAt(now) {
+					agg.add(groups, doc.Payload)
+				}
+			}
+		}
+	default:
+		for pos := db.getFirstDocOffset(); pos != 0; {
+			doc := db.doGetDocumentAt(pos)
+			if !doc.expiredAt(now) {
+				agg.add(groups, doc.Payload)
+			}
+			pos = doc.NextDocOffset
+		}
+	}
+	return groups
+}
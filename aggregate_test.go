@@ -0,0 +1,100 @@
+package clownshoes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	//Payloads of the form "group:value:user"
+	for i := 0; i < 300; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf("g%d:%d:u%d", i%3, i, i%7))))
+	}
+	field := func(n int) func([]byte) string {
+		return func(payload []byte) string { return strings.Split(string(payload), ":")[n] }
+	}
+	value := func(payload []byte) (float64, bool) {
+		v, err := strconv.ParseFloat(field(1)(payload), 64)
+		return v, err == nil
+	}
+	db.AddIndex("group", field(0))
+
+	accs := []Accumulator{
+		{Name: "n", Op: AggCount},
+		{Name: "sum", Op: AggSum, Value: value},
+		{Name: "avg", Op: AggAvg, Value: value},
+		{Name: "min", Op: AggMin, Value: value},
+		{Name: "max", Op: AggMax, Value: value},
+		{Name: "users", Op: AggDistinct, Key: field(2)},
+	}
+	groups, e := db.Aggregate(Aggregation{GroupBy: field(0), Accumulators: accs})
+	if e != nil || len(groups) != 3 {
+		t.Fatal("Wrong groups", groups, e)
+	}
+	g := groups[1]
+	if g.Key != "g1" || g.Count != 100 || g.Values["sum"] != 14950 || g.Values["avg"] != 149.5 ||
+		g.Values["min"] != 1 || g.Values["max"] != 298 || g.Values["users"] != 7 {
+		t.Error("Wrong accumulators", g)
+	}
+
+	//Top-K by a descending accumulator
+	groups, _ = db.Aggregate(Aggregation{GroupBy: field(2), Accumulators: accs, SortBy: "sum", Desc: true, TopK: 2})
+	if len(groups) != 2 || groups[0].Key != "u5" || groups[1].Key != "u4" {
+		t.Error("Wrong top groups", groups)
+	}
+
+	//From a posting list, with a filter
+	groups, _ = db.Aggregate(Aggregation{Index: "group", Key: "g2", Accumulators: accs,
+		Filter: func(payload []byte) bool { v, _ := value(payload); return v < 30 }})
+	if len(groups) != 1 || groups[0].Count != 10 || groups[0].Values["max"] != 29 {
+		t.Error("Wrong indexed aggregate", groups)
+	}
+
+	if _, e := db.Aggregate(Aggregation{Accumulators: accs, SortBy: "nope"}); e == nil {
+		t.Error("Expected error sorting by unknown accumulator")
+	}
+	if _, e := db.Aggregate(Aggregation{Accumulators: []Accumulator{{Name: "s", Op: AggSum}}}); e == nil {
+		t.Error("Expected error for sum without a value function")
+	}
+
+	//A panicking group function doesn't leave the lock held
+	func() {
+		defer func() { recover() }()
+		db.Aggregate(Aggregation{GroupBy: func([]byte) string { panic("oops") }})
+	}()
+	if _, e := db.PutDocument(NewDocument([]byte("g0:0:u0"))); e != nil {
+		t.Error("Problem writing after a panic", e)
+	}
+}
+
+func TestAggregateWhere(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	for i := 0; i < 50; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf(`{"city":"c%d","age":%d}`, i%5, i))))
+	}
+	db.AddFieldIndex("city", "city")
+	groups, e := db.Aggregate(Aggregation{Where: And(Eq("city", "c1"), Gte("age", 20)),
+		Accumulators: []Accumulator{{Name: "n", Op: AggCount}}})
+	if e != nil || len(groups) != 1 || groups[0].Count != 6 {
+		t.Error("Wrong aggregate over query", groups, e)
+	}
+}
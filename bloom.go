@@ -0,0 +1,54 @@
+package clownshoes
+
+import (
+	"math"
+)
+
+// A Bloom filter: a set that can answer "maybe" for keys it doesn't hold, at
+// a rate fixed when it's sized, but never "no" for keys it does.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 //Number of bits
+	k    int    //Number of hashes
+}
+
+// Size a filter to hold n keys with the given false positive rate.
+func newBloomFilter(n int, rate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{make([]uint64, (m+63)/64), m, k}
+}
+
+// The bits for a key are h1 + i*h2 for i < k, per Kirsch & Mitzenmacher.
+func (b *bloomFilter) hashes(key string) (uint64, uint64) {
+	h1 := hashKey([]byte(key))
+	return h1, mix64(h1^0x9e3779b97f4a7c15) | 1
+}
+
+func (b *bloomFilter) add(key string) {
+	h1, h2 := b.hashes(key)
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(key string) bool {
+	h1, h2 := b.hashes(key)
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,336 @@
+// Command clownshoes inspects and maintains Clownshoes database files.
+//
+// Usage:
+//
+//	clownshoes <command> [flags] <file> [args]
+//
+// Commands:
+//
+//	info              pointers, sizes & document counts
+//	dump              every document's offset & payload
+//	get <offset>      the document at the given offset
+//	verify            walk every collection's links in both directions
+//	compact           compact the file
+//	copy <dest>       copy the file to dest
+//	grow <bytes>      extend the file by the given number of bytes
+//	shrink            truncate the file to the end of the last document
+//	export            write documents to stdout
+//	import <src>      insert documents from src, or stdin if src is -
+//	serve             serve the file over HTTP (see package server)
+//	serve-redis       serve the file over the Redis protocol (see package resp)
+//
+// Flags:
+//
+//	-json             write machine-readable JSON
+//	-collection name  operate on the named collection rather than the default
+//	-format f         jsonl, raw, base64 or binary, for import & export
+//	-contains s       only export documents containing s
+//	-start n          skip the first n records when importing, to resume
+//	-batch n          documents inserted per batch when importing
+//	-addr a           address to serve on, by default localhost:8080 for HTTP
+//	                  and localhost:6379 for Redis
+//	-timeout d        per-request timeout when serving
+//	-backup-dir d     directory for backups made through the server
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bnyeggen/clownshoes"
+	"github.com/bnyeggen/clownshoes/resp"
+	"github.com/bnyeggen/clownshoes/server"
+)
+
+type command struct {
+	nArgs    int  //Arguments after the file name
+	readOnly bool //Whether the file can be opened read-only, alongside other readers
+	creates  bool //Whether it may initialize an empty file, and create the collection
+	usage    string
+	run      func(db *clownshoes.DocumentBundle, args []string, env *env) error
+}
+
+var commands = map[string]command{
+	"info":        {0, true, false, "info <file>", info},
+	"dump":        {0, true, false, "dump <file>", dump},
+	"get":         {1, true, false, "get <file> <offset>", get},
+	"verify":      {0, true, false, "verify <file>", verify},
+	"compact":     {0, false, false, "compact <file>", compact},
+	"copy":        {1, true, false, "copy <file> <dest>", copyDB},
+	"grow":        {1, false, false, "grow <file> <bytes>", grow},
+	"shrink":      {0, false, false, "shrink <file>", shrink},
+	"export":      {0, true, false, "export [-format f] [-contains s] <file>", export},
+	"import":      {1, false, true, "import [-format f] [-start n] [-batch n] <file> <src>", importDocs},
+	"serve":       {0, false, false, "serve [-addr a] [-timeout d] [-backup-dir d] <file>", serve},
+	"serve-redis": {0, false, false, "serve-redis [-addr a] [-collection name] <file>", serveRedis},
+}
+
+var errProblems = errors.New("verification failed")
+
+// Everything a command needs besides the DB
+type env struct {
+	stdin     io.Reader
+	stdout    io.Writer
+	stderr    io.Writer
+	json      bool
+	format    clownshoes.Format
+	contains  string
+	startAt   uint64
+	batchSize int
+	addr      string
+	timeout   time.Duration
+	backupDir string
+}
+
+// Writes either a human-readable line or a line of JSON to stdout
+func (env *env) emit(v interface{}, format string, args ...interface{}) {
+	if env.json {
+		json.NewEncoder(env.stdout).Encode(v)
+	} else {
+		fmt.Fprintf(env.stdout, format+"\n", args...)
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func usage(stderr io.Writer) int {
+	fmt.Fprintln(stderr, "usage: clownshoes <command> [-json] [-collection name] <file> [args]")
+	for _, name := range []string{"info", "dump", "get", "verify", "compact", "copy", "grow", "shrink", "export", "import", "serve", "serve-redis"} {
+		fmt.Fprintln(stderr, "  clownshoes", commands[name].usage)
+	}
+	return 2
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) < 1 {
+		return usage(stderr)
+	}
+	cmd, found := commands[args[0]]
+	if !found {
+		return usage(stderr)
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "write machine-readable JSON")
+	collection := flags.String("collection", "", "operate on the named collection rather than the default")
+	formatName := flags.String("format", "jsonl", "jsonl, raw, base64 or binary, for import & export")
+	contains := flags.String("contains", "", "only export documents containing this")
+	startAt := flags.Uint64("start", 0, "skip this many records when importing, to resume")
+	batchSize := flags.Int("batch", 1000, "documents inserted per batch when importing")
+	addr := flags.String("addr", "", "address to serve on")
+	timeout := flags.Duration("timeout", 30*time.Second, "per-request timeout when serving")
+	backupDir := flags.String("backup-dir", "", "directory for backups made through the server")
+	if flags.Parse(args[1:]) != nil || flags.NArg() != cmd.nArgs+1 {
+		return usage(stderr)
+	}
+	format, err := clownshoes.ParseFormat(*formatName)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	//OpenDB would happily create it, or initialize an empty file
+	if info, err := os.Stat(flags.Arg(0)); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	} else if !(cmd.creates && info.Size() == 0) {
+		if err := clownshoes.CheckFile(flags.Arg(0)); err != nil {
+			fmt.Fprintln(stderr, flags.Arg(0)+":", err)
+			return 1
+		}
+	}
+	db, err := clownshoes.OpenDB(flags.Arg(0), clownshoes.Options{ReadOnly: cmd.readOnly})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer db.Close()
+	if *collection != "" {
+		if cmd.creates {
+			db, err = db.CreateCollection(*collection)
+		} else {
+			db, err = db.OpenCollection(*collection)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err, *collection)
+			return 1
+		}
+	}
+
+	err = cmd.run(db, flags.Args()[1:], &env{stdin, stdout, stderr, *asJSON, format, *contains, *startAt, *batchSize, *addr, *timeout, *backupDir})
+	if err == nil {
+		err = db.Sync()
+	}
+	if err == errProblems {
+		return 1
+	} else if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func info(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+	collections := db.CollectionNames()
+	env.emit(struct {
+		clownshoes.Stats
+		Collections []string
+	}{stats, collections},
+		"first document:  %d\nlast document:   %d\nend of data:     %d\ndocuments:       %d (%d in file)\nlive bytes:      %d (%d in file)\ndead bytes:      %d (%.1f%% fragmented)\nfile size:       %d\nmapped size:     %d\ncollections:     %q",
+		stats.FirstDocOffset, stats.LastDocOffset, stats.EndOffset, stats.DocCount, stats.FileDocCount,
+		stats.LiveBytes, stats.FileLiveBytes, stats.DeadBytes, 100*stats.Fragmentation,
+		stats.FileSize, stats.MappedSize, collections)
+	if !env.json {
+		for name, idx := range stats.Indexes {
+			env.emit(nil, "index %q:  %d keys, %d postings", name, idx.Keys, idx.Postings)
+		}
+	}
+	return nil
+}
+
+type jsonDocument struct {
+	Offset  uint64
+	Expires int64  `json:",omitempty"`
+	Payload []byte //Base64 encoded
+}
+
+func dump(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	db.ForEachDocument(func(offset uint64, doc clownshoes.Document) bool {
+		env.emit(jsonDocument{offset, doc.Expires, doc.Payload}, "%d\t%q", offset, doc.Payload)
+		return true
+	})
+	return nil
+}
+
+func get(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	offset, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	doc, err := db.GetDocumentAt(offset)
+	if err != nil {
+		return err
+	}
+	env.emit(jsonDocument{offset, doc.Expires, doc.Payload}, "%q", doc.Payload)
+	return nil
+}
+
+func verify(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	problems := db.Verify()
+	descriptions := make([]string, len(problems))
+	for i, problem := range problems {
+		descriptions[i] = problem.Error()
+	}
+	if env.json {
+		env.emit(struct {
+			OK       bool
+			Problems []string
+		}{len(problems) == 0, descriptions}, "")
+	} else if len(problems) == 0 {
+		env.emit(nil, "ok")
+	} else {
+		for _, description := range descriptions {
+			env.emit(nil, "%s", description)
+		}
+	}
+	if len(problems) != 0 {
+		return errProblems
+	}
+	return nil
+}
+
+func compact(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	if err := db.Compact(); err != nil {
+		return err
+	}
+	return info(db, args, env)
+}
+
+func copyDB(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	return db.CopyDB(args[0], "")
+}
+
+func grow(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	bytes, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	if err = db.Grow(bytes); err != nil {
+		return err
+	}
+	return info(db, args, env)
+}
+
+func shrink(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	if err := db.Shrink(); err != nil {
+		return err
+	}
+	return info(db, args, env)
+}
+
+func export(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	var filter func([]byte) bool
+	if env.contains != "" {
+		filter = func(b []byte) bool { return bytes.Contains(b, []byte(env.contains)) }
+	}
+	_, err := db.ExportDocuments(env.stdout, env.format, filter)
+	return err
+}
+
+func importDocs(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	src := env.stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+	records, err := db.ImportDocuments(src, env.format, clownshoes.ImportOptions{
+		BatchSize: env.batchSize,
+		StartAt:   env.startAt,
+		Progress: func(records uint64) {
+			fmt.Fprintf(env.stderr, "%d records\r", records)
+		},
+	})
+	fmt.Fprintln(env.stderr)
+	if err != nil {
+		return fmt.Errorf("%v; resume with -start %d", err, records)
+	}
+	env.emit(struct{ Records uint64 }{records}, "imported %d records", records)
+	return nil
+}
+
+func serve(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	s := server.New(db, env.timeout)
+	s.BackupDir = env.backupDir
+	if env.addr == "" {
+		env.addr = "localhost:8080"
+	}
+	fmt.Fprintln(env.stderr, "serving on", env.addr)
+	return http.ListenAndServe(env.addr, s)
+}
+
+func serveRedis(db *clownshoes.DocumentBundle, args []string, env *env) error {
+	s := resp.New(db)
+	if env.addr == "" {
+		env.addr = "localhost:6379"
+	}
+	fmt.Fprintln(env.stderr, "serving on", env.addr)
+	return s.ListenAndServe(env.addr)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bnyeggen/clownshoes"
+)
+
+func TestCommands(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesCLITest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db := clownshoes.NewDB(f.Name())
+	first, _ := db.PutDocument(clownshoes.NewDocument([]byte("Spiffy Document 1")))
+	db.PutDocument(clownshoes.NewDocument([]byte("Critical Document 2")))
+	db.Collection("other").PutDocument(clownshoes.NewDocument([]byte("Other Document")))
+	db.Sync()
+
+	runOK := func(args ...string) string {
+		var stdout, stderr bytes.Buffer
+		if status := run(args, nil, &stdout, &stderr); status != 0 {
+			t.Error("Command failed", args, status, stderr.String())
+		}
+		return stdout.String()
+	}
+
+	var stats struct {
+		DocCount     uint64
+		FileDocCount uint64
+		Collections  []string
+	}
+	if e := json.Unmarshal([]byte(runOK("info", "-json", f.Name())), &stats); e != nil {
+		t.Error("Bad JSON from info", e)
+	}
+	if stats.DocCount != 2 || stats.FileDocCount != 3 || len(stats.Collections) != 1 {
+		t.Error("Wrong info", stats)
+	}
+
+	lines := strings.Split(strings.TrimSpace(runOK("dump", "-json", f.Name())), "\n")
+	var doc jsonDocument
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[0]), &doc) != nil || doc.Offset != first || string(doc.Payload) != "Spiffy Document 1" {
+		t.Error("Wrong dump", lines)
+	}
+	if out := runOK("dump", "-collection", "other", f.Name()); !strings.Contains(out, "Other Document") {
+		t.Error("Wrong collection dumped", out)
+	}
+	if out := runOK("get", f.Name(), strconv.FormatUint(first, 10)); out != "\"Spiffy Document 1\"\n" {
+		t.Error("Wrong document", out)
+	}
+	if out := runOK("verify", f.Name()); out != "ok\n" {
+		t.Error("Verification failed", out)
+	}
+
+	copyName := f.Name() + ".copy"
+	defer os.Remove(copyName)
+	runOK("copy", f.Name(), copyName)
+	runOK("shrink", copyName)
+	runOK("grow", copyName, "4096")
+	runOK("compact", copyName)
+	if out := runOK("verify", "-json", copyName); !strings.Contains(out, `"OK":true`) {
+		t.Error("Verification of copy failed", out)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if run([]string{"get", f.Name(), strconv.FormatUint(first+1, 10)}, nil, &stdout, &stderr) == 0 {
+		t.Error("Get at invalid offset succeeded")
+	}
+	if run([]string{"bogus"}, nil, &stdout, &stderr) != 2 {
+		t.Error("Unknown command accepted")
+	}
+	if run([]string{"info", f.Name() + ".missing"}, nil, &stdout, &stderr) == 0 {
+		t.Error("Missing file accepted")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesCLITest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	var stdout, stderr bytes.Buffer
+	input := strings.NewReader("{\"a\": 1}\n{\"b\": 2}\n{\"a\": 3}\n")
+	if run([]string{"import", "-batch", "2", f.Name(), "-"}, input, &stdout, &stderr) != 0 {
+		t.Error("Import failed", stderr.String())
+	}
+	if stdout.String() != "imported 3 records\n" {
+		t.Error("Wrong import output", stdout.String())
+	}
+
+	stdout.Reset()
+	if run([]string{"export", "-contains", "\"a\"", f.Name()}, nil, &stdout, &stderr) != 0 {
+		t.Error("Export failed", stderr.String())
+	}
+	if stdout.String() != "{\"a\":1}\n{\"a\":3}\n" {
+		t.Error("Wrong export", stdout.String())
+	}
+
+	stdout.Reset()
+	if run([]string{"export", "-format", "bogus", f.Name()}, nil, &stdout, &stderr) != 2 {
+		t.Error("Bad format accepted")
+	}
+	stderr.Reset()
+	if run([]string{"import", f.Name(), "-"}, strings.NewReader("{}\nnope\n"), &stdout, &stderr) == 0 {
+		t.Error("Bad input accepted")
+	}
+	if !strings.Contains(stderr.String(), "resume with -start 1") {
+		t.Error("No resume hint", stderr.String())
+	}
+}
+
+func TestCommandsRefuse(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesCLITest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	//Neither empty files nor other files are turned into DBs
+	for _, contents := range []string{"", "not a db"} {
+		ioutil.WriteFile(f.Name(), []byte(contents), 0666)
+		var stdout, stderr bytes.Buffer
+		if run([]string{"grow", f.Name(), "1000"}, nil, &stdout, &stderr) == 0 {
+			t.Error("Grew a file that isn't a DB", contents)
+		}
+		if info, _ := os.Stat(f.Name()); info.Size() != int64(len(contents)) {
+			t.Error("File was changed to size", info.Size())
+		}
+	}
+
+	os.Remove(f.Name())
+	db := clownshoes.NewDB(f.Name())
+	db.Collection("other")
+	db.Close()
+	var stdout, stderr bytes.Buffer
+	if run([]string{"compact", "-collection", "othre", f.Name()}, nil, &stdout, &stderr) == 0 {
+		t.Error("Compacted a missing collection")
+	}
+	if run([]string{"compact", "-collection", "other", f.Name()}, nil, &stdout, &stderr) != 0 {
+		t.Error("Couldn't compact a collection", stderr.String())
+	}
+	db = clownshoes.NewDB(f.Name())
+	if names := db.CollectionNames(); len(names) != 1 || names[0] != "other" {
+		t.Error("Commands created collections", names)
+	}
+}
@@ -0,0 +1,41 @@
+package clownshoes
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codecs convert between Go values and payloads for typed collections.
+
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(payload []byte) (T, error)
+}
+
+// Encodes values as JSON with encoding/json.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(payload []byte) (v T, err error) {
+	err = json.Unmarshal(payload, &v)
+	return v, err
+}
+
+// Encodes values with encoding/gob.  Each payload carries its own type
+// description, so this is larger than the other codecs for small values.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[T]) Decode(payload []byte) (v T, err error) {
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&v)
+	return v, err
+}
@@ -0,0 +1,125 @@
+package clownshoes
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type codecAddress struct {
+	Street string
+	Zip    int
+}
+
+type codecPerson struct {
+	Name      string
+	Age       int
+	Score     float64
+	Ratio     float32
+	Admin     bool
+	Tags      []string
+	Lucky     []int64
+	Avatar    []byte
+	Home      codecAddress
+	Work      *codecAddress
+	Previous  []codecAddress
+	Counts    map[string]uint32
+	Joined    time.Time
+	Secret    string `clownshoes:"-"`
+	Nickname  string `clownshoes:"100"`
+	internal  int
+	Temperate int8
+}
+
+func testPerson() codecPerson {
+	return codecPerson{
+		Name:      "Ada",
+		Age:       -36,
+		Score:     99.5,
+		Ratio:     0.25,
+		Admin:     true,
+		Tags:      []string{"a", "", "c"},
+		Lucky:     []int64{7, -13, 0, 1 << 40},
+		Avatar:    []byte{0, 1, 2},
+		Home:      codecAddress{"1 Main St", 12345},
+		Work:      &codecAddress{Street: "Office"},
+		Previous:  []codecAddress{{"Old St", 1}, {}},
+		Counts:    map[string]uint32{"x": 1, "y": 0},
+		Joined:    time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		Nickname:  "Countess",
+		Temperate: -5,
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	codecs := map[string]Codec[codecPerson]{
+		"json":  JSONCodec[codecPerson]{},
+		"gob":   GobCodec[codecPerson]{},
+		"proto": ProtoCodec[codecPerson]{},
+	}
+	for name, codec := range codecs {
+		in := testPerson()
+		payload, e := codec.Encode(in)
+		if e != nil {
+			t.Fatal(name, "encode failed", e)
+		}
+		out, e := codec.Decode(payload)
+		if e != nil {
+			t.Fatal(name, "decode failed", e)
+		}
+		in.Secret = ""
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("%s round trip differs:\n%+v\n%+v", name, in, out)
+		}
+	}
+}
+
+func TestProtoCodecEvolution(t *testing.T) {
+	type v1 struct {
+		Name  string `clownshoes:"1"`
+		Email string `clownshoes:"2"`
+		Level []uint16
+	}
+	type v2 struct {
+		Name  string `clownshoes:"1"`
+		Phone string `clownshoes:"4"`
+	}
+	payload, e := ProtoCodec[v1]{}.Encode(v1{"Ada", "ada@example.com", []uint16{1, 2}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	out, e := ProtoCodec[*v2]{}.Decode(payload)
+	if e != nil || out.Name != "Ada" || out.Phone != "" {
+		t.Error("Unknown fields not skipped", out, e)
+	}
+
+	//Unpacked repeated scalars, as older encoders write them
+	unpacked := []byte{3<<3 | wireVarint, 5, 3<<3 | wireVarint, 6}
+	if back, e := (ProtoCodec[v1]{}).Decode(unpacked); e != nil || !reflect.DeepEqual(back.Level, []uint16{5, 6}) {
+		t.Error("Unpacked repeated field not decoded", back, e)
+	}
+
+	//Numbers too large for a narrower field are refused rather than truncated
+	wide, _ := ProtoCodec[struct{ N int64 }]{}.Encode(struct{ N int64 }{-300})
+	if _, e := (ProtoCodec[struct{ N int8 }]{}).Decode(wide); e == nil {
+		t.Error("Overflowing int decoded")
+	}
+	if _, e := (ProtoCodec[v1]{}).Decode([]byte{3<<3 | wireVarint, 0x80, 0x80, 0x04}); e == nil {
+		t.Error("Overflowing uint decoded")
+	}
+
+	//Pointers to zero values are written, and nil pointers aren't
+	type ptrs struct{ P, Q *int }
+	zero := 0
+	payload, _ = ProtoCodec[ptrs]{}.Encode(ptrs{P: &zero})
+	if back, e := (ProtoCodec[ptrs]{}).Decode(payload); e != nil || back.P == nil || *back.P != 0 || back.Q != nil {
+		t.Error("Pointers not decoded as encoded", back, e)
+	}
+
+	if _, e := (ProtoCodec[struct{ C chan int }]{}).Encode(struct{ C chan int }{make(chan int)}); e == nil {
+		t.Error("Unsupported type encoded")
+	}
+	if _, e := (ProtoCodec[v1]{}).Decode([]byte{1<<3 | wireBytes, 10, 'x'}); e == nil {
+		t.Error("Truncated message decoded")
+	}
+}
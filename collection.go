@@ -0,0 +1,234 @@
+package clownshoes
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Named collections share a file with the default collection.  Each has its
+// own linked list of documents, indexes, hooks & expiry, but they share the
+// lock, the mapping, the change feed and the free space at the end of the file.
+//
+// The catalog lives in the header page after the default collection's list
+// head: a fixed number of 64 byte slots, each containing a NUL-padded name
+// followed by a 32 byte list head laid out like the default collection's.  A
+// slot with an empty name is free.
+
+const (
+	catalogStart   = 64
+	catalogSlot    = 64
+	maxNameLength  = 32
+	maxCollections = (journalStart - catalogStart) / catalogSlot
+)
+
+var (
+	ErrBadCollectionName  = errors.New("clownshoes: collection names must be 1-32 bytes without NULs")
+	ErrTooManyCollections = errors.New("clownshoes: no free collection slots")
+	ErrNoSuchCollection   = errors.New("clownshoes: no such collection")
+)
+
+// Return the named collection, creating it if necessary.  Returns nil if it
+// doesn't exist and can't be created; use CreateCollection to find out why.
+func (db *DocumentBundle) Collection(name string) *DocumentBundle {
+	coll, _ := db.CreateCollection(name)
+	return coll
+}
+
+// Return the named collection, creating it if it doesn't already exist.
+func (db *DocumentBundle) CreateCollection(name string) (*DocumentBundle, error) {
+	db.Lock()
+	defer db.Unlock()
+	root := db.root
+	if coll, present := root.collections[name]; present {
+		return coll, nil
+	}
+	if len(name) == 0 || len(name) > maxNameLength || bytes.IndexByte([]byte(name), 0) != -1 {
+		return nil, ErrBadCollectionName
+	}
+
+	if slotPos, found := root.findCollectionSlot(name); found {
+		return root.openCollection(name, slotPos), nil
+	}
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	}
+	return root.doCreateCollection(name)
+}
+
+// Return the named collection, or ErrNoSuchCollection if it doesn't exist.
+// Unlike CreateCollection, never writes to the file.
+func (db *DocumentBundle) OpenCollection(name string) (*DocumentBundle, error) {
+	db.Lock()
+	defer db.Unlock()
+	root := db.root
+	if coll, present := root.collections[name]; present {
+		return coll, nil
+	}
+	//An empty name would find a free slot
+	if name != "" {
+		if slotPos, found := root.findCollectionSlot(name); found {
+			return root.openCollection(name, slotPos), nil
+		}
+	}
+	return nil, ErrNoSuchCollection
+}
+
+// Create the named collection, or open it if it already exists, without
+// acquiring the lock.
+func (db *DocumentBundle) doCreateCollection(name string) (*DocumentBundle, error) {
+	root := db.root
+	if coll, present := root.collections[name]; present {
+		return coll, nil
+	}
+	slotPos, found := root.findCollectionSlot(name)
+	if !found {
+		slotPos, found = root.findCollectionSlot("")
+		if !found {
+			return nil, ErrTooManyCollections
+		}
+		//Clear out anything left behind by a dropped collection
+		root.writeBytes(slotPos, make([]byte, catalogSlot))
+		root.writeBytes(slotPos, []byte(name))
+	}
+
+	return root.openCollection(name, slotPos), nil
+}
+
+// Remove the named collection and all its documents.  The space they occupied
+// is reclaimed on the next Compact.  Handles to the collection must not be
+// used afterwards.
+func (db *DocumentBundle) DropCollection(name string) error {
+	db.Lock()
+	defer db.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	return db.doDropCollection(name)
+}
+
+// Drop the named collection without acquiring the lock.
+func (db *DocumentBundle) doDropCollection(name string) error {
+	root := db.root
+	slotPos, found := root.findCollectionSlot(name)
+	if name == "" || !found {
+		return ErrNoSuchCollection
+	}
+	coll, present := root.collections[name]
+	if !present {
+		coll = root.openCollection(name, slotPos)
+	}
+	root.writeBytes(slotPos, make([]byte, catalogSlot))
+	root.journal(journalReset, 0)
+	coll.releaseIndexes()
+	coll.indexes = make(map[string]*index, 0)
+	coll.builds = nil
+	coll.expiry = expiryTracker{}
+	delete(root.collections, name)
+	coll.publishChange(ChangeEvent{Op: OpDropCollection})
+	return nil
+}
+
+// Names of all the named collections in the file.  The default collection is
+// not included.
+func (db *DocumentBundle) CollectionNames() []string {
+	db.readLock()
+	defer db.RUnlock()
+	var out []string
+	for i := 0; i < maxCollections; i++ {
+		if name := db.root.collectionNameAt(catalogStart + uint64(i)*catalogSlot); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// Name of this collection, "" for the default.
+func (db *DocumentBundle) Name() string {
+	return db.name
+}
+
+func (db *DocumentBundle) collectionNameAt(slotPos uint64) string {
+	nameBytes := db.AsBytes[slotPos : slotPos+maxNameLength]
+	if end := bytes.IndexByte(nameBytes, 0); end != -1 {
+		nameBytes = nameBytes[:end]
+	}
+	return string(nameBytes)
+}
+
+// Return the position of the catalog slot with the given name, or the first
+// free one if name is "".
+func (db *DocumentBundle) findCollectionSlot(name string) (uint64, bool) {
+	for i := 0; i < maxCollections; i++ {
+		slotPos := catalogStart + uint64(i)*catalogSlot
+		if db.collectionNameAt(slotPos) == name {
+			return slotPos, true
+		}
+	}
+	return 0, false
+}
+
+// The default collection & every named collection in the file, opening any that
+// haven't been yet.  Assumes the lock is held.
+func (db *DocumentBundle) allCollections() []*DocumentBundle {
+	root := db.root
+	out := []*DocumentBundle{root}
+	for i := 0; i < maxCollections; i++ {
+		slotPos := catalogStart + uint64(i)*catalogSlot
+		name := root.collectionNameAt(slotPos)
+		if name == "" {
+			continue
+		}
+		coll, present := root.collections[name]
+		if !present {
+			coll = root.openCollection(name, slotPos)
+		}
+		out = append(out, coll)
+	}
+	return out
+}
+
+// Views of the default collection & every named collection in the file, enough
+// to read their lists & header counts.  Unlike allCollections this doesn't open
+// handles for collections that haven't been, so the read lock is enough.
+func (db *DocumentBundle) collectionViews() []*DocumentBundle {
+	root := db.root
+	out := []*DocumentBundle{root}
+	for i := 0; i < maxCollections; i++ {
+		slotPos := catalogStart + uint64(i)*catalogSlot
+		name := root.collectionNameAt(slotPos)
+		if name == "" {
+			continue
+		}
+		out = append(out, &DocumentBundle{AsBytes: root.AsBytes, name: name, headPos: slotPos + maxNameLength, root: root})
+	}
+	return out
+}
+
+// The default collection & the named collections opened so far.  Collections
+// that haven't been opened have no indexes, hooks or subscribers, so this is
+// enough for anything concerning in-memory state, and doesn't need the write
+// lock.
+func (db *DocumentBundle) openedCollections() []*DocumentBundle {
+	out := []*DocumentBundle{db.root}
+	for _, coll := range db.root.collections {
+		out = append(out, coll)
+	}
+	return out
+}
+
+// Create a handle for the collection in the given catalog slot.  Called on the
+// root.
+func (db *DocumentBundle) openCollection(name string, slotPos uint64) *DocumentBundle {
+	coll := &DocumentBundle{
+		RWMutex: db.RWMutex,
+		AsBytes: db.AsBytes,
+		FileLoc: db.FileLoc,
+		indexes: make(map[string]*index, 0),
+		changes: db.changes,
+		name:    name,
+		headPos: slotPos + maxNameLength,
+		root:    db,
+	}
+	db.collections[name] = coll
+	return coll
+}
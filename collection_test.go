@@ -0,0 +1,142 @@
+package clownshoes
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCollections(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	users := db.Collection("users")
+	sessions := db.Collection("sessions")
+	if users == nil || sessions == nil || db.Collection("users") != users {
+		t.Fatal("Collections not created")
+	}
+	if _, e := db.CreateCollection(strings.Repeat("x", 33)); e != ErrBadCollectionName {
+		t.Error("Overlong name accepted")
+	}
+	users.AddIndex("identity", func(b []byte) string { return string(b) })
+
+	//Interleave the collections in the file
+	for i := 0; i < 100; i++ {
+		db.PutDocument(NewDocument([]byte("default")))
+		users.PutDocument(NewDocument([]byte("user")))
+		sessions.PutDocument(NewDocument([]byte("session")))
+	}
+	all := func(b []byte) bool { return true }
+	if len(db.GetDocuments(all)) != 100 || len(users.GetDocuments(all)) != 100 || len(sessions.GetDocuments(all)) != 100 {
+		t.Error("Documents leaked between collections")
+	}
+
+	//Growing a document that's followed by another collection's must not clobber it
+	users.ReplaceDocuments(func(b []byte) ([]byte, bool) { return []byte("a much longer user"), true })
+	sessions.RemoveDocuments(func(b []byte) bool { return true })
+	if len(db.GetDocuments(func(b []byte) bool { return string(b) == "default" })) != 100 {
+		t.Error("Default collection damaged by replacement")
+	}
+	if len(users.GetDocumentsWhere("identity", "a much longer user")) != 100 {
+		t.Error("Indexed lookup failed in collection")
+	}
+
+	db.Compact()
+	if len(db.GetDocuments(all)) != 100 || len(users.GetDocuments(all)) != 100 || len(sessions.GetDocuments(all)) != 0 {
+		t.Error("Documents lost in compaction")
+	}
+	if len(users.GetDocumentsWhere("identity", "a much longer user")) != 100 {
+		t.Error("Collection index not rebuilt by compaction")
+	}
+
+	//Reopening sees the catalog
+	db.Sync()
+	db2 := NewDB(f.Name())
+	names := db2.CollectionNames()
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "sessions" || names[1] != "users" {
+		t.Error("Wrong collections after reopening", names)
+	}
+	if len(db2.Collection("users").GetDocuments(all)) != 100 {
+		t.Error("Collection documents missing after reopening")
+	}
+
+	if db.DropCollection("users") != nil || db.DropCollection("users") != ErrNoSuchCollection {
+		t.Error("Drop failed")
+	}
+	if len(db.CollectionNames()) != 1 || len(db.Collection("users").GetDocuments(all)) != 0 {
+		t.Error("Dropped collection still present")
+	}
+}
+
+func TestCollectionOffsets(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	users := db.Collection("users")
+	var userOffsets []uint64
+	for i := 0; i < 5; i++ {
+		db.PutDocument(NewDocument([]byte("default")))
+		offset, _ := users.PutDocument(NewDocument([]byte("user")))
+		userOffsets = append(userOffsets, offset)
+	}
+
+	//Offsets of other collections' documents are refused, wherever they are
+	for _, offset := range userOffsets {
+		if e := db.RemoveDocumentAt(offset); e != ErrNoDocument {
+			t.Error("Removed another collection's document at", offset, e)
+		}
+		if _, e := db.GetDocumentAt(offset); e != ErrNoDocument {
+			t.Error("Read another collection's document at", offset, e)
+		}
+	}
+	if problems := db.Verify(); len(problems) != 0 || db.Count() != 5 || users.Count() != 5 {
+		t.Error("File damaged", problems, db.Count(), users.Count())
+	}
+
+	if e := users.RemoveDocumentAt(userOffsets[1]); e != nil {
+		t.Error("Problem removing document", e)
+	}
+	if e := users.RemoveDocumentAt(userOffsets[1]); e != ErrNoDocument {
+		t.Error("Removed a document twice", e)
+	}
+	if problems := db.Verify(); len(problems) != 0 || users.Count() != 4 {
+		t.Error("File damaged", problems, users.Count())
+	}
+
+	//The space at the end of the file is reused by whichever collection writes
+	//next, and compaction moves everything
+	last := userOffsets[4]
+	users.RemoveDocumentAt(last)
+	if offset, _ := db.PutDocument(NewDocument([]byte("default"))); offset != last {
+		t.Fatal("Space at the end wasn't reused", offset, last)
+	}
+	if _, e := users.GetDocumentAt(last); e != ErrNoDocument {
+		t.Error("Read a reused offset from its old collection", e)
+	}
+	if doc, e := db.GetDocumentAt(last); e != nil || string(doc.Payload) != "default" {
+		t.Error("Problem reading a reused offset", e)
+	}
+	db.Compact()
+	users.ForEachDocument(func(offset uint64, _ Document) bool {
+		if _, e := users.GetDocumentAt(offset); e != nil {
+			t.Error("Problem reading a compacted document", e)
+		}
+		if _, e := db.GetDocumentAt(offset); e != ErrNoDocument {
+			t.Error("Read another collection's compacted document", e)
+		}
+		return true
+	})
+}
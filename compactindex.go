@@ -0,0 +1,319 @@
+package clownshoes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// Compact indexes keep their postings in a table sorted by key, in a sidecar
+// file mapped read-only, with a Bloom filter of the keys in memory.  Lookups of
+// keys the filter rules out never touch the table; the rest binary search it.
+// The table is written once, so changes since it was built are kept in memory
+// alongside it, and folded in when it's rebuilt, which Compact does since it
+// moves every document anyway.  The sidecar is unlinked as soon as it's
+// created, so it disappears with the process, and compact indexes aren't
+// included in index dumps.
+//
+// Table layout: for each key in order, the uvarint length of the key, the key,
+// the uvarint number of offsets, and the offsets in ascending order as uvarint
+// deltas.  Then the position of each key's entry as a big-endian uint64, and
+// finally the number of keys.
+
+type CompactIndexOptions struct {
+	FalsePositiveRate float64 //Of the Bloom filter, trading memory for table reads on misses.  DefaultFalsePositiveRate if zero
+	Dir               string  //Where to write the table; the DB file's directory if empty
+}
+
+const DefaultFalsePositiveRate = 0.01
+
+type compactIndex struct {
+	opts    CompactIndexOptions
+	dir     string
+	file    *os.File
+	table   []byte //Mapped sidecar file
+	count   int    //Number of keys in the table
+	bloom   *bloomFilter
+	added   map[string][]uint64 //Postings added since the table was built
+	removed map[uint64]bool     //Offsets in the table removed since it was built
+	keys    int                 //Distinct keys, counting those whose documents have since been removed
+	err     error               //Why the last build failed, if it did
+}
+
+// Add an index like AddIndex, but keeping its postings on disk.  Returns an
+// error if the table can't be written.  If it can't be written when the index
+// is rebuilt, the index keeps everything in memory until the next rebuild.
+func (db *DocumentBundle) AddCompactIndex(indexName string, keyFn func([]byte) string, opts CompactIndexOptions) error {
+	if opts.FalsePositiveRate == 0 {
+		opts.FalsePositiveRate = DefaultFalsePositiveRate
+	}
+	if !(opts.FalsePositiveRate > 0 && opts.FalsePositiveRate < 1) {
+		return errors.New("clownshoes: false positive rate must be between 0 and 1")
+	}
+	db.Lock()
+	defer db.Unlock()
+	dir := opts.Dir
+	if dir == "" {
+		dir = filepath.Dir(db.root.FileLoc)
+	}
+	//Any existing index stays in place unless the new one can be built
+	idx := newIndexLike(&index{keyFn: keyFn, compact: &compactIndex{opts: opts, dir: dir}})
+	db.doRebuildIndex(idx)
+	if err := idx.compact.err; err != nil {
+		idx.release()
+		return err
+	}
+	db.doPutIndex(indexName, idx)
+	db.publishIndexAdded(indexName)
+	return nil
+}
+
+// Write a new table for the index from the collection's current contents.
+// Assumes the write lock is held.
+func (db *DocumentBundle) doBuildCompactIndex(idx *index) error {
+	c := idx.compact
+	c.release()
+	c.added = make(map[string][]uint64)
+	c.removed = make(map[uint64]bool)
+	c.bloom, c.keys = nil, 0
+
+	s := newSorter(&Ordering{})
+	db.doForEachDocument(func(offset uint64, doc Document) {
+		if key, covered := idx.keyOf(doc.Payload); covered {
+			s.addKey(offset, []byte(key))
+			idx.postings++
+			if idx.keys != nil {
+				idx.keys[offset] = key
+			}
+		}
+	})
+	c.err = c.writeTable(s)
+	if c.err != nil {
+		c.release()
+		idx.postings = 0
+	}
+	return c.err
+}
+
+// Write and map the table from the sorted keys, and fill in the filter.
+func (c *compactIndex) writeTable(s *sorter) error {
+	f, err := ioutil.TempFile(c.dir, "clownshoes-index")
+	if err != nil {
+		s.finishRecords(func(*sortRecord) bool { return false })
+		return err
+	}
+	os.Remove(f.Name())
+	c.file = f
+	positions, err := ioutil.TempFile(c.dir, "clownshoes-index")
+	if err != nil {
+		s.finishRecords(func(*sortRecord) bool { return false })
+		return err
+	}
+	os.Remove(positions.Name())
+	defer positions.Close()
+
+	w, pw := bufio.NewWriter(f), bufio.NewWriter(positions)
+	var pos uint64
+	var entry []byte
+	var key []byte
+	var offsets []uint64
+	var buf [binary.MaxVarintLen64]byte
+	flush := func() {
+		entry = entry[:0]
+		entry = append(entry, buf[:binary.PutUvarint(buf[:], uint64(len(key)))]...)
+		entry = append(entry, key...)
+		entry = append(entry, buf[:binary.PutUvarint(buf[:], uint64(len(offsets)))]...)
+		sortOffsets(offsets)
+		prev := uint64(0)
+		for _, offset := range offsets {
+			entry = append(entry, buf[:binary.PutUvarint(buf[:], offset-prev)]...)
+			prev = offset
+		}
+		w.Write(entry)
+		binary.BigEndian.PutUint64(buf[:8], pos)
+		pw.Write(buf[:8])
+		pos += uint64(len(entry))
+		c.count++
+	}
+	err = s.finishRecords(func(rec *sortRecord) bool {
+		if offsets != nil && !bytes.Equal(rec.key, key) {
+			flush()
+			offsets = offsets[:0]
+		}
+		key = rec.key
+		offsets = append(offsets, rec.offset)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(offsets) != 0 {
+		flush()
+	}
+	binary.BigEndian.PutUint64(buf[:8], uint64(c.count))
+	if err := pw.Flush(); err != nil {
+		return err
+	}
+	if _, err := positions.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, positions); err != nil {
+		return err
+	}
+	if _, err := f.Write(buf[:8]); err != nil {
+		return err
+	}
+
+	size := int(pos) + 8*c.count + 8
+	if c.table, err = syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+		return err
+	}
+	//Leave room for keys added before the next rebuild
+	c.bloom = newBloomFilter(c.count+c.count/4+1024, c.opts.FalsePositiveRate)
+	for i := 0; i < c.count; i++ {
+		key, _, _ := c.entryAt(c.position(i), false)
+		c.bloom.add(key)
+	}
+	c.keys = c.count
+	return nil
+}
+
+// Unmap and close the table.
+func (c *compactIndex) release() {
+	if c.table != nil {
+		syscall.Munmap(c.table)
+		c.table = nil
+	}
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	c.count = 0
+}
+
+// Position of the ith key's entry in the table.
+func (c *compactIndex) position(i int) uint64 {
+	base := len(c.table) - 8 - 8*c.count
+	return binary.BigEndian.Uint64(c.table[base+8*i:])
+}
+
+// Parse the entry at pos, returning its key, its offsets if wanted, and the
+// position of the next entry.
+func (c *compactIndex) entryAt(pos uint64, wantOffsets bool) (string, []uint64, uint64) {
+	keyLen, n := binary.Uvarint(c.table[pos:])
+	pos += uint64(n)
+	key := string(c.table[pos : pos+keyLen])
+	pos += keyLen
+	count, n := binary.Uvarint(c.table[pos:])
+	pos += uint64(n)
+	var offsets []uint64
+	if wantOffsets {
+		offsets = make([]uint64, 0, count)
+	}
+	prev := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		delta, n := binary.Uvarint(c.table[pos:])
+		pos += uint64(n)
+		prev += delta
+		if wantOffsets {
+			offsets = append(offsets, prev)
+		}
+	}
+	return key, offsets, pos
+}
+
+// The offsets under the key in the table, including removed ones.
+func (c *compactIndex) tableGet(key string) []uint64 {
+	if c.table == nil || !c.bloom.mayContain(key) {
+		return nil
+	}
+	i := sort.Search(c.count, func(i int) bool {
+		k, _, _ := c.entryAt(c.position(i), false)
+		return k >= key
+	})
+	if i == c.count {
+		return nil
+	}
+	k, offsets, _ := c.entryAt(c.position(i), true)
+	if k != key {
+		return nil
+	}
+	return offsets
+}
+
+func (c *compactIndex) add(key string, offset uint64) {
+	if _, found := c.added[key]; !found && c.tableGet(key) == nil {
+		c.keys++
+	}
+	if c.bloom != nil {
+		c.bloom.add(key)
+	}
+	c.added[key] = append(c.added[key], offset)
+}
+
+// Returns whether the offset was there.
+func (c *compactIndex) remove(key string, offset uint64) bool {
+	arr := c.added[key]
+	for i := range arr {
+		if arr[i] == offset {
+			arr[i] = arr[len(arr)-1]
+			c.added[key] = arr[:len(arr)-1]
+			if len(arr) == 1 {
+				delete(c.added, key)
+			}
+			return true
+		}
+	}
+	if c.removed[offset] {
+		return false
+	}
+	for _, tableOffset := range c.tableGet(key) {
+		if tableOffset == offset {
+			c.removed[offset] = true
+			return true
+		}
+	}
+	return false
+}
+
+// Keep the offsets that haven't been removed, followed by those added since.
+func (c *compactIndex) merge(key string, tableOffsets []uint64) []uint64 {
+	out := tableOffsets[:0]
+	for _, offset := range tableOffsets {
+		if !c.removed[offset] {
+			out = append(out, offset)
+		}
+	}
+	return append(out, c.added[key]...)
+}
+
+func (c *compactIndex) get(key string) []uint64 {
+	return c.merge(key, c.tableGet(key))
+}
+
+func (c *compactIndex) forEachKey(proc func(key string, offsets []uint64)) {
+	var pos uint64
+	for i := 0; i < c.count; i++ {
+		var key string
+		var offsets []uint64
+		key, offsets, pos = c.entryAt(pos, true)
+		if offsets = c.merge(key, offsets); len(offsets) != 0 {
+			proc(key, offsets)
+		}
+	}
+	for key, offsets := range c.added {
+		if c.tableGet(key) == nil {
+			proc(key, offsets)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package clownshoes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	b := newBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		b.add(strconv.Itoa(i))
+	}
+	for i := 0; i < 10000; i++ {
+		if !b.mayContain(strconv.Itoa(i)) {
+			t.Fatal("False negative for", i)
+		}
+	}
+	falsePositives := 0
+	for i := 10000; i < 110000; i++ {
+		if b.mayContain(strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 100000; rate > 0.02 {
+		t.Error("False positive rate too high", rate)
+	}
+}
+
+func TestCompactIndex(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	for i := 0; i < 20000; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf("k%d:%d", i%3000, i))))
+	}
+	keyFn := func(b []byte) string { return strings.Split(string(b), ":")[0] }
+	db.AddIndex("memory", keyFn)
+	if e := db.AddCompactIndex("compact", keyFn, CompactIndexOptions{Dir: os.TempDir()}); e != nil {
+		t.Fatal("Couldn't add compact index", e)
+	}
+
+	check := func(stage string) {
+		for i := 0; i < 3100; i += 7 {
+			key := "k" + strconv.Itoa(i)
+			a, b := db.GetDocumentsWhere("memory", key), db.GetDocumentsWhere("compact", key)
+			as, bs := map[string]bool{}, map[string]bool{}
+			for _, doc := range a {
+				as[string(doc.Payload)] = true
+			}
+			for _, doc := range b {
+				bs[string(doc.Payload)] = true
+			}
+			if len(a) != len(b) || fmt.Sprint(as) != fmt.Sprint(bs) {
+				t.Fatal(stage, "lookups differ for", key, len(a), len(b))
+			}
+		}
+		if a, b := db.DistinctKeys("memory"), db.DistinctKeys("compact"); strings.Join(a, ",") != strings.Join(b, ",") {
+			t.Error(stage, "distinct keys differ", len(a), len(b))
+		}
+		stats, _ := db.Stats()
+		if stats.Indexes["memory"].Postings != stats.Indexes["compact"].Postings {
+			t.Error(stage, "postings differ", stats.Indexes)
+		}
+	}
+	check("built")
+
+	//Changes are kept alongside the table until it's rebuilt
+	for i := 0; i < 500; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf("k%d:new", 3000+i%100))))
+	}
+	db.RemoveDocumentsWhere("memory", "k14", func([]byte) bool { return true })
+	db.ReplaceDocumentsWhere("memory", "k21", func(b []byte) ([]byte, bool) {
+		return []byte("k3001:" + string(b) + " moved somewhere longer"), true
+	})
+	check("changed")
+	if db.ExistsWhere("compact", "k14") || db.CountWhere("compact", "k3001") != 5+len(db.GetDocumentsWhere("memory", "k21"))+7 {
+		t.Error("Wrong counts after changes", db.CountWhere("compact", "k3001"))
+	}
+
+	db.Compact()
+	if idx := db.indexes["compact"]; len(idx.compact.added) != 0 || len(idx.compact.removed) != 0 || idx.compact.table == nil {
+		t.Error("Compaction didn't rebuild the table")
+	}
+	check("compacted")
+
+	//Removing an offset that isn't under the key leaves the count alone
+	idx := db.indexes["compact"]
+	postings := idx.postings
+	offset := idx.get("k1")[0]
+	idx.remove("k2", offset)
+	idx.remove("k1", offset)
+	idx.remove("k1", offset)
+	if idx.postings != postings-1 {
+		t.Error("Wrong postings after removals", idx.postings, postings)
+	}
+	idx.add("k1", offset)
+
+	if e := db.AddCompactIndex("compact", keyFn, CompactIndexOptions{Dir: "/nonexistent"}); e == nil {
+		t.Error("Expected error replacing the index")
+	}
+	if db.indexes["compact"].compact.table == nil {
+		t.Error("Failed replacement released the existing index")
+	}
+	check("replacement failed")
+
+	//Replacing it with a built or loaded index releases the table
+	compact := db.indexes["compact"].compact
+	if e := <-db.AddIndexAsync("compact", keyFn); e != nil || compact.table != nil {
+		t.Error("Built replacement didn't release the table", e)
+	}
+	check("replaced by build")
+	idxFile := f.Name() + ".idx"
+	defer os.Remove(idxFile)
+	db.dumpIndexes(idxFile)
+	if e := db.AddCompactIndex("compact", keyFn, CompactIndexOptions{}); e != nil {
+		t.Fatal("Problem re-adding compact index", e)
+	}
+	compact = db.indexes["compact"].compact
+	if e := db.LoadIndexes(map[string]func([]byte) string{"memory": keyFn, "compact": keyFn}, idxFile); e != nil || compact.table != nil {
+		t.Error("Loaded replacement didn't release the table", e)
+	}
+	check("replaced by load")
+
+	db.RemoveIndex("compact")
+	if e := db.AddCompactIndex("bad", keyFn, CompactIndexOptions{Dir: "/nonexistent"}); e == nil {
+		t.Error("Expected error writing table to a missing directory")
+	}
+	if _, found := db.indexes["bad"]; found {
+		t.Error("Failed index left in place")
+	}
+}
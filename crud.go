@@ -1,17 +1,29 @@
 package clownshoes
 
+import "bytes"
+
 // Publicly facing higher-order modification functions
 
+// Mutations return ErrReadOnly on a DB that doesn't allow them, such as a
+// replication follower.
+
+// Expired documents are invisible to reads and replacements even before they
+// are reaped, but may still be removed.
+
 // Using the index with the given name, look up all the documents with the
 // given key and return them.
 func (db *DocumentBundle) GetDocumentsWhere(indexName string, lookupKey string) (docs []Document) {
-	db.RLock()
+	db.readLock()
 	defer db.RUnlock()
+	now := timeNow().UnixNano()
 	idx, found := db.indexes[indexName]
 	if found {
-		offsets := idx.lookup[lookupKey]
+		offsets := idx.get(lookupKey)
 		for _, offset := range offsets {
-			docs = append(docs, db.doGetDocumentAt(offset))
+			doc := db.doGetDocumentAt(offset)
+			if !doc.expiredAt(now) {
+				docs = append(docs, doc)
+			}
 		}
 	}
 	return docs
@@ -20,11 +32,12 @@ func (db *DocumentBundle) GetDocumentsWhere(indexName string, lookupKey string)
 // Return all the documents for which the given function returns true, scanning
 // the DB to do so.
 func (db *DocumentBundle) GetDocuments(filter func([]byte) bool) (docs []Document) {
-	db.RLock()
+	db.readLock()
 	defer db.RUnlock()
+	now := timeNow().UnixNano()
 
 	db.doForEachDocument(func(offset uint64, doc Document) {
-		if filter(doc.Payload) {
+		if !doc.expiredAt(now) && filter(doc.Payload) {
 			docs = append(docs, doc)
 		}
 	})
@@ -32,90 +45,277 @@ func (db *DocumentBundle) GetDocuments(filter func([]byte) bool) (docs []Documen
 	return docs
 }
 
+// Run proc over each live document in the collection along with its offset,
+// stopping early if it returns false.  The payloads point into the mapping, so
+// must be copied if they are to outlive the call.
+func (db *DocumentBundle) ForEachDocument(proc func(offset uint64, doc Document) bool) {
+	db.readLock()
+	defer db.RUnlock()
+	now := timeNow().UnixNano()
+
+	pos := db.getFirstDocOffset()
+	for pos != 0 {
+		doc := db.doGetDocumentAt(pos)
+		if !doc.expiredAt(now) && !proc(pos, doc) {
+			return
+		}
+		pos = doc.NextDocOffset
+	}
+}
+
+// As ForEachDocument, but starting from the document at the given offset, to
+// resume a walk.  Returns ErrNoDocument if there isn't a live document of this
+// collection there.
+func (db *DocumentBundle) ForEachDocumentFrom(offset uint64, proc func(offset uint64, doc Document) bool) error {
+	db.readLock()
+	defer db.RUnlock()
+	if !db.doIsDocumentAt(offset) {
+		return ErrNoDocument
+	}
+	now := timeNow().UnixNano()
+
+	pos := offset
+	for pos != 0 {
+		doc := db.doGetDocumentAt(pos)
+		if !doc.expiredAt(now) && !proc(pos, doc) {
+			return nil
+		}
+		pos = doc.NextDocOffset
+	}
+	return nil
+}
+
+// As ForEachDocument, but over the documents with the given key in the named
+// index.  Does nothing if there is no such index.
+func (db *DocumentBundle) ForEachDocumentWhere(indexName string, lookupKey string, proc func(offset uint64, doc Document) bool) {
+	db.readLock()
+	defer db.RUnlock()
+	now := timeNow().UnixNano()
+	idx, found := db.indexes[indexName]
+	if found {
+		for _, offset := range idx.get(lookupKey) {
+			doc := db.doGetDocumentAt(offset)
+			if !doc.expiredAt(now) && !proc(offset, doc) {
+				return
+			}
+		}
+	}
+}
+
+// Return the document at the given offset, or ErrNoDocument if there isn't a
+// live document of this collection there.
+func (db *DocumentBundle) GetDocumentAt(offset uint64) (Document, error) {
+	db.readLock()
+	defer db.RUnlock()
+	if !db.doIsDocumentAt(offset) {
+		return Document{}, ErrNoDocument
+	}
+	doc := db.doGetDocumentAt(offset)
+	if doc.expiredAt(timeNow().UnixNano()) {
+		return Document{}, ErrNoDocument
+	}
+	return doc, nil
+}
+
 // Using the index, run the replacer function on all the documents with the given
 // key.  If the second return value of the replacer function is true, replace the
-// document with the first return value.  Returns the number of documents affected.
-func (db *DocumentBundle) ReplaceDocumentsWhere(indexName string, lookupKey string, replacer func([]byte) ([]byte, bool)) (counter uint64) {
+// document with the first return value.  Returns the number of documents affected,
+// stopping at the first error returned by a hook.
+func (db *DocumentBundle) ReplaceDocumentsWhere(indexName string, lookupKey string, replacer func([]byte) ([]byte, bool)) (counter uint64, err error) {
 	db.Lock()
 	defer db.Unlock()
+	if err = db.checkWritable(); err != nil {
+		return 0, err
+	}
 
+	now := timeNow().UnixNano()
 	idx, found := db.indexes[indexName]
 	if found {
-		offsets := idx.lookup[lookupKey]
+		//Replacements modify the posting list as we go
+		offsets := append([]uint64(nil), idx.get(lookupKey)...)
 		for _, offset := range offsets {
-			newPayload, modified := replacer(db.doGetDocumentAt(offset).Payload)
+			curDoc := db.doGetDocumentAt(offset)
+			if curDoc.expiredAt(now) {
+				continue
+			}
+			newPayload, modified := replacer(curDoc.Payload)
 			if modified {
-				db.doReplaceDocument(offset, NewDocument(newPayload))
+				if _, err = db.doReplaceDocument(offset, NewDocument(newPayload)); err != nil {
+					return counter, err
+				}
 				counter++
 			}
 		}
 	}
-	return counter
+	return counter, nil
 }
 
 // For all valid documents, if the second return value of the replacer function
 // ran over the payload is true, replace the payload with the first return
-// value. Returns the number of documents affected.
-func (db *DocumentBundle) ReplaceDocuments(replacer func([]byte) ([]byte, bool)) (counter uint64) {
+// value. Returns the number of documents affected, stopping at the first error
+// returned by a hook.
+func (db *DocumentBundle) ReplaceDocuments(replacer func([]byte) ([]byte, bool)) (counter uint64, err error) {
 	db.Lock()
 	defer db.Unlock()
+	if err = db.checkWritable(); err != nil {
+		return 0, err
+	}
 
 	//This traverses in reverse to avoid an infinite loop with modifications that
 	//expand documents, which results in an insert at the end of the file.
+	now := timeNow().UnixNano()
 	pos := db.getLastDocOffset()
 	for pos != 0 {
 		curDoc := db.doGetDocumentAt(pos)
+		if curDoc.expiredAt(now) {
+			pos = curDoc.PrevDocOffset
+			continue
+		}
 		newPayload, modified := replacer(curDoc.Payload)
 		if modified {
-			db.doReplaceDocument(pos, NewDocument(newPayload))
+			if _, err = db.doReplaceDocument(pos, NewDocument(newPayload)); err != nil {
+				return counter, err
+			}
 			counter++
 		}
 		pos = curDoc.PrevDocOffset
 	}
-	return counter
+	return counter, nil
+}
+
+// Using the index, replace the first live document with the given key with doc,
+// taking doc's expiry even if that's none, and remove the rest, or insert doc
+// if there are none.  Readers see the change all at once.  Returns the offset
+// of doc, or the first error returned by a hook, which leaves the existing
+// documents in place if it rejects the replacement or insertion.
+func (db *DocumentBundle) SetDocumentWhere(indexName string, lookupKey string, doc Document) (uint64, error) {
+	db.Lock()
+	defer db.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	var offsets []uint64
+	if idx, found := db.indexes[indexName]; found {
+		//Replacements modify the posting list as we go
+		offsets = append(offsets, idx.get(lookupKey)...)
+	}
+	now := timeNow().UnixNano()
+	replaced := -1
+	for i, offset := range offsets {
+		if doc := db.doGetDocumentAt(offset); !doc.expiredAt(now) {
+			replaced = i
+			break
+		}
+	}
+	var newOffset uint64
+	var err error
+	if replaced == -1 {
+		newOffset, err = db.doPutDocument(doc)
+	} else {
+		newOffset, err = db.doSetDocument(offsets[replaced], doc)
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i, offset := range offsets {
+		if i == replaced {
+			continue
+		}
+		if err := db.doRemoveDocumentAt(offset); err != nil {
+			return newOffset, err
+		}
+	}
+	return newOffset, nil
 }
 
 // Using the index with the given name, remove all documents with the given key
 // and where the supplied function of the payload returns true.  Returns the
-// number of documents affected.
-func (db *DocumentBundle) RemoveDocumentsWhere(indexName string, lookupKey string, filter func([]byte) bool) (counter uint64) {
+// number of documents affected, stopping at the first error returned by a hook.
+func (db *DocumentBundle) RemoveDocumentsWhere(indexName string, lookupKey string, filter func([]byte) bool) (counter uint64, err error) {
 	db.Lock()
 	defer db.Unlock()
+	if err = db.checkWritable(); err != nil {
+		return 0, err
+	}
 
 	idx, found := db.indexes[indexName]
 	if found {
-		offsets := idx.lookup[lookupKey]
+		//Removals modify the posting list as we go
+		offsets := append([]uint64(nil), idx.get(lookupKey)...)
 		for _, offset := range offsets {
 			if filter(db.doGetDocumentAt(offset).Payload) {
-				db.doRemoveDocumentAt(offset)
+				if err = db.doRemoveDocumentAt(offset); err != nil {
+					return counter, err
+				}
 				counter++
 			}
 		}
 	}
-	return counter
+	return counter, nil
 }
 
 // Remove all documents where the supplied function of their payloads returns true.
-// Scans the whole DB and returns the number of documents affected.
-func (db *DocumentBundle) RemoveDocuments(filter func([]byte) bool) (counter uint64) {
+// Scans the whole DB and returns the number of documents affected, stopping at
+// the first error returned by a hook.
+func (db *DocumentBundle) RemoveDocuments(filter func([]byte) bool) (counter uint64, err error) {
 	db.Lock()
 	defer db.Unlock()
+	if err = db.checkWritable(); err != nil {
+		return 0, err
+	}
 
-	db.doForEachDocument(func(offset uint64, doc Document) {
-		if filter(doc.Payload) {
-			db.doRemoveDocumentAt(offset)
+	pos := db.getFirstDocOffset()
+	for pos != 0 {
+		curDoc := db.doGetDocumentAt(pos)
+		if filter(curDoc.Payload) {
+			if err = db.doRemoveDocumentAt(pos); err != nil {
+				return counter, err
+			}
 			counter++
 		}
-	})
+		pos = curDoc.NextDocOffset
+	}
+	return counter, nil
+}
 
-	return counter
+// Remove the document at the given offset.  Returns ErrNoDocument if there
+// isn't one in this collection, or the error from a hook.
+func (db *DocumentBundle) RemoveDocumentAt(offset uint64) error {
+	db.Lock()
+	defer db.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if !db.doIsDocumentAt(offset) {
+		return ErrNoDocument
+	}
+	return db.doRemoveDocumentAt(offset)
+}
+
+// As RemoveDocumentAt, but only if the document there still has the given
+// payload, since the offset may have been freed and reused since it was read.
+func (db *DocumentBundle) removeDocumentIf(offset uint64, payload []byte) error {
+	db.Lock()
+	defer db.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if !db.doIsDocumentAt(offset) || !bytes.Equal(db.doGetDocumentAt(offset).Payload, payload) {
+		return ErrNoDocument
+	}
+	return db.doRemoveDocumentAt(offset)
 }
 
-// Insert the given (new) document and return the index at which it was inserted.
+// Insert the given (new) document and return the index at which it was inserted,
+// or an error if a hook rejected it.
 // Right now this always inserts at the end, but if we ever have a use pattern w/
 // lots of removals / growing edits, we could do a malloc-tracking type thing
-func (db *DocumentBundle) PutDocument(doc Document) uint64 {
+func (db *DocumentBundle) PutDocument(doc Document) (uint64, error) {
 	db.Lock()
 	defer db.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return 0, err
+	}
 	return db.doPutDocument(doc)
 }
@@ -2,10 +2,12 @@ package clownshoes
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestDBCreateReadDelete(t *testing.T) {
@@ -166,3 +168,103 @@ func TestDBCompaction(t *testing.T) {
 	t.Log("Compacting")
 	db.Compact()
 }
+
+func TestReplaceAtEndOfMapping(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	db.PutDocument(NewDocument([]byte("first")))
+	last, _ := db.PutDocument(NewDocument([]byte("last")))
+	db.Shrink()
+
+	//The last document in the file grows in place however little room is mapped
+	longer := bytes.Repeat([]byte("longer"), 1000)
+	db.ReplaceDocuments(func(b []byte) ([]byte, bool) {
+		return longer, string(b) == "last"
+	})
+	if doc, e := db.GetDocumentAt(last); e != nil || !bytes.Equal(doc.Payload, longer) {
+		t.Error("Document didn't grow in place", e)
+	}
+	if problems := db.Verify(); len(problems) != 0 {
+		t.Error("File damaged", problems)
+	}
+}
+
+func TestSetDocumentWhere(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	key := func(b []byte) string { return string(b[:1]) }
+	db.AddIndex("key", key)
+	db.PutDocument(NewExpiringDocument([]byte("a1"), time.Now().Add(time.Hour)))
+	db.PutDocument(NewDocument([]byte("a2")))
+	db.PutDocument(NewDocument([]byte("b1")))
+
+	//Replaces one, removes the other, and clears the expiry
+	offset, e := db.SetDocumentWhere("key", "a", NewDocument([]byte("a longer value")))
+	if e != nil {
+		t.Fatal("Problem setting document", e)
+	}
+	docs := db.GetDocumentsWhere("key", "a")
+	if len(docs) != 1 || string(docs[0].Payload) != "a longer value" || docs[0].Expires != 0 {
+		t.Error("Wrong documents after set", docs)
+	}
+	if doc, e := db.GetDocumentAt(offset); e != nil || string(doc.Payload) != "a longer value" {
+		t.Error("Wrong offset returned", e)
+	}
+	if _, e := db.SetDocumentWhere("key", "c", NewDocument([]byte("c1"))); e != nil || db.Count() != 3 {
+		t.Error("Problem inserting through set", e, db.Count())
+	}
+
+	//A rejected replacement leaves the old document
+	db.AddHooks(Hooks{BeforeReplace: func(uint64, []byte, []byte) ([]byte, error) {
+		return nil, errors.New("no")
+	}})
+	if _, e := db.SetDocumentWhere("key", "b", NewDocument([]byte("b2"))); e == nil {
+		t.Error("Hook didn't reject set")
+	}
+	if docs := db.GetDocumentsWhere("key", "b"); len(docs) != 1 || string(docs[0].Payload) != "b1" {
+		t.Error("Rejected set changed documents", docs)
+	}
+	if problems := db.Verify(); len(problems) != 0 {
+		t.Error("File damaged", problems)
+	}
+}
+
+func TestForEachDocumentFrom(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	var offsets []uint64
+	for i := 0; i < 5; i++ {
+		offset, _ := db.PutDocument(NewDocument([]byte{byte(i)}))
+		offsets = append(offsets, offset)
+	}
+	var seen []byte
+	e = db.ForEachDocumentFrom(offsets[2], func(offset uint64, doc Document) bool {
+		seen = append(seen, doc.Payload[0])
+		return true
+	})
+	if e != nil || !bytes.Equal(seen, []byte{2, 3, 4}) {
+		t.Error("Wrong documents from offset", seen, e)
+	}
+	db.RemoveDocumentAt(offsets[2])
+	if e := db.ForEachDocumentFrom(offsets[2], func(uint64, Document) bool { return true }); e != ErrNoDocument {
+		t.Error("Resumed from a removed document", e)
+	}
+}
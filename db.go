@@ -3,6 +3,8 @@ package clownshoes
 //Core data manipulation functions
 
 import (
+	"errors"
+	"io"
 	"os"
 	"reflect"
 	"sync"
@@ -11,15 +13,86 @@ import (
 )
 
 //Storage schema:
-//A uint64 pointer to the position of the first document, or 0 if we're empty
-//A uint64 pointer to the position of the last document, or 0 if we're empty
-//And then a bunch o' documents
+//A 4k header page, containing
+//  A 32 byte list head for the default collection, containing
+//    A uint64 pointer to the position of the first document, or 0 if we're empty
+//    A uint64 pointer to the position of the last document, or 0 if we're empty
+//    A uint64 count of documents
+//    A uint64 count of bytes occupied by documents, including headers
+//  A uint64 pointer to the end of the last document in the file, or 0 if we've never
+//  had one
+//  A uint64 generation, incremented whenever the file is resized & remapped
+//  A uint64 count of modifications, incremented by every change to a document,
+//  which numbers the journal's entries
+//  A uint32 magic number identifying the file as a DB
+//  A uint32 version of this layout, formatVersion
+//  The catalog of named collections (see collection.go)
+//A 64k journal of the most recent changes, for tail readers (see tail.go)
+//And then a bunch o' documents, from all collections
+
+const (
+	tailPos          = 32   //Position of the pointer to the end of the used region
+	generationPos    = 40   //Position of the remap counter
+	modificationsPos = 48   //Position of the modification counter
+	magicPos         = 56   //Position of the magic number
+	versionPos       = 60   //Position of the format version
+	journalStart     = 4096 //Position of the journal
+)
+
+// Position of the first document
+const dataStart = journalStart + journalEntries*journalEntrySize
 
+const (
+	fileMagic = 0x436c5368 //"ClSh"
+	//Files from before the version was recorded have neither it nor the magic
+	//number, and can't be opened.  Version 1 had no journal
+	formatVersion = 2
+)
+
+// A DocumentBundle is a single collection within a file.  The one returned by
+// NewDB is the default collection, and owns the mapping; named collections share
+// its lock and storage.
 type DocumentBundle struct {
-	sync.RWMutex                  //We support per-database write locks as of version 0, aren't we fancy
-	AsBytes      []byte           //Entire mmap'd array.  Includes first & last doc offsets
-	FileLoc      string           //Location of file we're mmaping
-	indexes      map[string]index //For exact-match indexing
+	*sync.RWMutex                            //We support per-file write locks as of version 0, aren't we fancy
+	AsBytes       []byte                     //Entire mmap'd array.  Includes the header page
+	FileLoc       string                     //Location of file we're mmaping
+	indexes       map[string]*index          //For exact-match indexing
+	builds        map[string]*indexBuild     //Indexes being built in the background. See indexbuild.go
+	changes       *changeFeed                //Subscribers to & recent history of modifications, shared by all collections
+	hooks         []Hooks                    //Run around each mutation, in order
+	expiry        expiryTracker              //Finds documents due for reaping
+	name          string                     //Name of the collection, "" for the default
+	headPos       uint64                     //Position of the collection's first & last doc pointers
+	root          *DocumentBundle            //The default collection, which owns the mapping
+	collections   map[string]*DocumentBundle //Named collections opened so far. Only used on the root
+	readOnly      bool                       //Refuse public mutations, eg on a replication follower. Only used on the root
+	options       Options                    //How the file was opened. Only used on the root
+	lockFile      *os.File                   //Holds the advisory lock taken by OpenDB until Close. Only used on the root
+	seenVersion   [2]uint64                  //Generation & modification count as of a tail reader's last refresh. Only used on the root
+	owners        map[uint64]uint64          //List head of each live document's collection, nil until doIsDocumentAt needs it. Only used on the root
+	ownersMu      sync.Mutex                 //Guards building owners under the read lock. Only used on the root
+}
+
+// Options for OpenDB.
+type Options struct {
+	ReadOnly bool //Map the file read-only and take a shared lock, so other readers may open it but writers may not
+	Tail     bool //Open read-only without a lock, following changes made by a writer in another process. See tail.go
+}
+
+var (
+	ErrReadOnly = errors.New("clownshoes: DB is read-only")
+	ErrLocked   = errors.New("clownshoes: file is locked by another process")
+	ErrNotDB    = errors.New("clownshoes: file isn't a DB")
+	ErrVersion  = errors.New("clownshoes: file is from an unsupported format version")
+	ErrLegacy   = errors.New("clownshoes: file is in the unversioned original layout; convert it with MigrateLegacyDB")
+)
+
+// Return ErrReadOnly if public mutations aren't allowed.  Assumes a lock is held.
+func (db *DocumentBundle) checkWritable() error {
+	if db.root.readOnly || db.root.options.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
 }
 
 func (db *DocumentBundle) GetIndexNames() []string {
@@ -35,7 +108,7 @@ func (db *DocumentBundle) HasIndexNamed(n string) bool {
 	return present
 }
 
-//Abstracts writes to allow for transparent journaling.
+// Abstracts writes to allow for transparent journaling.
 func (db *DocumentBundle) writeBytes(pos uint64, data []byte) {
 	copy(db.AsBytes[pos:], data)
 }
@@ -44,21 +117,50 @@ func (db *DocumentBundle) writePointer(pos uint64, data uint64) {
 	uint64ToBytes(db.AsBytes, pos, data)
 }
 
-// Return the offset of the first valid document in the DB, or 0 if there is none
+// Return the offset of the first valid document in the collection, or 0 if there is none
 func (db *DocumentBundle) getFirstDocOffset() uint64 {
-	return uint64FromBytes(db.AsBytes, 0)
+	return uint64FromBytes(db.AsBytes, db.headPos)
 }
 
-// Return the offset of the last valid document in the DB, or 0 if it is empty
+// Return the offset of the last valid document in the collection, or 0 if it is empty
 func (db *DocumentBundle) getLastDocOffset() uint64 {
-	return uint64FromBytes(db.AsBytes, 8)
+	return uint64FromBytes(db.AsBytes, db.headPos+8)
 }
 
 func (db *DocumentBundle) setFirstDocOffset(offset uint64) {
-	db.writePointer(0, offset)
+	db.writePointer(db.headPos, offset)
 }
 func (db *DocumentBundle) setLastDocOffset(offset uint64) {
-	db.writePointer(8, offset)
+	db.writePointer(db.headPos+8, offset)
+}
+
+// Return the number of documents in the collection
+func (db *DocumentBundle) getDocCount() uint64 {
+	return uint64FromBytes(db.AsBytes, db.headPos+16)
+}
+
+// Return the number of bytes occupied by the collection's documents
+func (db *DocumentBundle) getLiveBytes() uint64 {
+	return uint64FromBytes(db.AsBytes, db.headPos+24)
+}
+
+// Add the given deltas to the collection's document & byte counts
+func (db *DocumentBundle) adjustCounts(docs int64, bytes int64) {
+	db.writePointer(db.headPos+16, uint64(int64(db.getDocCount())+docs))
+	db.writePointer(db.headPos+24, uint64(int64(db.getLiveBytes())+bytes))
+}
+
+// Return the position at which the next document will be written
+func (db *DocumentBundle) getTail() uint64 {
+	tail := uint64FromBytes(db.AsBytes, tailPos)
+	if tail == 0 {
+		return dataStart
+	}
+	return tail
+}
+
+func (db *DocumentBundle) setTail(tail uint64) {
+	db.writePointer(tailPos, tail)
 }
 
 // For the document at the given position, update the pointer to the next document
@@ -71,11 +173,11 @@ func (db *DocumentBundle) setPrevDocOffset(docOffset uint64, prevDocOffset uint6
 	db.writePointer(docOffset+4+8, prevDocOffset)
 }
 
-// Copies the data, overwriting if necessary, to a file at destination.  Calling
-// this periodically is the only way to ensure you have a consistent version of
-// your data.  "" as indexDest does not dump indexes.
+// Copies the data for every collection, overwriting if necessary, to a file at
+// destination.  Calling this periodically is the only way to ensure you have a
+// consistent version of your data.  "" as indexDest does not dump indexes.
 func (db *DocumentBundle) CopyDB(dataDest, indexDest string) error {
-	db.RLock()
+	db.readLock()
 	defer db.RUnlock()
 	dataFile, err := os.Create(dataDest)
 	if err != nil {
@@ -109,13 +211,18 @@ func (db *DocumentBundle) Sync() error {
 	return mSync(&db.AsBytes)
 }
 
-// Grow or shrink the backing storage for the given db to the given size
+// Grow or shrink the backing storage for the file to the given size.  The
+// file isn't shrunk while tail readers have it open; see tail.go.
 func (db *DocumentBundle) doReMmap(size uint64) error {
-	e := syscall.Munmap(db.AsBytes)
+	newFile, e := os.OpenFile(db.FileLoc, os.O_RDWR|os.O_CREATE, 0666)
 	if e != nil {
 		return e
 	}
-	newFile, e := os.OpenFile(db.FileLoc, os.O_RDWR|os.O_CREATE, 0666)
+	//The lock, if we get it, keeps new tail readers out until the file is closed
+	if size < uint64(len(db.AsBytes)) && !lockOutTailReaders(newFile) {
+		return newFile.Close()
+	}
+	e = syscall.Munmap(db.AsBytes)
 	if e != nil {
 		return e
 	}
@@ -127,92 +234,359 @@ func (db *DocumentBundle) doReMmap(size uint64) error {
 	if e != nil {
 		return e
 	}
-	db.AsBytes = newArr
+	db.setMapping(newArr)
+	//Tell readers in other processes to remap
+	db.writePointer(generationPos, uint64FromBytes(newArr, generationPos)+1)
 	return newFile.Close()
 }
 
-// Concatenate all documents, adjust pointers to be consistent, re-index,
-// and truncate the file.
-func (db *DocumentBundle) Compact() {
+// Point every collection in the file at the given mapping
+func (db *DocumentBundle) setMapping(newArr []byte) {
+	db.root.AsBytes = newArr
+	for _, coll := range db.root.collections {
+		coll.AsBytes = newArr
+	}
+}
+
+// Concatenate all documents in every collection, adjust pointers to be
+// consistent, re-index, and truncate the file, unless tail readers have it
+// open.
+func (db *DocumentBundle) Compact() error {
 	db.Lock()
 	defer db.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	return db.doCompact()
+}
 
-	idxNames := make([]string, 0)
-	idxFns := make([]func([]byte) string, 0)
-	//Record indexes for re-creation later
-	for idxName, idx := range db.indexes {
-		idxNames = append(idxNames, idxName)
-		idxFns = append(idxFns, idx.keyFn)
+// Compact without acquiring the lock.
+func (db *DocumentBundle) doCompact() error {
+	colls := db.root.allCollections()
+	for _, coll := range colls {
+		//Every offset is about to change, so the expiry tracker is rebuilt on demand
+		coll.expiry = expiryTracker{}
 	}
 
-	firstDocPos := db.getFirstDocOffset()
+	//Each collection's list is in ascending order of position, but they're
+	//interleaved, so merge them & move documents in order of position.  Nothing
+	//is ever moved later in the file, so we never overwrite a document that has
+	//yet to be moved.
+	nextPos := make([]uint64, len(colls))
+	prevNewPos := make([]uint64, len(colls))
+	for i, coll := range colls {
+		nextPos[i] = coll.getFirstDocOffset()
+	}
+	insertPoint := uint64(dataStart)
+	for {
+		cur := -1
+		for i := range colls {
+			if nextPos[i] != 0 && (cur == -1 || nextPos[i] < nextPos[cur]) {
+				cur = i
+			}
+		}
+		if cur == -1 {
+			break
+		}
+		coll := colls[cur]
+		doc := db.doGetDocumentAt(nextPos[cur])
+		nextPos[cur] = doc.NextDocOffset
+
+		//Move doc to the insert point, point it and its predecessor at each other
+		db.writeBytes(insertPoint, doc.toBytes())
+		db.setPrevDocOffset(insertPoint, prevNewPos[cur])
+		if prevNewPos[cur] == 0 {
+			coll.setFirstDocOffset(insertPoint)
+		} else {
+			db.setNextDocOffset(prevNewPos[cur], insertPoint)
+		}
+		prevNewPos[cur] = insertPoint
+		insertPoint += doc.byteSize()
+	}
 
-	//Compacting an empty database to 4k - will still grow in 1gb chunks
-	if firstDocPos == 0 {
-		db.doReMmap(4096)
-		return
+	//The last documents moved in each collection are the new last documents
+	for i, coll := range colls {
+		coll.setLastDocOffset(prevNewPos[i])
+		if prevNewPos[i] == 0 {
+			coll.setFirstDocOffset(0)
+		} else {
+			db.setNextDocOffset(prevNewPos[i], 0)
+		}
 	}
+	db.setTail(insertPoint)
+	db.journal(journalReset, 0)
 
-	firstDoc := db.doGetDocumentAt(firstDocPos)
-	nextDocPos := firstDoc.NextDocOffset
+	//Now shrink the underlying file & re-mmap.  An empty database compacts to
+	//just the header, and will still grow in 1gb chunks
+	err := db.doReMmap(insertPoint)
 
-	//Move initial document to the head if necessary
-	if firstDocPos != 16 {
-		db.writeBytes(16, firstDoc.toBytes())
-		db.setFirstDocOffset(16)
-		//Back-pointer handled below, if there is a next document to point back from
+	//And rebuild indexes, which blows away the old values
+	for _, coll := range colls {
+		for _, idx := range coll.indexes {
+			coll.doRebuildIndex(idx)
+		}
+		coll.restartIndexBuilds()
+		coll.publishChange(ChangeEvent{Op: OpCompact})
+	}
+	return err
+}
 
-		firstDocPos = 16
+// Returns a new 1gb DocumentBundle, or loads the DocumentBundle at that location
+// if it already exists.  Panics if the file can't be opened or isn't a DB this
+// version can read; use OpenDB to get the error instead.  Takes no lock, so
+// nothing stops another process opening the same file and corrupting it.
+func NewDB(location string) *DocumentBundle {
+	fileOut, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		panic(err)
 	}
+	defer fileOut.Close()
+	db, err := mapDB(fileOut, location, Options{})
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
 
-	for nextDocPos != 0 {
-		nextDoc := db.doGetDocumentAt(nextDocPos)
-		insertPoint := firstDocPos + firstDoc.byteSize()
+// As NewDB, but holds an advisory lock on the file until Close: exclusive for
+// writers, shared for readers.  Returns ErrLocked if the file is open with a
+// conflicting lock, whether by another process or this one.  Read-only opens
+// don't create the file, and their mutations return ErrReadOnly.  Tail opens
+// are read-only, and take no flock but a lock of their own; see tail.go.
+func OpenDB(location string, opts Options) (*DocumentBundle, error) {
+	flag, how := os.O_RDWR|os.O_CREATE, syscall.LOCK_EX
+	if opts.Tail {
+		opts.ReadOnly = true
+	}
+	if opts.ReadOnly {
+		flag, how = os.O_RDONLY, syscall.LOCK_SH
+	}
+	lockFile, err := os.OpenFile(location, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Tail {
+		//Not a flock, which would conflict with the writer's, but enough to stop
+		//it truncating the file under our mapping
+		if err = lockAsTailReader(lockFile); err != nil {
+			lockFile.Close()
+			return nil, err
+		}
+		db, err := mapDB(lockFile, location, opts)
+		if err != nil {
+			lockFile.Close()
+			return nil, err
+		}
+		db.seenVersion = db.headerVersion()
+		db.lockFile = lockFile
+		return db, nil
+	}
+	if err = syscall.Flock(int(lockFile.Fd()), how|syscall.LOCK_NB); err != nil {
+		lockFile.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	db, err := mapDB(lockFile, location, opts)
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	db.lockFile = lockFile
+	return db, nil
+}
 
-		//Move nextDoc to end of firstDoc, point nextDoc and firstDoc at each other
-		db.writeBytes(insertPoint, nextDoc.toBytes())
-		db.setNextDocOffset(firstDocPos, insertPoint)
-		db.setPrevDocOffset(insertPoint, firstDocPos)
+// Map the given open file, initializing it if it's empty.  Returns ErrNotDB,
+// ErrLegacy or ErrVersion if it isn't a DB this version can read.
+func mapDB(file *os.File, location string, opts Options) (*DocumentBundle, error) {
+	stats, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	fresh := stats.Size() == 0 && !opts.ReadOnly
+	if opts.ReadOnly {
+		prot = syscall.PROT_READ
+	}
+	if fresh {
+		//New file, give us some room.  The zeroed header is an empty DB, once
+		//it's stamped with the magic number & version
+		if err = file.Truncate(1000000000); err != nil {
+			return nil, err
+		}
+		if stats, err = file.Stat(); err != nil {
+			return nil, err
+		}
+	} else if err = checkHeader(file, stats.Size()); err != nil {
+		return nil, err
+	}
 
-		//Move up cursor
-		firstDocPos = insertPoint
-		nextDocPos = nextDoc.NextDocOffset
-		firstDoc = nextDoc
+	bytesOut, err := syscall.Mmap(int(file.Fd()), 0, int(stats.Size()), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
 	}
+	if fresh {
+		uint32ToBytes(bytesOut, magicPos, fileMagic)
+		uint32ToBytes(bytesOut, versionPos, formatVersion)
+	}
+	db := &DocumentBundle{
+		RWMutex:     &sync.RWMutex{},
+		AsBytes:     bytesOut,
+		FileLoc:     location,
+		indexes:     make(map[string]*index, 0),
+		changes:     &changeFeed{},
+		collections: make(map[string]*DocumentBundle),
+		options:     opts,
+	}
+	db.root = db
+	return db, nil
+}
 
-	//nextDocPos is invalid at this point, so this is the final valid position
-	db.setLastDocOffset(firstDocPos)
-	newSize := firstDocPos + uint64(firstDoc.Size)
+// Return nil if the file at location is a DB this version can open, or why it
+// isn't, without creating or modifying it.
+func CheckFile(location string) error {
+	file, err := os.Open(location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stats, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return checkHeader(file, stats.Size())
+}
 
-	//Now shrink the underlying file & re-mmap
-	db.doReMmap(newSize)
+// Check that the open file, of the given size, is a DB this version can read,
+// without mapping it, so nothing else is ever grown or written to.
+func checkHeader(file *os.File, size int64) error {
+	if size < legacyDataStart {
+		return ErrNotDB
+	}
+	header := make([]byte, 64)
+	if _, err := file.ReadAt(header, 0); err != nil && err != io.EOF {
+		return err
+	}
+	if size < dataStart || uint32FromBytes(header, magicPos) != fileMagic {
+		if isLegacyHeader(header, uint64(size)) {
+			return ErrLegacy
+		}
+		return ErrNotDB
+	}
+	if uint32FromBytes(header, versionPos) != formatVersion {
+		return ErrVersion
+	}
+	return nil
+}
 
-	//And re-add indexes, which blows away the old values
-	for i := 0; i < len(idxNames); i++ {
-		db.doAddIndex(idxNames[i], idxFns[i])
+// Whether a header without the magic number looks like the original layout: a
+// pair of first & last document pointers, both 0 or both within the file.
+func isLegacyHeader(header []byte, size uint64) bool {
+	first, last := uint64FromBytes(header, 0), uint64FromBytes(header, 8)
+	if first == 0 || last == 0 {
+		return first == last
 	}
+	return first >= legacyDataStart && last >= legacyDataStart &&
+		first+legacyDocHeaderSize <= size && last+legacyDocHeaderSize <= size
 }
 
-// Returns a new 1gb DocumentBundle, or loads the DocumentBundle at that location
-// if it already exists.
-func NewDB(location string) *DocumentBundle {
-	fileOut, _ := os.OpenFile(location, os.O_RDWR|os.O_CREATE, 0666)
-	defer fileOut.Close()
-	stats, _ := fileOut.Stat()
-	if stats.Size() < 16 {
-		//New file, clear the pointers to the start and end positions
-		fileOut.Write(make([]byte, 16))
-		//And give us some room
-		fileOut.Truncate(1000000000)
+const (
+	legacyDataStart     = 16 //Position of the first document in the original layout
+	legacyDocHeaderSize = 20 //Size, next & prev pointers, without an expiry
+)
+
+// Copy the documents of a file in the original, unversioned layout, which
+// OpenDB refuses with ErrLegacy, into a new DB at dest, in the same order.
+// dest must not already exist.  The source is only read.
+func MigrateLegacyDB(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stats, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(stats.Size())
+	header := make([]byte, legacyDataStart)
+	if _, err = in.ReadAt(header, 0); err != nil || !isLegacyHeader(header, size) {
+		return ErrNotDB
+	}
+	out, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	out.Close()
+	db, err := OpenDB(dest, Options{})
+	if err != nil {
+		return err
+	}
+
+	//Every document takes at least a header, which bounds the walk should the
+	//links loop
+	docHeader := make([]byte, legacyDocHeaderSize)
+	pos, remaining := uint64FromBytes(header, 0), size/legacyDocHeaderSize
+	for pos != 0 {
+		if remaining == 0 || pos < legacyDataStart || pos+legacyDocHeaderSize > size {
+			err = ErrNotDB
+			break
+		}
+		remaining--
+		if _, err = in.ReadAt(docHeader, int64(pos)); err != nil {
+			break
+		}
+		docSize := uint64(uint32FromBytes(docHeader, 0))
+		if docSize < legacyDocHeaderSize || pos+docSize > size {
+			err = ErrNotDB
+			break
+		}
+		payload := make([]byte, docSize-legacyDocHeaderSize)
+		if _, err = in.ReadAt(payload, int64(pos+legacyDocHeaderSize)); err != nil {
+			break
+		}
+		if _, err = db.PutDocument(NewDocument(payload)); err != nil {
+			break
+		}
+		pos = uint64FromBytes(docHeader, 4)
+	}
+	if err == nil {
+		err = db.Sync()
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
 	}
-	stats, _ = fileOut.Stat()
+	return err
+}
 
-	var bytesOut []byte
-	bytesOut, _ = syscall.Mmap(int(fileOut.Fd()), 0, int(stats.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
-	return &DocumentBundle{sync.RWMutex{}, bytesOut, location, make(map[string]index, 0)}
+// Unmap the file and release any lock taken by OpenDB.  Neither this nor any
+// other handle on the file may be used afterwards.
+func (db *DocumentBundle) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	root := db.root
+	if root.AsBytes == nil {
+		return nil
+	}
+	for _, coll := range root.openedCollections() {
+		coll.releaseIndexes()
+	}
+	err := syscall.Munmap(root.AsBytes)
+	root.setMapping(nil)
+	if root.lockFile != nil {
+		if e := root.lockFile.Close(); err == nil {
+			err = e
+		}
+		root.lockFile = nil
+	}
+	return err
 }
 
-// Grow the db's backing storage by 1gb.
+// Grow the file's backing storage by 1gb.
 func (db *DocumentBundle) doGrowDB() {
 	oldSize := uint64(len(db.AsBytes))
 	db.doReMmap(oldSize + 1000000000)
@@ -232,49 +606,74 @@ func (db *DocumentBundle) doForEachDocument(proc func(uint64, Document)) {
 }
 
 // Without acquiring the lock (assumes the caller already holds it), insert the
-// given document at the end of the DB.
-func (db *DocumentBundle) doPutDocument(doc Document) uint64 {
-	lastDocOffset := db.getLastDocOffset()
-
-	//Handle case of initial insert
-	if lastDocOffset == 0 {
-		if 16+doc.byteSize() >= uint64(len(db.AsBytes)) {
-			db.doGrowDB()
-		}
-		doc.PrevDocOffset = 0
-		doc.NextDocOffset = 0
-		db.setFirstDocOffset(16)
-		db.setLastDocOffset(16)
-		db.writeBytes(16, doc.toBytes())
-		db.indexDocument(doc, 16)
-		return 16
+// given document at the end of the DB, subject to the registered hooks.
+func (db *DocumentBundle) doPutDocument(doc Document) (uint64, error) {
+	payload, err := db.runBeforePut(doc.Payload)
+	if err != nil {
+		return 0, err
 	}
+	doc.Payload = payload
+	doc.Size = uint32(doc.byteSize())
+	offset := db.doAppendDocument(doc)
+	db.runAfterPut(offset, payload)
+	db.publishChange(ChangeEvent{Op: OpPut, NewOffset: offset, Payload: payload, Expires: doc.Expires})
+	return offset, nil
+}
 
-	lastDoc := db.doGetDocumentAt(lastDocOffset)
+// Link and index the given document at the end of the collection without
+// notifying watchers.  It's written at the end of the file.
+func (db *DocumentBundle) doAppendDocument(doc Document) uint64 {
+	insertPoint := db.getTail()
 	//If not enough space, grow DB
-	if lastDocOffset+lastDoc.byteSize()+doc.byteSize() >= uint64(len(db.AsBytes)) {
+	if insertPoint+doc.byteSize() >= uint64(len(db.AsBytes)) {
+		//The payload may point into the mapping we're about to replace
+		doc.Payload = append([]byte(nil), doc.Payload...)
 		db.doGrowDB()
 	}
+
+	lastDocOffset := db.getLastDocOffset()
 	//Adjust doc pointers
 	doc.PrevDocOffset = lastDocOffset
 	doc.NextDocOffset = 0
 	//Appending
-	insertPoint := lastDocOffset + lastDoc.byteSize()
 	db.writeBytes(insertPoint, doc.toBytes())
-	//Update the DB pointer to the last doc
+	db.setTail(insertPoint + doc.byteSize())
+	//Update the collection pointer to the last doc
 	db.setLastDocOffset(insertPoint)
-	//The now 2nd-to-last doc's pointer to the next doc
-	db.setNextDocOffset(lastDocOffset, insertPoint)
+	if lastDocOffset == 0 {
+		//Initial insert
+		db.setFirstDocOffset(insertPoint)
+	} else {
+		//The now 2nd-to-last doc's pointer to the next doc
+		db.setNextDocOffset(lastDocOffset, insertPoint)
+	}
+
+	db.adjustCounts(1, int64(doc.byteSize()))
+	db.journal(journalPut, insertPoint)
 
 	//Index
 	db.indexDocument(doc, insertPoint)
+	db.trackExpiry(doc, insertPoint)
 
 	return insertPoint
 }
 
 // Adjust the pointers to bypass the given document - does not zero the storage,
 // but a compaction will result in it being overwritten.
-func (db *DocumentBundle) doRemoveDocumentAt(offset uint64) {
+func (db *DocumentBundle) doRemoveDocumentAt(offset uint64) error {
+	err := db.runBeforeRemove(offset, db.doGetDocumentAt(offset).Payload)
+	if err != nil {
+		return err
+	}
+	targ := db.doUnlinkDocumentAt(offset)
+	db.runAfterRemove(offset, targ.Payload)
+	db.publishChange(ChangeEvent{Op: OpRemove, OldOffset: offset, Payload: targ.Payload})
+	return nil
+}
+
+// Unlink and deindex the document at the given offset without notifying
+// watchers, returning what was there.
+func (db *DocumentBundle) doUnlinkDocumentAt(offset uint64) Document {
 	targ := db.doGetDocumentAt(offset)
 	prevDocOffset := targ.PrevDocOffset
 	nextDocOffset := targ.NextDocOffset
@@ -292,23 +691,75 @@ func (db *DocumentBundle) doRemoveDocumentAt(offset uint64) {
 		db.setLastDocOffset(prevDocOffset)
 	}
 
+	//If it was the last thing in the file, we can reuse the space right away
+	if offset+targ.byteSize() == db.getTail() {
+		db.setTail(offset)
+	}
+	db.adjustCounts(-1, -int64(targ.byteSize()))
+	db.journal(journalRemove, offset)
+
+	db.unlinkFromIndexBuilds(offset, prevDocOffset)
 	db.deindexDocument(targ, offset)
+	db.untrackExpiry(offset)
+	return targ
 }
 
 // Attempt to update the given document inplace - if it cannot be done, remove the
-// existing document and insert the new one at the end
-func (db *DocumentBundle) doReplaceDocument(offset uint64, newDoc Document) uint64 {
+// existing document and insert the new one at the end.  The replacement keeps
+// the existing document's expiry unless it has its own.
+func (db *DocumentBundle) doReplaceDocument(offset uint64, newDoc Document) (uint64, error) {
+	//Replacing the payload doesn't extend the document's life
+	if newDoc.Expires == 0 {
+		newDoc.Expires = db.doGetDocumentAt(offset).Expires
+	}
+	return db.doSetDocument(offset, newDoc)
+}
+
+// As doReplaceDocument, but the replacement has newDoc's expiry, even if that's
+// none.
+func (db *DocumentBundle) doSetDocument(offset uint64, newDoc Document) (uint64, error) {
 	curDoc := db.doGetDocumentAt(offset)
-	if newDoc.byteSize()+offset < curDoc.NextDocOffset {
-		db.deindexDocument(db.doGetDocumentAt(offset), offset)
+	payload, err := db.runBeforeReplace(offset, curDoc.Payload, newDoc.Payload)
+	if err != nil {
+		return 0, err
+	}
+	newDoc.Payload = payload
+	newDoc, newOffset := db.doRewriteDocument(offset, curDoc, newDoc)
+	db.runAfterReplace(offset, newOffset, payload)
+	db.publishChange(ChangeEvent{Op: OpReplace, OldOffset: offset, NewOffset: newOffset, Payload: payload, Expires: newDoc.Expires})
+	return newOffset, nil
+}
+
+// Replace curDoc, at the given offset, with newDoc, expiry and all, without
+// running hooks or notifying watchers.  Returns the document as written and its offset.
+func (db *DocumentBundle) doRewriteDocument(offset uint64, curDoc, newDoc Document) (Document, uint64) {
+	newDoc.Size = uint32(newDoc.byteSize())
+	newOffset := offset
+	//Documents from other collections may follow this one, so it can only grow
+	//in place if it's at the end of the file.  That doesn't depend on the size
+	//of the mapping, which differs between a primary and its followers
+	atTail := offset+curDoc.byteSize() == db.getTail()
+	if newDoc.byteSize() <= curDoc.byteSize() || atTail {
+		db.deindexDocument(curDoc, offset)
+		if offset+newDoc.byteSize() >= uint64(len(db.AsBytes)) {
+			//The payload may point into the mapping we're about to replace
+			newDoc.Payload = append([]byte(nil), newDoc.Payload...)
+			db.doGrowDB()
+		}
 		newDoc.NextDocOffset = curDoc.NextDocOffset
 		newDoc.PrevDocOffset = curDoc.PrevDocOffset
 		db.writeBytes(offset, newDoc.toBytes())
+		if atTail {
+			db.setTail(offset + newDoc.byteSize())
+		}
+		db.adjustCounts(0, int64(newDoc.byteSize())-int64(curDoc.byteSize()))
+		db.journal(journalPut, offset)
 		db.indexDocument(newDoc, offset)
-		return offset
+		db.trackExpiry(newDoc, offset)
 	} else {
 		//Indexing and modifying offsets is handled by subroutines
-		db.doRemoveDocumentAt(offset)
-		return db.doPutDocument(newDoc)
+		db.doUnlinkDocumentAt(offset)
+		newOffset = db.doAppendDocument(newDoc)
 	}
+	return newDoc, newOffset
 }
@@ -32,3 +32,170 @@ func TestDBCopy(t *testing.T) {
 	}
 
 }
+
+func TestOpenDBLocking(t *testing.T) {
+	f, _ := ioutil.TempFile("", "ClownshoesDBTest")
+	f.Close()
+	os.Remove(f.Name())
+	defer os.Remove(f.Name())
+
+	if _, e := OpenDB(f.Name(), Options{ReadOnly: true}); e == nil {
+		t.Error("Read-only open created a file")
+	}
+	writer, e := OpenDB(f.Name(), Options{})
+	if e != nil {
+		t.Fatal("Problem opening db", e)
+	}
+	writer.PutDocument(NewDocument([]byte("Spiffy Document 1")))
+	writer.Collection("users").PutDocument(NewDocument([]byte("user")))
+	if _, e := OpenDB(f.Name(), Options{}); e != ErrLocked {
+		t.Error("Second writer not locked out", e)
+	}
+	if _, e := OpenDB(f.Name(), Options{ReadOnly: true}); e != ErrLocked {
+		t.Error("Reader not locked out by writer", e)
+	}
+	if e := writer.Close(); e != nil {
+		t.Error("Problem closing db", e)
+	}
+
+	reader1, e := OpenDB(f.Name(), Options{ReadOnly: true})
+	if e != nil {
+		t.Fatal("Problem opening db read-only", e)
+	}
+	defer reader1.Close()
+	reader2, e := OpenDB(f.Name(), Options{ReadOnly: true})
+	if e != nil {
+		t.Fatal("Second reader locked out", e)
+	}
+	defer reader2.Close()
+	if _, e := OpenDB(f.Name(), Options{}); e != ErrLocked {
+		t.Error("Writer not locked out by readers", e)
+	}
+
+	all := func(b []byte) bool { return true }
+	if len(reader1.GetDocuments(all)) != 1 || len(reader2.Collection("users").GetDocuments(all)) != 1 {
+		t.Error("Reader doesn't see documents")
+	}
+	if _, e := reader1.PutDocument(NewDocument([]byte("nope"))); e != ErrReadOnly {
+		t.Error("Reader accepted a write", e)
+	}
+	if reader1.Collection("sessions") != nil {
+		t.Error("Reader created a collection")
+	}
+	if e := reader1.Compact(); e != ErrReadOnly {
+		t.Error("Reader compacted", e)
+	}
+}
+
+func TestOpenDBFormat(t *testing.T) {
+	f, _ := ioutil.TempFile("", "ClownshoesDBTest")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	//The original layout: first & last document pointers, then a 20 byte
+	//document at 16
+	old := make([]byte, 8192)
+	uint64ToBytes(old, 0, 16)
+	uint64ToBytes(old, 8, 16)
+	uint32ToBytes(old, 16, 25)
+	copy(old[36:], "hello")
+	ioutil.WriteFile(f.Name(), old, 0666)
+	func() {
+		defer func() {
+			if recover() != ErrLegacy {
+				t.Error("NewDB didn't panic with ErrLegacy for the old layout")
+			}
+		}()
+		NewDB(f.Name())
+	}()
+	if _, e := OpenDB(f.Name(), Options{}); e != ErrLegacy {
+		t.Error("Expected ErrLegacy for the old layout, got", e)
+	}
+	if _, e := OpenDB(f.Name(), Options{ReadOnly: true}); e != ErrLegacy {
+		t.Error("Expected ErrLegacy read-only, got", e)
+	}
+
+	//Small files aren't grown
+	ioutil.WriteFile(f.Name(), []byte("not a db"), 0666)
+	if _, e := OpenDB(f.Name(), Options{}); e != ErrNotDB {
+		t.Error("Expected ErrNotDB for a small file, got", e)
+	}
+	if info, _ := os.Stat(f.Name()); info.Size() != 8 {
+		t.Error("Small file was grown to", info.Size())
+	}
+
+	ioutil.WriteFile(f.Name(), nil, 0666)
+	db, e := OpenDB(f.Name(), Options{})
+	if e != nil {
+		t.Fatal("Problem creating db", e)
+	}
+	db.PutDocument(NewDocument([]byte("new")))
+	db.Close()
+	if db, e = OpenDB(f.Name(), Options{ReadOnly: true}); e != nil || db.Count() != 1 {
+		t.Fatal("Problem reopening db", e)
+	}
+	db.Close()
+
+	//A later version's files are refused
+	version := make([]byte, 4)
+	uint32ToBytes(version, 0, formatVersion+1)
+	file, _ := os.OpenFile(f.Name(), os.O_RDWR, 0666)
+	file.WriteAt(version, versionPos)
+	file.Close()
+	if _, e := OpenDB(f.Name(), Options{}); e != ErrVersion {
+		t.Error("Expected ErrVersion, got", e)
+	}
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	f, _ := ioutil.TempFile("", "ClownshoesDBTest")
+	f.Close()
+	defer os.Remove(f.Name())
+	dest := f.Name() + ".migrated"
+	defer os.Remove(dest)
+
+	//Two documents in the original layout, linked out of file order
+	old := make([]byte, 8192)
+	uint64ToBytes(old, 0, 41)
+	uint64ToBytes(old, 8, 16)
+	uint32ToBytes(old, 16, 25)
+	uint64ToBytes(old, 20, 0)
+	uint64ToBytes(old, 28, 41)
+	copy(old[36:], "world")
+	uint32ToBytes(old, 41, 25)
+	uint64ToBytes(old, 45, 16)
+	uint64ToBytes(old, 53, 0)
+	copy(old[61:], "hello")
+	ioutil.WriteFile(f.Name(), old, 0666)
+
+	if e := MigrateLegacyDB(f.Name(), dest); e != nil {
+		t.Fatal("Problem migrating", e)
+	}
+	db, e := OpenDB(dest, Options{ReadOnly: true})
+	if e != nil {
+		t.Fatal("Problem opening migrated db", e)
+	}
+	var got []string
+	db.ForEachDocument(func(_ uint64, doc Document) bool {
+		got = append(got, string(doc.Payload))
+		return true
+	})
+	db.Close()
+	if len(got) != 2 || got[0] != "hello" || got[1] != "world" {
+		t.Error("Wrong migrated documents", got)
+	}
+	if e := MigrateLegacyDB(f.Name(), dest); e == nil {
+		t.Error("Migrated over an existing file")
+	}
+
+	//A loop in the links is refused, and leaves nothing behind
+	uint64ToBytes(old, 20, 41)
+	ioutil.WriteFile(f.Name(), old, 0666)
+	os.Remove(dest)
+	if e := MigrateLegacyDB(f.Name(), dest); e != ErrNotDB {
+		t.Error("Expected ErrNotDB for looping links, got", e)
+	}
+	if _, e := os.Stat(dest); !os.IsNotExist(e) {
+		t.Error("Failed migration left a file")
+	}
+}
@@ -1,18 +1,35 @@
 package clownshoes
 
+import "time"
+
 // Packed size in bytes of all elements of a Document save the Payload.
-const docHeaderSize = 20
+const docHeaderSize = 28
+
+// Largest payload whose packed size fits the document's uint32 Size field.
+const maxPayloadSize = 1<<32 - 1 - docHeaderSize
 
 type Document struct {
 	Size          uint32 //Number of bytes for the entire packed document. This field is only used for deserialization.
 	NextDocOffset uint64 //Offset of the next valid document
 	PrevDocOffset uint64 //Offset of previous valid document
+	Expires       int64  //Unix nanoseconds after which the document is hidden and reaped, or 0 for never
 	Payload       []byte //Your precious data
 }
 
 // Returns an empty document, ripe for insertion, with the given payload
 func NewDocument(payload []byte) Document {
-	return Document{docHeaderSize + uint32(len(payload)), 0, 0, payload}
+	return Document{docHeaderSize + uint32(len(payload)), 0, 0, 0, payload}
+}
+
+// Returns an empty document with the given payload that expires at the given time
+func NewExpiringDocument(payload []byte, expires time.Time) Document {
+	return Document{docHeaderSize + uint32(len(payload)), 0, 0, expires.UnixNano(), payload}
+}
+
+// Whether the document has an expiry that has passed as of now, given as Unix
+// nanoseconds.
+func (doc *Document) expiredAt(now int64) bool {
+	return doc.Expires != 0 && doc.Expires <= now
 }
 
 // Total packed size of a document, returned as a uint64 but always in the uint32
@@ -29,14 +46,19 @@ func (doc *Document) toBytes() []byte {
 	uint32ToBytes(out, 0, uint32(byteSize))
 	uint64ToBytes(out, 4, doc.NextDocOffset)
 	uint64ToBytes(out, 12, doc.PrevDocOffset)
+	uint64ToBytes(out, 20, uint64(doc.Expires))
 	copy(out[docHeaderSize:], doc.Payload)
 	return out
 }
 
 // Retrieve the document at the given index, assuming the given index is valid.
+// The payload's capacity is capped so that appending to it can't scribble over
+// the following document.
 func (db *DocumentBundle) doGetDocumentAt(offset uint64) Document {
 	docLength := uint32FromBytes(db.AsBytes, offset)
 	nextDocPos := uint64FromBytes(db.AsBytes, offset+4)
 	prevDocPos := uint64FromBytes(db.AsBytes, offset+12)
-	return Document{docLength, nextDocPos, prevDocPos, db.AsBytes[offset+docHeaderSize : offset+uint64(docLength)]}
+	expires := int64(uint64FromBytes(db.AsBytes, offset+20))
+	end := offset + uint64(docLength)
+	return Document{docLength, nextDocPos, prevDocPos, expires, db.AsBytes[offset+docHeaderSize : end : end]}
 }
@@ -0,0 +1,138 @@
+package clownshoes
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Expiring documents are hidden from reads as soon as their expiry passes, and
+// physically removed by ReapExpired.  To find them without a scan we keep a
+// min-heap of expiry times, built on first use and maintained by the mutation
+// paths afterwards.  Heap entries are validated against the offset map when
+// popped, so entries for documents that have since been removed or replaced are
+// simply discarded.
+
+// Overridden in tests
+var timeNow = time.Now
+
+type expiryEntry struct {
+	expires int64
+	offset  uint64
+}
+
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expires < h[j].expires }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	out := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return out
+}
+
+type expiryTracker struct {
+	loaded   bool             //Whether byOffset & queue reflect the DB
+	byOffset map[uint64]int64 //Current expiry of each expiring document
+	queue    expiryHeap
+}
+
+// Record the expiry of the document now at the given offset, if it has one.
+func (db *DocumentBundle) trackExpiry(doc Document, offset uint64) {
+	if !db.expiry.loaded {
+		return
+	}
+	if doc.Expires == 0 {
+		delete(db.expiry.byOffset, offset)
+		return
+	}
+	db.expiry.byOffset[offset] = doc.Expires
+	heap.Push(&db.expiry.queue, expiryEntry{doc.Expires, offset})
+}
+
+// Forget the expiry of the document that was at the given offset.
+func (db *DocumentBundle) untrackExpiry(offset uint64) {
+	if db.expiry.loaded {
+		delete(db.expiry.byOffset, offset)
+	}
+}
+
+// Scan the DB to build the expiry tracker, if that hasn't already happened.
+func (db *DocumentBundle) doLoadExpiry() {
+	if db.expiry.loaded {
+		return
+	}
+	db.expiry = expiryTracker{true, make(map[uint64]int64), nil}
+	db.doForEachDocument(func(offset uint64, doc Document) {
+		db.trackExpiry(doc, offset)
+	})
+}
+
+// Remove up to limit documents whose expiry has passed, returning how many were
+// removed.  Removals go through the usual hooks and change feed, and stop at the
+// first hook error.
+func (db *DocumentBundle) ReapExpired(limit int) (counter uint64, err error) {
+	db.Lock()
+	defer db.Unlock()
+	if err = db.checkWritable(); err != nil {
+		return 0, err
+	}
+	db.doLoadExpiry()
+
+	now := timeNow().UnixNano()
+	for counter < uint64(limit) && db.expiry.queue.Len() > 0 && db.expiry.queue[0].expires <= now {
+		next := heap.Pop(&db.expiry.queue).(expiryEntry)
+		if cur, present := db.expiry.byOffset[next.offset]; !present || cur != next.expires {
+			//Stale entry
+			continue
+		}
+		if err = db.doRemoveDocumentAt(next.offset); err != nil {
+			//Leave it in place for the next attempt
+			heap.Push(&db.expiry.queue, next)
+			return counter, err
+		}
+		counter++
+	}
+	return counter, nil
+}
+
+// Start a goroutine which, every interval, reaps expired documents in batches of
+// batchSize, releasing the write lock between batches.  Batches are at least
+// one document.  Call the returned function to stop it, which waits for the
+// batch in progress, if any, to finish.
+func (db *DocumentBundle) StartReaper(interval time.Duration, batchSize int) (stop func()) {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			for {
+				ct, err := db.ReapExpired(batchSize)
+				if err != nil || ct < uint64(batchSize) {
+					break
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
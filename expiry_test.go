@@ -0,0 +1,159 @@
+package clownshoes
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	db.AddIndex("identity", func(b []byte) string { return string(b) })
+	db.PutDocument(NewDocument([]byte("forever")))
+	for i := 0; i < 10; i++ {
+		db.PutDocument(NewExpiringDocument([]byte("session"), now.Add(time.Minute)))
+	}
+	db.PutDocument(NewExpiringDocument([]byte("later"), now.Add(time.Hour)))
+
+	//Replacement keeps the original expiry
+	db.ReplaceDocumentsWhere("identity", "later", func(b []byte) ([]byte, bool) {
+		return []byte("much later"), true
+	})
+
+	if ct, _ := db.ReapExpired(100); ct != 0 {
+		t.Error("Reaped unexpired documents", ct)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if len(db.GetDocuments(func(b []byte) bool { return true })) != 2 {
+		t.Error("Expired documents visible to scans")
+	}
+	if len(db.GetDocumentsWhere("identity", "session")) != 0 {
+		t.Error("Expired documents visible to indexed lookups")
+	}
+	if ct, _ := db.ReplaceDocuments(func(b []byte) ([]byte, bool) { return b, true }); ct != 2 {
+		t.Error("Expired documents visible to replacement", ct)
+	}
+
+	//Bounded batches
+	if ct, _ := db.ReapExpired(4); ct != 4 {
+		t.Error("Wrong batch size reaped", ct)
+	}
+	if ct, _ := db.ReapExpired(100); ct != 6 {
+		t.Error("Wrong remainder reaped", ct)
+	}
+
+	now = now.Add(2 * time.Hour)
+	db.Compact()
+	if ct, _ := db.ReapExpired(100); ct != 1 {
+		t.Error("Replaced document not reaped after compaction", ct)
+	}
+	docs := db.GetDocuments(func(b []byte) bool { return true })
+	if len(docs) != 1 || string(docs[0].Payload) != "forever" {
+		t.Error("Wrong documents survived reaping")
+	}
+}
+
+func TestReaper(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	sub := db.Watch(func(ev ChangeEvent) bool { return ev.Op == OpRemove })
+	defer sub.Close()
+	for i := 0; i < 5; i++ {
+		db.PutDocument(NewExpiringDocument([]byte("ephemeral"), time.Now()))
+	}
+	stop := db.StartReaper(time.Millisecond, 2)
+	defer stop()
+	for i := 0; i < 5; i++ {
+		<-sub.C
+	}
+	if len(db.GetDocuments(func(b []byte) bool { return true })) != 0 {
+		t.Error("Expired documents not reaped")
+	}
+}
+
+func TestReaperBatchSize(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	sub := db.Watch(func(ev ChangeEvent) bool { return ev.Op == OpRemove })
+	defer sub.Close()
+	for i := 0; i < 3; i++ {
+		db.PutDocument(NewExpiringDocument([]byte("ephemeral"), time.Now()))
+	}
+	//A batch size of 0 is treated as 1, rather than reaping nothing forever
+	stop := db.StartReaper(time.Millisecond, 0)
+	defer stop()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-sub.C:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expired documents not reaped")
+		}
+	}
+}
+
+func TestReaperStopsMidBacklog(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	for i := 0; i < 1000; i++ {
+		db.PutDocument(NewExpiringDocument([]byte("ephemeral"), time.Now()))
+	}
+	//The first removal waits until we've asked the reaper to stop
+	reaping, released := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	db.AddHooks(Hooks{AfterRemove: func(uint64, []byte) {
+		once.Do(func() {
+			reaping <- struct{}{}
+			<-released
+		})
+	}})
+	stop := db.StartReaper(time.Millisecond, 1)
+	<-reaping
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(released)
+	<-stopped
+	remaining := db.Count()
+	if remaining != 999 {
+		t.Error("Reaper carried on through the backlog after being stopped", remaining)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if db.Count() != remaining {
+		t.Error("Reaper still running after stop returned")
+	}
+}
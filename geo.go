@@ -0,0 +1,287 @@
+package clownshoes
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// Geo indexes are ordered indexes whose keys are points quantized to 32 bits
+// of latitude and longitude, interleaved into a 64 bit Z-order (Morton) code,
+// the same idea as a geohash.  Every quadtree cell is then one contiguous
+// range of keys, so a bounding box is covered by a handful of cells, looked up
+// as ranges of the sorted keys, and the points found checked against the box.
+// Points are decoded from the keys themselves, accurate to about a centimetre,
+// so queries never read payloads they don't return.
+
+type Point struct {
+	Lat, Lon float64
+}
+
+// A box from its south-west to its north-east corner.  If Min.Lon is greater
+// than Max.Lon the box crosses the antimeridian.
+type BBox struct {
+	Min, Max Point
+}
+
+type GeoMatch struct {
+	Offset   uint64
+	Doc      Document
+	Point    Point   //Location as stored in the index
+	Distance float64 //Kilometres from the centre, for Near
+}
+
+const earthRadiusKm = 6371.0088
+
+func quantize(v, min, max float64) uint32 {
+	f := (v - min) / (max - min) * (1 << 32)
+	if f <= 0 {
+		return 0
+	} else if f >= 1<<32-1 {
+		return 1<<32 - 1
+	}
+	return uint32(f)
+}
+
+func dequantize(q uint32, min, max float64) float64 {
+	return (float64(q)+0.5)/(1<<32)*(max-min) + min
+}
+
+// Spread the bits of x out to the even positions.
+func spreadBits(x uint32) uint64 {
+	v := uint64(x)
+	v = (v | v<<16) & 0x0000ffff0000ffff
+	v = (v | v<<8) & 0x00ff00ff00ff00ff
+	v = (v | v<<4) & 0x0f0f0f0f0f0f0f0f
+	v = (v | v<<2) & 0x3333333333333333
+	v = (v | v<<1) & 0x5555555555555555
+	return v
+}
+
+func compactBits(v uint64) uint32 {
+	v &= 0x5555555555555555
+	v = (v | v>>1) & 0x3333333333333333
+	v = (v | v>>2) & 0x0f0f0f0f0f0f0f0f
+	v = (v | v>>4) & 0x00ff00ff00ff00ff
+	v = (v | v>>8) & 0x0000ffff0000ffff
+	v = (v | v>>16) & 0x00000000ffffffff
+	return uint32(v)
+}
+
+// Longitude takes the high bit of each pair, as in a geohash.
+func morton(x, y uint32) uint64 {
+	return spreadBits(x)<<1 | spreadBits(y)
+}
+
+func geoKey(code uint64) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], code)
+	return string(buf[:])
+}
+
+// The quantized coordinates of a geo index key.
+func geoCell(key string) (x, y uint32) {
+	code := binary.BigEndian.Uint64([]byte(key))
+	return compactBits(code >> 1), compactBits(code)
+}
+
+// Wrap a function returning a document's location as an index key function.
+// Documents without one, or with coordinates out of range, get the key "".
+// Use this for the key functions of geo indexes passed to LoadIndexes.
+func GeoKeyFn(pointFn func(payload []byte) (Point, bool)) func([]byte) string {
+	return func(payload []byte) string {
+		p, ok := pointFn(payload)
+		if !ok || !(p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180) {
+			return ""
+		}
+		return geoKey(morton(quantize(p.Lon, -180, 180), quantize(p.Lat, -90, 90)))
+	}
+}
+
+// Add an index on each document's location, for Within, Near and
+// WithinPolygon.
+func (db *DocumentBundle) AddGeoIndex(indexName string, pointFn func(payload []byte) (Point, bool)) {
+	db.Lock()
+	defer db.Unlock()
+	db.doAddIndexLike(indexName, &index{keyFn: GeoKeyFn(pointFn), ordered: true, geo: true})
+	db.publishIndexAdded(indexName)
+}
+
+// Return the named geo index, nil if there's no such index, or an error if it
+// isn't a geo index.  Assumes a lock is held.
+func (db *DocumentBundle) geoIndex(indexName string) (*index, error) {
+	idx, found := db.indexes[indexName]
+	if !found {
+		return nil, nil
+	}
+	if !idx.geo {
+		return nil, errors.New("clownshoes: index " + indexName + " isn't a geo index")
+	}
+	return idx, nil
+}
+
+// Run proc over the live documents in the index within the box, given in
+// quantized coordinates without wrapping.  Assumes a lock is held.
+func (db *DocumentBundle) doGeoScan(idx *index, xmin, xmax, ymin, ymax uint32, now int64, proc func(offset uint64, doc Document, x, y uint32)) {
+	//The finest level at which the box spans at most 4 cells each way
+	level := 32
+	for level > 0 && ((xmax>>(32-level))-(xmin>>(32-level)) > 3 || (ymax>>(32-level))-(ymin>>(32-level)) > 3) {
+		level--
+	}
+	shift := uint(32 - level)
+	var cells [][2]uint64
+	for cx := uint64(xmin >> shift); cx <= uint64(xmax>>shift); cx++ {
+		for cy := uint64(ymin >> shift); cy <= uint64(ymax>>shift); cy++ {
+			lo := morton(uint32(cx<<shift), uint32(cy<<shift))
+			cells = append(cells, [2]uint64{lo, lo + (1<<(2*shift) - 1)})
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i][0] < cells[j][0] })
+
+	for i, cell := range cells {
+		//Adjacent cells were covered by the previous range
+		if i > 0 && cells[i-1][1]+1 == cell[0] {
+			continue
+		}
+		hi := cell[1]
+		for j := i + 1; j < len(cells) && cells[j-1][1]+1 == cells[j][0]; j++ {
+			hi = cells[j][1]
+		}
+		start := sort.SearchStrings(idx.sorted, geoKey(cell[0]))
+		for _, key := range idx.sorted[start:] {
+			if len(key) != 8 {
+				continue
+			}
+			if binary.BigEndian.Uint64([]byte(key)) > hi {
+				break
+			}
+			x, y := geoCell(key)
+			if x < xmin || x > xmax || y < ymin || y > ymax {
+				continue
+			}
+			for _, offset := range idx.lookup[key] {
+				if doc := db.doGetDocumentAt(offset); !doc.expiredAt(now) {
+					proc(offset, doc, x, y)
+				}
+			}
+		}
+	}
+}
+
+// Run proc over the documents in the box, splitting it at the antimeridian.
+// Assumes a lock is held.
+func (db *DocumentBundle) doGeoBox(idx *index, box BBox, proc func(offset uint64, doc Document, p Point)) {
+	now := timeNow().UnixNano()
+	ymin, ymax := quantize(box.Min.Lat, -90, 90), quantize(box.Max.Lat, -90, 90)
+	if ymin > ymax {
+		return
+	}
+	visit := func(offset uint64, doc Document, x, y uint32) {
+		proc(offset, doc, Point{dequantize(y, -90, 90), dequantize(x, -180, 180)})
+	}
+	xmin, xmax := quantize(box.Min.Lon, -180, 180), quantize(box.Max.Lon, -180, 180)
+	if xmin <= xmax {
+		db.doGeoScan(idx, xmin, xmax, ymin, ymax, now, visit)
+	} else {
+		db.doGeoScan(idx, xmin, 1<<32-1, ymin, ymax, now, visit)
+		db.doGeoScan(idx, 0, xmax, ymin, ymax, now, visit)
+	}
+}
+
+// Return the documents located within the box, in index order.
+func (db *DocumentBundle) Within(indexName string, box BBox) ([]GeoMatch, error) {
+	db.readLock()
+	defer db.RUnlock()
+	idx, err := db.geoIndex(indexName)
+	if idx == nil {
+		return nil, err
+	}
+	var out []GeoMatch
+	db.doGeoBox(idx, box, func(offset uint64, doc Document, p Point) {
+		out = append(out, GeoMatch{Offset: offset, Doc: doc, Point: p})
+	})
+	return out, nil
+}
+
+// Great-circle distance in kilometres.
+func haversineKm(a, b Point) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Return the documents within radiusKm of the centre, nearest first, keeping
+// at most limit of them if it's nonzero.
+func (db *DocumentBundle) Near(indexName string, center Point, radiusKm float64, limit int) ([]GeoMatch, error) {
+	//The box around the circle, taking in every longitude near the poles
+	dLat := radiusKm / earthRadiusKm * 180 / math.Pi
+	box := BBox{Point{math.Max(-90, center.Lat-dLat), -180}, Point{math.Min(90, center.Lat+dLat), 180}}
+	if box.Min.Lat > -90 && box.Max.Lat < 90 {
+		maxLat := math.Max(math.Abs(box.Min.Lat), math.Abs(box.Max.Lat)) * math.Pi / 180
+		if dLon := dLat / math.Cos(maxLat); dLon < 180 {
+			box.Min.Lon = math.Remainder(center.Lon-dLon, 360)
+			box.Max.Lon = math.Remainder(center.Lon+dLon, 360)
+		}
+	}
+
+	db.readLock()
+	defer db.RUnlock()
+	idx, err := db.geoIndex(indexName)
+	if idx == nil {
+		return nil, err
+	}
+	var out []GeoMatch
+	db.doGeoBox(idx, box, func(offset uint64, doc Document, p Point) {
+		if d := haversineKm(center, p); d <= radiusKm {
+			out = append(out, GeoMatch{offset, doc, p, d})
+		}
+	})
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Distance < out[j].Distance })
+	if limit != 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// Whether the point is inside the polygon, by counting edge crossings.
+func pointInPolygon(p Point, polygon []Point) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) && p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Return the documents located inside the polygon, given as its vertices in
+// order, in index order.  Edges are straight lines in latitude & longitude,
+// and the polygon mustn't cross the antimeridian.
+func (db *DocumentBundle) WithinPolygon(indexName string, polygon []Point) ([]GeoMatch, error) {
+	if len(polygon) < 3 {
+		return nil, errors.New("clownshoes: polygon needs at least 3 vertices")
+	}
+	box := BBox{polygon[0], polygon[0]}
+	for _, p := range polygon[1:] {
+		box.Min.Lat, box.Min.Lon = math.Min(box.Min.Lat, p.Lat), math.Min(box.Min.Lon, p.Lon)
+		box.Max.Lat, box.Max.Lon = math.Max(box.Max.Lat, p.Lat), math.Max(box.Max.Lon, p.Lon)
+	}
+
+	db.readLock()
+	defer db.RUnlock()
+	idx, err := db.geoIndex(indexName)
+	if idx == nil {
+		return nil, err
+	}
+	var out []GeoMatch
+	db.doGeoBox(idx, box, func(offset uint64, doc Document, p Point) {
+		if pointInPolygon(p, polygon) {
+			out = append(out, GeoMatch{Offset: offset, Doc: doc, Point: p})
+		}
+	})
+	return out, nil
+}
@@ -0,0 +1,126 @@
+package clownshoes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestGeoIndex(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	parse := func(payload []byte) (Point, bool) {
+		var p Point
+		_, err := fmt.Sscanf(string(payload), "%f,%f", &p.Lat, &p.Lon)
+		return p, err == nil
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf("%.6f,%.6f", r.Float64()*180-90, r.Float64()*360-180))))
+	}
+	db.PutDocument(NewDocument([]byte("nowhere")))
+	db.AddGeoIndex("where", parse)
+
+	//Compare against brute force
+	brute := func(keep func(p Point) bool) []string {
+		var out []string
+		db.ForEachDocument(func(offset uint64, doc Document) bool {
+			if p, ok := parse(doc.Payload); ok && keep(p) {
+				out = append(out, string(doc.Payload))
+			}
+			return true
+		})
+		sort.Strings(out)
+		return out
+	}
+	payloads := func(matches []GeoMatch) []string {
+		var out []string
+		for _, m := range matches {
+			out = append(out, string(m.Doc.Payload))
+		}
+		sort.Strings(out)
+		return out
+	}
+	same := func(a, b []string) bool { return fmt.Sprint(a) == fmt.Sprint(b) }
+
+	boxes := []BBox{
+		{Point{10, 20}, Point{30, 45}},
+		{Point{-90, -180}, Point{90, 180}},
+		{Point{-10, 170}, Point{20, -170}},
+		{Point{51.5, -0.2}, Point{51.6, -0.1}},
+	}
+	for _, box := range boxes {
+		matches, e := db.Within("where", box)
+		want := brute(func(p Point) bool {
+			inLon := p.Lon >= box.Min.Lon && p.Lon <= box.Max.Lon
+			if box.Min.Lon > box.Max.Lon {
+				inLon = p.Lon >= box.Min.Lon || p.Lon <= box.Max.Lon
+			}
+			return inLon && p.Lat >= box.Min.Lat && p.Lat <= box.Max.Lat
+		})
+		if e != nil || !same(payloads(matches), want) {
+			t.Error("Within", box, "found", len(matches), "expected", len(want), e)
+		}
+	}
+
+	for _, center := range []Point{{0, 0}, {45, 179}, {89, 0}} {
+		matches, e := db.Near("where", center, 1500, 0)
+		want := brute(func(p Point) bool { return haversineKm(center, p) <= 1500 })
+		if e != nil || !same(payloads(matches), want) {
+			t.Error("Near", center, "found", len(matches), "expected", len(want), e)
+		}
+		for i := 1; i < len(matches); i++ {
+			if matches[i].Distance < matches[i-1].Distance {
+				t.Error("Near results out of order")
+			}
+		}
+		if limited, _ := db.Near("where", center, 1500, 3); len(want) >= 3 && (len(limited) != 3 || limited[2].Offset != matches[2].Offset) {
+			t.Error("Near limit failed", limited)
+		}
+	}
+
+	triangle := []Point{{0, 0}, {40, 10}, {10, 60}}
+	matches, e := db.WithinPolygon("where", triangle)
+	if want := brute(func(p Point) bool { return pointInPolygon(p, triangle) }); e != nil || len(want) == 0 || !same(payloads(matches), want) {
+		t.Error("WithinPolygon found", len(matches), "expected", len(want), e)
+	}
+
+	//Locations follow replacement, and survive a dump & load
+	db.PutDocument(NewDocument([]byte("1.5,1.5")))
+	db.ReplaceDocuments(func(b []byte) ([]byte, bool) {
+		if string(b) == "1.5,1.5" {
+			return []byte("-1.5,-1.5"), true
+		}
+		return nil, false
+	})
+	idxFile, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating indexdump", e)
+	}
+	idxFile.Close()
+	defer os.Remove(idxFile.Name())
+	db.dumpIndexes(idxFile.Name())
+	db.RemoveIndex("where")
+	db.LoadIndexes(map[string]func([]byte) string{"where": GeoKeyFn(parse)}, idxFile.Name())
+	matches, e = db.Near("where", Point{-1.5, -1.5}, 0.01, 0)
+	if e != nil || len(matches) != 1 || string(matches[0].Doc.Payload) != "-1.5,-1.5" {
+		t.Error("Wrong match after replace & reload", matches, e)
+	}
+	if matches, _ = db.Within("where", BBox{Point{1.4, 1.4}, Point{1.6, 1.6}}); len(payloads(matches)) != len(brute(func(p Point) bool { return p.Lat >= 1.4 && p.Lat <= 1.6 && p.Lon >= 1.4 && p.Lon <= 1.6 })) {
+		t.Error("Old location still indexed")
+	}
+
+	db.AddIndex("plain", first2Bytes)
+	if _, e := db.Within("plain", boxes[0]); e == nil {
+		t.Error("Expected error for a non-geo index")
+	}
+}
@@ -0,0 +1,90 @@
+package clownshoes
+
+// Hooks are run inside the write lock around every mutation made through the
+// public CRUD functions, so they must not call back into the DB.  Before* hooks
+// may return a modified payload, or an error to abort the operation; the error
+// is returned to the caller of the CRUD function.  Any field may be nil.
+type Hooks struct {
+	BeforePut     func(payload []byte) ([]byte, error)
+	AfterPut      func(offset uint64, payload []byte)
+	BeforeReplace func(offset uint64, oldPayload, newPayload []byte) ([]byte, error)
+	AfterReplace  func(oldOffset, newOffset uint64, payload []byte)
+	BeforeRemove  func(offset uint64, payload []byte) error
+	AfterRemove   func(offset uint64, payload []byte)
+}
+
+// Register a set of hooks.  Hooks run in the order they were added, with each
+// Before* hook seeing the payload returned by the previous one.
+func (db *DocumentBundle) AddHooks(h Hooks) {
+	db.Lock()
+	defer db.Unlock()
+	db.hooks = append(db.hooks, h)
+}
+
+// Unregister all hooks.
+func (db *DocumentBundle) ClearHooks() {
+	db.Lock()
+	defer db.Unlock()
+	db.hooks = nil
+}
+
+func (db *DocumentBundle) runBeforePut(payload []byte) ([]byte, error) {
+	var err error
+	for _, h := range db.hooks {
+		if h.BeforePut != nil {
+			payload, err = h.BeforePut(payload)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return payload, nil
+}
+
+func (db *DocumentBundle) runAfterPut(offset uint64, payload []byte) {
+	for _, h := range db.hooks {
+		if h.AfterPut != nil {
+			h.AfterPut(offset, payload)
+		}
+	}
+}
+
+func (db *DocumentBundle) runBeforeReplace(offset uint64, oldPayload, newPayload []byte) ([]byte, error) {
+	var err error
+	for _, h := range db.hooks {
+		if h.BeforeReplace != nil {
+			newPayload, err = h.BeforeReplace(offset, oldPayload, newPayload)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newPayload, nil
+}
+
+func (db *DocumentBundle) runAfterReplace(oldOffset, newOffset uint64, payload []byte) {
+	for _, h := range db.hooks {
+		if h.AfterReplace != nil {
+			h.AfterReplace(oldOffset, newOffset, payload)
+		}
+	}
+}
+
+func (db *DocumentBundle) runBeforeRemove(offset uint64, payload []byte) error {
+	for _, h := range db.hooks {
+		if h.BeforeRemove != nil {
+			if err := h.BeforeRemove(offset, payload); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *DocumentBundle) runAfterRemove(offset uint64, payload []byte) {
+	for _, h := range db.hooks {
+		if h.AfterRemove != nil {
+			h.AfterRemove(offset, payload)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package clownshoes
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	errEmpty := errors.New("empty payload")
+	errProtected := errors.New("protected document")
+	var puts, replaces, removes int
+	db.AddHooks(Hooks{
+		BeforePut: func(payload []byte) ([]byte, error) {
+			if len(payload) == 0 {
+				return nil, errEmpty
+			}
+			return append([]byte("stamped:"), payload...), nil
+		},
+		AfterPut: func(offset uint64, payload []byte) { puts++ },
+		BeforeReplace: func(offset uint64, oldPayload, newPayload []byte) ([]byte, error) {
+			return bytes.ToUpper(newPayload), nil
+		},
+		AfterReplace: func(oldOffset, newOffset uint64, payload []byte) { replaces++ },
+		BeforeRemove: func(offset uint64, payload []byte) error {
+			if bytes.Contains(bytes.ToLower(payload), []byte("keep")) {
+				return errProtected
+			}
+			return nil
+		},
+		AfterRemove: func(offset uint64, payload []byte) { removes++ },
+	})
+
+	if _, e := db.PutDocument(NewDocument(nil)); e != errEmpty {
+		t.Error("Hook did not reject document", e)
+	}
+	db.PutDocument(NewDocument([]byte("keep me")))
+	db.PutDocument(NewDocument([]byte("toss me")))
+	if puts != 2 {
+		t.Error("AfterPut ran wrong number of times", puts)
+	}
+	docs := db.GetDocuments(func(b []byte) bool { return bytes.HasPrefix(b, []byte("stamped:")) })
+	if len(docs) != 2 {
+		t.Error("Payloads not modified by hook")
+	}
+
+	ct, e := db.ReplaceDocuments(func(payload []byte) ([]byte, bool) {
+		return append(payload, '!'), true
+	})
+	if ct != 2 || e != nil || replaces != 2 {
+		t.Error("Replacement hooks not run", ct, e, replaces)
+	}
+	if len(db.GetDocuments(func(b []byte) bool { return bytes.Equal(b, []byte("STAMPED:TOSS ME!")) })) != 1 {
+		t.Error("Replacement payload not modified by hook")
+	}
+
+	//Both documents moved on replacement, so the protected one is now last
+	ct, e = db.RemoveDocuments(func(payload []byte) bool { return true })
+	if ct != 1 || e != errProtected || removes != 1 {
+		t.Error("Removal not aborted", ct, e, removes)
+	}
+
+	db.ClearHooks()
+	db.PutDocument(NewDocument(nil))
+	ct, e = db.RemoveDocuments(func(payload []byte) bool { return true })
+	if puts != 2 || removes != 1 || ct != 2 || e != nil {
+		t.Error("Hooks still run after ClearHooks")
+	}
+}
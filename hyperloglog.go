@@ -0,0 +1,100 @@
+package clownshoes
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog estimates the number of distinct keys added to it in a fixed
+// amount of memory: 2^precision bytes, for a standard error of about
+// 1.04/sqrt(2^precision).  See Flajolet et al, "HyperLogLog: the analysis of a
+// near-optimal cardinality estimation algorithm".
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8 //Longest run of leading zeroes + 1 seen for each bucket
+}
+
+// Return an empty HyperLogLog with 2^precision registers.  precision is clamped
+// to 4-16; 12 gives about 1.6% error in 4kb.
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < 4 {
+		precision = 4
+	} else if precision > 16 {
+		precision = 16
+	}
+	return &HyperLogLog{precision, make([]uint8, 1<<precision)}
+}
+
+// FNV alone doesn't spread similar keys across all the bits, so finish with
+// splitmix64's mixer.
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return mix64(h.Sum64())
+}
+
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Record a key.
+func (hll *HyperLogLog) Add(key []byte) {
+	x := hashKey(key)
+	bucket := x >> (64 - hll.precision)
+	//Leading zeroes in the remaining bits, with a sentinel so it's bounded
+	rest := x<<hll.precision | 1<<(hll.precision-1)
+	rank := uint8(bits.LeadingZeros64(rest)) + 1
+	if rank > hll.registers[bucket] {
+		hll.registers[bucket] = rank
+	}
+}
+
+// Fold in the keys recorded by another HyperLogLog of the same precision.
+func (hll *HyperLogLog) Merge(other *HyperLogLog) error {
+	if other.precision != hll.precision {
+		return errors.New("clownshoes: can't merge HyperLogLogs of different precision")
+	}
+	for i, r := range other.registers {
+		if r > hll.registers[i] {
+			hll.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Estimated number of distinct keys recorded.
+func (hll *HyperLogLog) Estimate() uint64 {
+	m := float64(len(hll.registers))
+	sum := 0.0
+	zeroes := 0
+	for _, r := range hll.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeroes++
+		}
+	}
+	var alpha float64
+	switch len(hll.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+	//Small cardinalities are better estimated by linear counting
+	if estimate <= 2.5*m && zeroes != 0 {
+		estimate = m * math.Log(m/float64(zeroes))
+	}
+	return uint64(estimate + 0.5)
+}
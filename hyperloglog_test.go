@@ -0,0 +1,35 @@
+package clownshoes
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		hll := NewHyperLogLog(12)
+		for i := 0; i < n; i++ {
+			hll.Add([]byte(strconv.Itoa(i)))
+			hll.Add([]byte(strconv.Itoa(i)))
+		}
+		est := float64(hll.Estimate())
+		if est < float64(n)*0.95 || est > float64(n)*1.05 {
+			t.Error("Bad estimate", est, "for", n)
+		}
+	}
+
+	a, b := NewHyperLogLog(10), NewHyperLogLog(10)
+	for i := 0; i < 5000; i++ {
+		a.Add([]byte(strconv.Itoa(i)))
+		b.Add([]byte(strconv.Itoa(i + 2500)))
+	}
+	if e := a.Merge(b); e != nil {
+		t.Error(e)
+	}
+	if est := a.Estimate(); est < 7000 || est > 8000 {
+		t.Error("Bad merged estimate", est)
+	}
+	if a.Merge(NewHyperLogLog(11)) == nil {
+		t.Error("Expected error merging different precisions")
+	}
+}
@@ -0,0 +1,253 @@
+package clownshoes
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Background index builds scan the collection in batches under the read lock,
+// so writers only wait for a batch at a time.  Mutations made while a build is
+// running are recorded in its side log, and the offsets they touch are skipped
+// by the scan.  Once the scan reaches the end of the list, the log is replayed
+// under the write lock and the index published in the same step; until then
+// lookups behave as if it doesn't exist.  Compaction invalidates every offset,
+// so restarts the scan.  Tail readers only learn of changes after the fact, so
+// apply them to the build's index directly; see tail.go.
+
+type IndexState int
+
+const (
+	IndexAbsent   IndexState = iota //No index or build by that name
+	IndexBuilding                   //Being built in the background
+	IndexReady                      //Usable for lookups
+	IndexFailed                     //The build failed, and the index was never published
+)
+
+func (s IndexState) String() string {
+	switch s {
+	case IndexBuilding:
+		return "building"
+	case IndexReady:
+		return "ready"
+	case IndexFailed:
+		return "failed"
+	}
+	return "absent"
+}
+
+var (
+	ErrIndexBuildCancelled = errors.New("clownshoes: index build was cancelled")
+	errIndexBuildClosed    = errors.New("clownshoes: DB was closed during index build")
+)
+
+// Number of documents indexed per hold of the read lock
+const indexBuildBatch = 1024
+
+type indexBuild struct {
+	like    *index          //Definition of the index being built
+	idx     *index          //Filled in by the scan
+	log     []indexLogEntry //Changes to the collection since the scan started, in order
+	touched map[uint64]bool //Offsets changed since the scan started, which it skips
+	cursor  uint64          //Last document the scan reached, or 0 before the first
+	err     error           //Why the build failed, if it did
+}
+
+type indexLogEntry struct {
+	key    string
+	offset uint64
+	add    bool
+}
+
+// Start building an index in the background, returning a channel that
+// receives nil once it's ready to use, or the error that stopped it.  An
+// existing index with the same name stays in place until the new one replaces
+// it.  Adding or removing an index with the same name cancels the build.
+func (db *DocumentBundle) AddIndexAsync(indexName string, keyFn func([]byte) string) <-chan error {
+	db.Lock()
+	defer db.Unlock()
+	b := &indexBuild{like: &index{keyFn: keyFn}}
+	b.reset(db.root.options.Tail)
+	if db.builds == nil {
+		db.builds = make(map[string]*indexBuild)
+	}
+	db.builds[indexName] = b
+	done := make(chan error, 1)
+	go func() {
+		done <- db.runIndexBuild(indexName, b)
+	}()
+	return done
+}
+
+// Return the state of the named index, and the error it failed with if it did.
+// A failed build is remembered until the index is added or removed again.
+func (db *DocumentBundle) IndexStatus(indexName string) (IndexState, error) {
+	db.readLock()
+	defer db.RUnlock()
+	if b, found := db.builds[indexName]; found {
+		if b.err != nil {
+			return IndexFailed, b.err
+		}
+		return IndexBuilding, nil
+	}
+	if _, found := db.indexes[indexName]; found {
+		return IndexReady, nil
+	}
+	return IndexAbsent, nil
+}
+
+// Start the build over, tracking the key of each offset if trackKeys, as tail
+// readers do.  Ordered indexes are sorted once they're complete.
+func (b *indexBuild) reset(trackKeys bool) {
+	b.idx = &index{keyFn: b.like.keyFn, lookup: make(map[string][]uint64), filter: b.like.filter, field: b.like.field, geo: b.like.geo}
+	if trackKeys {
+		b.idx.keys = make(map[uint64]string)
+	}
+	b.log = nil
+	b.touched = make(map[uint64]bool)
+	b.cursor = 0
+}
+
+// Start the running builds over.  Assumes the write lock is held.
+func (db *DocumentBundle) restartIndexBuilds() {
+	for _, b := range db.builds {
+		if b.err == nil {
+			b.reset(db.root.options.Tail)
+		}
+	}
+}
+
+// Mark the build failed, dropping what it has built so far.
+func (b *indexBuild) fail(err error) {
+	b.err = err
+	b.idx, b.log, b.touched = nil, nil, nil
+}
+
+// Run fn, which calls the build's key function, failing the build rather than
+// the caller if it panics.
+func (b *indexBuild) guard(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.fail(fmt.Errorf("clownshoes: index key function panicked: %v", r))
+		}
+	}()
+	fn()
+}
+
+// Record an index change in the logs of the running builds.  Assumes the write
+// lock is held.
+func (db *DocumentBundle) logIndexBuilds(doc Document, offset uint64, add bool) {
+	for _, b := range db.builds {
+		if b.err != nil {
+			continue
+		}
+		b.guard(func() {
+			if key, covered := b.idx.keyOf(doc.Payload); covered {
+				b.log = append(b.log, indexLogEntry{key, offset, add})
+			}
+			b.touched[offset] = true
+		})
+	}
+}
+
+// Keep the scans' positions valid when the document at offset is unlinked.
+// Everything up to the previous document has been seen already.  Assumes the
+// write lock is held.
+func (db *DocumentBundle) unlinkFromIndexBuilds(offset uint64, prevDocOffset uint64) {
+	for _, b := range db.builds {
+		if b.cursor == offset {
+			b.cursor = prevDocOffset
+		}
+	}
+}
+
+// Where the scan picks up from.  Assumes a lock is held.
+func (db *DocumentBundle) indexBuildNext(b *indexBuild) uint64 {
+	if b.cursor == 0 {
+		return db.getFirstDocOffset()
+	}
+	return db.doGetDocumentAt(b.cursor).NextDocOffset
+}
+
+// Scan until the build is published or fails.
+func (db *DocumentBundle) runIndexBuild(indexName string, b *indexBuild) error {
+	for {
+		more, scanErr := db.scanIndexBatch(indexName, b)
+		if more && scanErr == nil {
+			continue
+		}
+		if finished, err := db.finishIndexBuild(indexName, b, scanErr); finished {
+			return err
+		}
+	}
+}
+
+// Index the next batch of documents under the read lock, returning whether
+// there are more to go.
+func (db *DocumentBundle) scanIndexBatch(indexName string, b *indexBuild) (more bool, err error) {
+	db.readLock()
+	defer db.RUnlock()
+	if db.builds[indexName] != b {
+		//The handle may be stale, so don't look at the mapping
+		return false, nil
+	}
+	if db.root.AsBytes == nil {
+		return false, errIndexBuildClosed
+	}
+	if b.err != nil {
+		//A writer's change made the key function panic
+		return false, b.err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("clownshoes: index key function panicked: %v", r)
+		}
+	}()
+	pos := db.indexBuildNext(b)
+	for i := 0; i < indexBuildBatch && pos != 0; i++ {
+		doc := db.doGetDocumentAt(pos)
+		if !b.touched[pos] {
+			if key, covered := b.idx.keyOf(doc.Payload); covered {
+				b.idx.add(key, pos)
+			}
+		}
+		b.cursor = pos
+		pos = doc.NextDocOffset
+	}
+	return pos != 0, nil
+}
+
+// Under the write lock, record a failure, or publish the index if the scan is
+// still at the end.  Returns whether the build is over, and how it ended.
+func (db *DocumentBundle) finishIndexBuild(indexName string, b *indexBuild, scanErr error) (bool, error) {
+	db.Lock()
+	defer db.Unlock()
+	if db.builds[indexName] != b {
+		return true, ErrIndexBuildCancelled
+	}
+	if scanErr != nil {
+		b.fail(scanErr)
+		return true, scanErr
+	}
+	if b.err != nil {
+		return true, b.err
+	}
+	if db.root.AsBytes == nil {
+		b.err = errIndexBuildClosed
+		return true, b.err
+	}
+	if db.indexBuildNext(b) != 0 {
+		return false, nil
+	}
+	for _, entry := range b.log {
+		if entry.add {
+			b.idx.add(entry.key, entry.offset)
+		} else {
+			b.idx.remove(entry.key, entry.offset)
+		}
+	}
+	b.idx.ordered = b.like.ordered
+	b.idx.resort()
+	db.doPutIndex(indexName, b.idx)
+	db.publishIndexAdded(indexName)
+	return true, nil
+}
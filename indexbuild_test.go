@@ -0,0 +1,129 @@
+package clownshoes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// Whether two indexes on db hold the same postings.
+func sameIndexes(db *DocumentBundle, a, b string) bool {
+	db.RLock()
+	defer db.RUnlock()
+	la, lb := db.indexes[a].lookup, db.indexes[b].lookup
+	if len(la) != len(lb) {
+		return false
+	}
+	for key, offsets := range la {
+		x := append([]uint64(nil), offsets...)
+		y := append([]uint64(nil), lb[key]...)
+		sortOffsets(x)
+		sortOffsets(y)
+		if fmt.Sprint(x) != fmt.Sprint(y) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAddIndexAsync(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	for i := 0; i < 20000; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf("k%02d:%d", i%50, i))))
+	}
+	keyFn := func(b []byte) string { return string(b[:3]) }
+
+	//Mutate while the index builds, including compacting
+	done := db.AddIndexAsync("async", keyFn)
+	if state, _ := db.IndexStatus("async"); state != IndexBuilding {
+		t.Error("Expected building, got", state)
+	}
+	if docs := db.GetDocumentsWhere("async", "k01"); len(docs) != 0 {
+		t.Error("Index usable before it's ready")
+	}
+	for i := 0; i < 2000; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf("k%02d:new%d", i%60, i))))
+		switch i % 40 {
+		case 0:
+			db.RemoveDocuments(func(b []byte) bool { return string(b) == fmt.Sprintf("k%02d:%d", i*7%50, i*7) })
+		case 1:
+			db.ReplaceDocuments(func(b []byte) ([]byte, bool) {
+				if string(b) == fmt.Sprintf("k%02d:%d", i*3%50, i*3) {
+					return []byte(fmt.Sprintf("k99:longer replacement %d", i)), true
+				}
+				return nil, false
+			})
+		}
+		if i == 1000 {
+			db.Compact()
+		}
+	}
+	if e := <-done; e != nil {
+		t.Fatal("Build failed", e)
+	}
+	if state, _ := db.IndexStatus("async"); state != IndexReady {
+		t.Error("Expected ready, got", state)
+	}
+	db.AddIndex("sync", keyFn)
+	if !sameIndexes(db, "async", "sync") {
+		t.Error("Background build differs from a synchronous one")
+	}
+
+	//Failures are reported and remembered
+	done = db.AddIndexAsync("broken", func(b []byte) string { panic("boom") })
+	if e := <-done; e == nil {
+		t.Error("Expected build to fail")
+	}
+	if state, e := db.IndexStatus("broken"); state != IndexFailed || e == nil {
+		t.Error("Expected failed, got", state, e)
+	}
+	db.RemoveIndex("broken")
+	if state, _ := db.IndexStatus("broken"); state != IndexAbsent {
+		t.Error("Expected absent, got", state)
+	}
+
+	//A key function that panics on a writer's document fails the build, not the writer
+	done = db.AddIndexAsync("poisoned", func(b []byte) string {
+		if string(b) == "k00:poison" {
+			panic("boom")
+		}
+		return keyFn(b)
+	})
+	if _, e := db.PutDocument(NewDocument([]byte("k00:poison"))); e != nil {
+		t.Error("Problem putting document", e)
+	}
+	if e := <-done; e == nil {
+		t.Error("Expected build to fail")
+	}
+	if state, e := db.IndexStatus("poisoned"); state != IndexFailed || e == nil {
+		t.Error("Expected failed, got", state, e)
+	}
+	if docs := db.GetDocuments(func(b []byte) bool { return string(b) == "k00:poison" }); len(docs) != 1 {
+		t.Error("Writer's document missing", len(docs))
+	}
+	db.RemoveIndex("poisoned")
+
+	//Removing the index cancels the build
+	done = db.AddIndexAsync("cancelled", keyFn)
+	db.RemoveIndex("cancelled")
+	if e := <-done; e != nil && e != ErrIndexBuildCancelled {
+		t.Error("Unexpected error", e)
+	}
+	if state, _ := db.IndexStatus("cancelled"); state != IndexAbsent {
+		t.Error("Expected absent, got", state)
+	}
+
+	keys := db.DistinctKeys("async")
+	if !sort.StringsAreSorted(keys) || keys[len(keys)-1] != "k99" {
+		t.Error("Wrong keys", keys[len(keys)-1])
+	}
+}
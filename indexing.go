@@ -3,44 +3,287 @@ package clownshoes
 import (
 	"encoding/gob"
 	"os"
+	"sort"
 )
 
 // Indexes have to be in memory for performance anyway, so we store them as
-// hashmaps.  Equality only.
+// hashmaps.  Equality only, except that ordered indexes also keep their keys
+// sorted for range lookups; see keys.go.
 type index struct {
-	keyFn  func([]byte) string //Derives the key from the document's data
-	lookup map[string][]uint64 //Maintains the lookup from key value to a list of offsets
+	keyFn    func([]byte) string //Derives the key from the document's data
+	lookup   map[string][]uint64 //Maintains the lookup from key value to a list of offsets
+	postings int                 //Total number of offsets across all keys
+	field    string              //JSON path the keys are taken from, for indexes made by AddFieldIndex
+	filter   func([]byte) bool   //Only documents it returns true for are indexed, for partial indexes
+	ordered  bool                //Whether sorted is maintained
+	sorted   []string            //Keys of lookup in order, for ordered indexes
+	geo      bool                //Whether the keys are locations; see geo.go
+	compact  *compactIndex       //Keeps the postings on disk instead of in lookup; see compactindex.go
+	spill    *spillIndex         //Keeps the postings compressed instead of in lookup; see spillindex.go
+	vector   *vectorIndex        //Keys are vectors, also kept for nearest neighbour search; see vector.go
+	keys     map[uint64]string   //Key of each offset, kept by tail readers; see tail.go
 }
 
-func (db *DocumentBundle) deindexDocument(doc Document, offset uint64) {
+// Return the key for the payload, and whether the index covers it at all.
+func (idx *index) keyOf(payload []byte) (string, bool) {
+	if idx.filter != nil && !idx.filter(payload) {
+		return "", false
+	}
+	return idx.keyFn(payload), true
+}
+
+// Add an offset to the key's posting list.
+func (idx *index) add(key string, offset uint64) {
+	if idx.keys != nil {
+		idx.keys[offset] = key
+	}
+	if idx.compact != nil {
+		idx.compact.add(key, offset)
+		idx.postings++
+		return
+	}
+	if idx.spill != nil {
+		idx.spill.add(key, offset)
+		idx.postings++
+		return
+	}
+	offsets, found := idx.lookup[key]
+	if !found && idx.ordered {
+		i := sort.SearchStrings(idx.sorted, key)
+		idx.sorted = append(idx.sorted, "")
+		copy(idx.sorted[i+1:], idx.sorted[i:])
+		idx.sorted[i] = key
+	}
+	idx.lookup[key] = append(offsets, offset)
+	idx.postings++
+	if idx.vector != nil {
+		idx.vector.add(key, offset)
+	}
+}
+
+// Return the offsets under the key.  The slice mustn't be modified.
+func (idx *index) get(key string) []uint64 {
+	if idx.compact != nil {
+		return idx.compact.get(key)
+	}
+	if idx.spill != nil {
+		return idx.spill.get(key)
+	}
+	return idx.lookup[key]
+}
+
+// Number of distinct keys.  Compact indexes may count keys that have had all
+// their documents removed since they were last rebuilt.
+func (idx *index) keyCount() int {
+	if idx.compact != nil {
+		return idx.compact.keys
+	}
+	if idx.spill != nil {
+		return idx.spill.keyCount()
+	}
+	return len(idx.lookup)
+}
+
+// Run proc over each key & its offsets, in no particular order.
+func (idx *index) forEachKey(proc func(key string, offsets []uint64)) {
+	if idx.compact != nil {
+		idx.compact.forEachKey(proc)
+		return
+	}
+	if idx.spill != nil {
+		idx.spill.forEachKey(proc)
+		return
+	}
+	for key, offsets := range idx.lookup {
+		proc(key, offsets)
+	}
+}
+
+// Free any resources outside the Go heap.  Assumes the write lock is held.
+func (idx *index) release() {
+	if idx.compact != nil {
+		idx.compact.release()
+	}
+	if idx.spill != nil {
+		idx.spill.release()
+	}
+}
+
+// Release all the collection's indexes.  Assumes the write lock is held.
+func (db *DocumentBundle) releaseIndexes() {
 	for _, idx := range db.indexes {
-		key := idx.keyFn(doc.Payload)
-		arr := idx.lookup[key]
-		for i := 0; i < len(arr); i++ {
-			if arr[i] == offset {
-				arr[i] = arr[len(arr)-1]
-				idx.lookup[key] = arr[:len(arr)-1]
-				break
+		idx.release()
+	}
+}
+
+// Recalculate the sorted keys of an ordered index from scratch, which is
+// quicker than maintaining them through a bulk load.
+func (idx *index) resort() {
+	idx.sorted = nil
+	if !idx.ordered {
+		return
+	}
+	idx.sorted = make([]string, 0, len(idx.lookup))
+	for key := range idx.lookup {
+		idx.sorted = append(idx.sorted, key)
+	}
+	sort.Strings(idx.sorted)
+}
+
+// Remove an offset from the key's posting list, if it's there.
+func (idx *index) remove(key string, offset uint64) {
+	if idx.keys != nil {
+		delete(idx.keys, offset)
+	}
+	if idx.compact != nil {
+		if idx.compact.remove(key, offset) {
+			idx.postings--
+		}
+		return
+	}
+	if idx.spill != nil {
+		if idx.spill.remove(key, offset) {
+			idx.postings--
+		}
+		return
+	}
+	arr := idx.lookup[key]
+	for i := 0; i < len(arr); i++ {
+		if arr[i] == offset {
+			arr[i] = arr[len(arr)-1]
+			idx.lookup[key] = arr[:len(arr)-1]
+			if len(arr) == 1 {
+				delete(idx.lookup, key)
+				if idx.ordered {
+					i := sort.SearchStrings(idx.sorted, key)
+					idx.sorted = append(idx.sorted[:i], idx.sorted[i+1:]...)
+				}
+			}
+			idx.postings--
+			if idx.vector != nil {
+				idx.vector.remove(offset)
 			}
+			return
 		}
 	}
 }
 
+// Remove an offset from whichever key it's under, without looking at the
+// document, which may have been overwritten.  Only for indexes tracking keys.
+func (idx *index) removeOffset(offset uint64) {
+	if key, found := idx.keys[offset]; found {
+		idx.remove(key, offset)
+	}
+}
+
+// Start tracking the key of each offset already in the index.
+func (idx *index) trackKeys() {
+	idx.keys = make(map[uint64]string)
+	idx.forEachKey(func(key string, offsets []uint64) {
+		for _, offset := range offsets {
+			idx.keys[offset] = key
+		}
+	})
+}
+
+func (db *DocumentBundle) deindexDocument(doc Document, offset uint64) {
+	for _, idx := range db.indexes {
+		if key, covered := idx.keyOf(doc.Payload); covered {
+			idx.remove(key, offset)
+		}
+	}
+	db.logIndexBuilds(doc, offset, false)
+}
+
 func (db *DocumentBundle) indexDocument(doc Document, insertPoint uint64) {
 	for _, idx := range db.indexes {
-		key := idx.keyFn(doc.Payload)
-		idx.lookup[key] = append(idx.lookup[key], insertPoint)
+		if key, covered := idx.keyOf(doc.Payload); covered {
+			idx.add(key, insertPoint)
+		}
 	}
+	db.logIndexBuilds(doc, insertPoint, true)
 }
 
 //For using in the context of already-locking fns
-func (db *DocumentBundle) doAddIndex(indexName string, keyFn func([]byte) string) {
-	idx := index{keyFn, make(map[string][]uint64)}
+func (db *DocumentBundle) doAddIndex(indexName string, keyFn func([]byte) string) *index {
+	return db.doAddPartialIndex(indexName, keyFn, nil)
+}
+
+func (db *DocumentBundle) doAddPartialIndex(indexName string, keyFn func([]byte) string, filter func([]byte) bool) *index {
+	return db.doAddIndexLike(indexName, &index{keyFn: keyFn, filter: filter})
+}
+
+// Add an index with the same definition as the given one.
+func (db *DocumentBundle) doAddIndexLike(indexName string, like *index) *index {
+	idx := newIndexLike(like)
+	db.doRebuildIndex(idx)
+	db.doPutIndex(indexName, idx)
+	return idx
+}
+
+// An empty index with the same definition as the given one.
+func newIndexLike(like *index) *index {
+	idx := &index{keyFn: like.keyFn, filter: like.filter, field: like.field, ordered: like.ordered, geo: like.geo}
+	if like.compact != nil {
+		idx.compact = &compactIndex{opts: like.compact.opts, dir: like.compact.dir}
+	}
+	if like.spill != nil {
+		idx.spill = &spillIndex{opts: like.spill.opts, dir: like.spill.dir}
+	}
+	if like.vector != nil {
+		idx.vector = newVectorIndex(like.vector.opts)
+	}
+	return idx
+}
+
+// Install the index under the given name, releasing any it replaces and
+// cancelling any build of it.
+func (db *DocumentBundle) doPutIndex(indexName string, idx *index) {
+	if old, found := db.indexes[indexName]; found {
+		old.release()
+	}
 	db.indexes[indexName] = idx
+	delete(db.builds, indexName)
+}
+
+// Remove the given index, releasing it and cancelling any build of it.
+func (db *DocumentBundle) doRemoveIndex(indexName string) {
+	if idx, found := db.indexes[indexName]; found {
+		idx.release()
+	}
+	delete(db.indexes, indexName)
+	delete(db.builds, indexName)
+}
+
+// Recalculate the index's contents from scratch.
+func (db *DocumentBundle) doRebuildIndex(idx *index) {
+	idx.lookup = make(map[string][]uint64)
+	idx.postings = 0
+	if db.root.options.Tail {
+		idx.keys = make(map[uint64]string)
+	}
+	if idx.compact != nil {
+		if db.doBuildCompactIndex(idx) == nil {
+			return
+		}
+		//Keep the postings in memory until the next rebuild
+	}
+	if idx.spill != nil {
+		idx.spill.reset()
+	}
+	if idx.vector != nil {
+		idx.vector = newVectorIndex(idx.vector.opts)
+	}
+	ordered := idx.ordered
+	idx.ordered = false
 	//Now calculate values by iterating thru maps
 	db.doForEachDocument(func(offset uint64, doc Document) {
-		idx.lookup[keyFn(doc.Payload)] = append(idx.lookup[keyFn(doc.Payload)], offset)
+		if key, covered := idx.keyOf(doc.Payload); covered {
+			idx.add(key, offset)
+		}
 	})
+	idx.ordered = ordered
+	idx.resort()
 }
 
 // Creates an index on the DB, with the given name, and the given function of the
@@ -52,17 +295,78 @@ func (db *DocumentBundle) AddIndex(indexName string, keyFn func([]byte) string)
 	db.Lock()
 	defer db.Unlock()
 	db.doAddIndex(indexName, keyFn)
+	db.publishIndexAdded(indexName)
+}
+
+// As AddIndex, but only documents for which filter returns true are indexed.
+// Replacing a document re-evaluates the filter, so it enters or leaves the
+// index as its payload changes.  Query never uses partial indexes.
+func (db *DocumentBundle) AddPartialIndex(indexName string, keyFn func([]byte) string, filter func([]byte) bool) {
+	db.Lock()
+	defer db.Unlock()
+	db.doAddPartialIndex(indexName, keyFn, filter)
+	db.publishIndexAdded(indexName)
 }
 
-// Remove the given index from the DB.
+// Tell watchers the named index was added, along with its definition so that
+// followers can build one like it.  Assumes the write lock is held.
+func (db *DocumentBundle) publishIndexAdded(indexName string) {
+	m := db.indexes[indexName].meta()
+	db.publishChange(ChangeEvent{Op: OpAddIndex, Index: indexName, indexMeta: &m})
+}
+
+// Remove the given index from the DB, cancelling any build of it.
 func (db *DocumentBundle) RemoveIndex(indexName string) {
 	db.Lock()
 	defer db.Unlock()
-	delete(db.indexes, indexName)
+	db.doRemoveIndex(indexName)
+	db.publishChange(ChangeEvent{Op: OpRemoveIndex, Index: indexName})
+}
+
+// What an index dump records about each index besides its contents.
+type indexMeta struct {
+	Partial bool        //Built with a filter, which must be supplied again on loading
+	Field   string      //JSON path for indexes made by AddFieldIndex
+	Ordered bool        //Keys are kept sorted
+	Geo     bool        //Keys are made by GeoKeyFn
+	Vector  *vectorMeta //Options & graph of vector indexes
+}
+
+// What an index dump records about a vector index: its options, and its graph
+// if it has one.
+type vectorMeta struct {
+	Options VectorIndexOptions
+	Links   map[uint64][][]uint64
+	Entry   uint64
+}
+
+// The index's definition, without a vector index's graph.
+func (idx *index) meta() indexMeta {
+	m := indexMeta{idx.filter != nil, idx.field, idx.ordered, idx.geo, nil}
+	if v := idx.vector; v != nil {
+		m.Vector = &vectorMeta{Options: v.opts}
+	}
+	return m
+}
+
+// An empty index of the recorded kind, using the given key function & filter,
+// or nil if it's partial and there's no filter to maintain it with.
+func (m indexMeta) like(keyFn func([]byte) string, filter func([]byte) bool) *index {
+	if !m.Partial {
+		filter = nil
+	} else if filter == nil {
+		return nil
+	}
+	idx := &index{keyFn: keyFn, filter: filter, field: m.Field, ordered: m.Ordered, geo: m.Geo}
+	if m.Vector != nil {
+		idx.vector = newVectorIndex(m.Vector.Options)
+	}
+	return idx
 }
 
-// Store the indexes to a file. This is private because for consistency it should
-// always happen in the context of CopyDB
+// Store the indexes of every collection in the file to a file, keyed by
+// collection name and then index name. This is private because for consistency
+// it should always happen in the context of CopyDB
 func (db *DocumentBundle) dumpIndexes(outfile string) error {
 	f, e := os.OpenFile(outfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if e != nil {
@@ -70,29 +374,158 @@ func (db *DocumentBundle) dumpIndexes(outfile string) error {
 	}
 	defer f.Close()
 	outGobEncoder := gob.NewEncoder(f)
-	out := make(map[string]map[string][]uint64)
-	for idxname, idx := range db.indexes {
-		out[idxname] = idx.lookup
+	//Offsets are only meaningful in files of the same layout
+	if e = outGobEncoder.Encode(uint32(formatVersion)); e != nil {
+		return e
+	}
+	out := make(map[string]map[string]map[string][]uint64)
+	meta := make(map[string]map[string]indexMeta)
+	for _, coll := range db.root.openedCollections() {
+		out[coll.name] = make(map[string]map[string][]uint64)
+		meta[coll.name] = make(map[string]indexMeta)
+		for idxname, idx := range coll.indexes {
+			//Compact and spill indexes are too large, and are rebuilt instead
+			if idx.compact != nil || idx.spill != nil {
+				continue
+			}
+			out[coll.name][idxname] = idx.lookup
+			m := idx.meta()
+			if v := idx.vector; v != nil {
+				m.Vector.Links, m.Vector.Entry = v.links, v.entry
+			}
+			meta[coll.name][idxname] = m
+		}
 	}
 	e = outGobEncoder.Encode(out)
+	if e == nil {
+		e = outGobEncoder.Encode(meta)
+	}
 	return e
 }
 
-// Load the packed indexes from the given file, using the supplied map to associate
-// the appropriate key function with them going forward.  Add them to the given
-// db's indexes.  Assumes the index is valid & up-to-date with respect to the given
-// DB.
-func (db *DocumentBundle) LoadIndexes(nameToKeyFns map[string]func([]byte) string, indexFile string) {
+// Load this collection's packed indexes from the given file, using the supplied
+// map to associate the appropriate key function with them going forward.  Add
+// them to the given db's indexes.  Assumes the index is valid & up-to-date with
+// respect to the given DB.  Partial indexes are skipped; see LoadPartialIndexes.
+// Returns an error if the file can't be read, or was dumped from a file of
+// another format version, in which case nothing is loaded.
+func (db *DocumentBundle) LoadIndexes(nameToKeyFns map[string]func([]byte) string, indexFile string) error {
+	return db.LoadPartialIndexes(nameToKeyFns, nil, indexFile)
+}
+
+// As LoadIndexes, also loading partial indexes with the filters in the
+// supplied map.  Partial indexes without a filter there are skipped, since
+// they couldn't be maintained.
+func (db *DocumentBundle) LoadPartialIndexes(nameToKeyFns map[string]func([]byte) string, nameToFilters map[string]func([]byte) bool, indexFile string) error {
 	db.Lock()
-	f, _ := os.Open(indexFile)
-	defer f.Close()
 	defer db.Unlock()
+	f, err := os.Open(indexFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 	inGobDecoder := gob.NewDecoder(f)
 
-	data := make(map[string]map[string][]uint64)
-	inGobDecoder.Decode(&data)
+	var version uint32
+	if err = inGobDecoder.Decode(&version); err != nil {
+		return err
+	}
+	if version != formatVersion {
+		return ErrVersion
+	}
+	data := make(map[string]map[string]map[string][]uint64)
+	if err = inGobDecoder.Decode(&data); err != nil {
+		return err
+	}
+	meta := make(map[string]map[string]indexMeta)
+	if err = inGobDecoder.Decode(&meta); err != nil {
+		return err
+	}
 
-	for idxName, idxlookup := range data {
-		db.indexes[idxName] = index{nameToKeyFns[idxName], idxlookup}
+	for idxName, idxlookup := range data[db.name] {
+		idxMeta := meta[db.name][idxName]
+		filter := nameToFilters[idxName]
+		if !idxMeta.Partial {
+			filter = nil
+		} else if filter == nil {
+			continue
+		}
+		postings := 0
+		for _, offsets := range idxlookup {
+			postings += len(offsets)
+		}
+		idx := &index{keyFn: nameToKeyFns[idxName], lookup: idxlookup, postings: postings, field: idxMeta.Field, filter: filter, ordered: idxMeta.Ordered, geo: idxMeta.Geo}
+		idx.resort()
+		if db.root.options.Tail {
+			idx.trackKeys()
+		}
+		if vm := idxMeta.Vector; vm != nil {
+			idx.vector = newVectorIndex(vm.Options)
+			if vm.Links != nil {
+				//Fill in the vectors without rebuilding the graph
+				idx.vector.links, idx.vector.entry = nil, vm.Entry
+			}
+			for key, offsets := range idxlookup {
+				for _, offset := range offsets {
+					idx.vector.add(key, offset)
+				}
+			}
+			if vm.Links != nil {
+				idx.vector.links = vm.Links
+				idx.vector.indexLinks()
+			}
+		}
+		db.doPutIndex(idxName, idx)
+	}
+	return nil
+}
+
+// Index-only reads answer from the posting lists without touching documents,
+// so they count documents that have expired but not yet been reaped.  A
+// missing index has no keys.
+
+// Return the number of documents with the given key in the named index.
+func (db *DocumentBundle) CountWhere(indexName string, lookupKey string) int {
+	db.readLock()
+	defer db.RUnlock()
+	if idx, found := db.indexes[indexName]; found {
+		return len(idx.get(lookupKey))
+	}
+	return 0
+}
+
+// Whether any document has the given key in the named index.
+func (db *DocumentBundle) ExistsWhere(indexName string, lookupKey string) bool {
+	return db.CountWhere(indexName, lookupKey) != 0
+}
+
+// Return the keys present in the named index, sorted.
+func (db *DocumentBundle) DistinctKeys(indexName string) []string {
+	db.readLock()
+	defer db.RUnlock()
+	idx, found := db.indexes[indexName]
+	if !found {
+		return nil
+	}
+	keys := make([]string, 0, idx.keyCount())
+	idx.forEachKey(func(key string, offsets []uint64) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// Return the number of documents under each key in the named index.
+func (db *DocumentBundle) KeyCardinalities(indexName string) map[string]int {
+	db.readLock()
+	defer db.RUnlock()
+	idx, found := db.indexes[indexName]
+	if !found {
+		return nil
 	}
+	out := make(map[string]int, idx.keyCount())
+	idx.forEachKey(func(key string, offsets []uint64) {
+		out[key] = len(offsets)
+	})
+	return out
 }
@@ -1,6 +1,7 @@
 package clownshoes
 
 import (
+	"encoding/gob"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -61,7 +62,20 @@ func TestIndexing(t *testing.T) {
 	}
 
 	var idxToKeyFn = map[string]func([]byte) string{"ftb": first2Bytes}
-	db.LoadIndexes(idxToKeyFn, idxFileName)
+	if e := db.LoadIndexes(idxToKeyFn, idxFileName+".missing"); e == nil {
+		t.Error("Expected error loading a missing dump")
+	}
+	//Dumps from before the format version was recorded are refused
+	oldDump, _ := os.Create(idxFileName + ".old")
+	gob.NewEncoder(oldDump).Encode(map[string]map[string][]uint64{"ftb": {"ab": {dataStart}}})
+	oldDump.Close()
+	defer os.Remove(idxFileName + ".old")
+	if e := db.LoadIndexes(idxToKeyFn, idxFileName+".old"); e == nil || len(db.indexes) != 0 {
+		t.Error("Loaded an old dump", e)
+	}
+	if e := db.LoadIndexes(idxToKeyFn, idxFileName); e != nil {
+		t.Error("Problem loading indexes", e)
+	}
 	for k, v := range rawStorage {
 		doc := db.GetDocumentsWhere("ftb", k)
 		if len(doc) != len(v) {
@@ -72,7 +86,7 @@ func TestIndexing(t *testing.T) {
 	//Test index-based deletion
 	for k, v := range rawStorage {
 		removedK = k
-		ct := db.RemoveDocumentsWhere("ftb", k, func([]byte) bool { return true })
+		ct, _ := db.RemoveDocumentsWhere("ftb", k, func([]byte) bool { return true })
 		if ct != uint64(len(v)) {
 			t.Error("Insufficient documents removed")
 		}
@@ -122,7 +136,7 @@ func TestDBUpdateWhere(t *testing.T) {
 		return input, false
 	}
 
-	ct := db.ReplaceDocumentsWhere("identity", "alpha", upcaser)
+	ct, _ := db.ReplaceDocumentsWhere("identity", "alpha", upcaser)
 	if ct != 1 {
 		t.Error("Insufficient documents replaced")
 	}
@@ -131,3 +145,95 @@ func TestDBUpdateWhere(t *testing.T) {
 		t.Error("Indexed documents not retrieved after indexed update")
 	}
 }
+
+func TestIndexOnlyReads(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	for _, s := range []string{"ab1", "ab2", "cd1", "ab3", "ef1"} {
+		db.PutDocument(NewDocument([]byte(s)))
+	}
+	db.AddIndex("first2", first2Bytes)
+	db.RemoveDocuments(func(b []byte) bool { return string(b) == "ef1" })
+
+	if db.CountWhere("first2", "ab") != 3 || db.CountWhere("first2", "ef") != 0 || db.CountWhere("nope", "ab") != 0 {
+		t.Error("Wrong counts")
+	}
+	if !db.ExistsWhere("first2", "cd") || db.ExistsWhere("first2", "ef") {
+		t.Error("Wrong existence")
+	}
+	if keys := db.DistinctKeys("first2"); strings.Join(keys, ",") != "ab,cd" {
+		t.Error("Wrong distinct keys", keys)
+	}
+	if cards := db.KeyCardinalities("first2"); len(cards) != 2 || cards["ab"] != 3 || cards["cd"] != 1 {
+		t.Error("Wrong cardinalities", cards)
+	}
+	if db.DistinctKeys("nope") != nil || db.KeyCardinalities("nope") != nil {
+		t.Error("Expected nothing for a missing index")
+	}
+}
+
+func TestPartialIndex(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	active := func(b []byte) bool { return strings.HasSuffix(string(b), ":active") }
+	for _, s := range []string{"u1:active", "u2:idle", "u3:active", "u4:idle"} {
+		db.PutDocument(NewDocument([]byte(s)))
+	}
+	db.AddPartialIndex("active", first2Bytes, active)
+	db.AddIndex("all", first2Bytes)
+	if db.CountWhere("active", "u1") != 1 || db.CountWhere("active", "u2") != 0 || len(db.DistinctKeys("active")) != 2 {
+		t.Error("Wrong partial index contents", db.DistinctKeys("active"))
+	}
+
+	//Documents enter & leave the index as they're replaced, including when
+	//they have to move
+	db.ReplaceDocumentsWhere("all", "u2", func(b []byte) ([]byte, bool) { return []byte("u2:active"), true })
+	db.ReplaceDocumentsWhere("all", "u1", func(b []byte) ([]byte, bool) { return []byte("u1:idle"), true })
+	db.ReplaceDocumentsWhere("all", "u3", func(b []byte) ([]byte, bool) { return []byte("u3:still very much active"), true })
+	db.PutDocument(NewDocument([]byte("u5:active")))
+	if keys := strings.Join(db.DistinctKeys("active"), ","); keys != "u2,u5" {
+		t.Error("Wrong partial index after replacement", keys)
+	}
+	db.Compact()
+	if keys := strings.Join(db.DistinctKeys("active"), ","); keys != "u2,u5" {
+		t.Error("Wrong partial index after compaction", keys)
+	}
+
+	//Dumps record that the index is partial
+	idxFile, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating indexdump", e)
+	}
+	idxFile.Close()
+	defer os.Remove(idxFile.Name())
+	db.dumpIndexes(idxFile.Name())
+	db.RemoveIndex("active")
+	db.RemoveIndex("all")
+
+	keyFns := map[string]func([]byte) string{"active": first2Bytes, "all": first2Bytes}
+	db.LoadIndexes(keyFns, idxFile.Name())
+	if state, _ := db.IndexStatus("active"); state != IndexAbsent || db.CountWhere("all", "u1") != 1 {
+		t.Error("Partial index loaded without its filter")
+	}
+	db.LoadPartialIndexes(keyFns, map[string]func([]byte) bool{"active": active, "all": active}, idxFile.Name())
+	db.PutDocument(NewDocument([]byte("u6:active")))
+	db.PutDocument(NewDocument([]byte("u7:idle")))
+	if keys := strings.Join(db.DistinctKeys("active"), ","); keys != "u2,u5,u6" {
+		t.Error("Wrong loaded partial index", keys)
+	}
+	if db.CountWhere("all", "u7") != 1 {
+		t.Error("Full index given a filter on loading")
+	}
+}
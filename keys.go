@@ -0,0 +1,308 @@
+package clownshoes
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Typed index keys are tuples of values encoded so that comparing the encoded
+// strings bytewise orders them as the tuples would be, part by part.  Each part
+// is a type tag followed by its value, so values of different types order by
+// type first; keep to one type per position.  Signed integers of any size are
+// int64s, unsigned integers uint64s, and float32s float64s.  A tuple that's a
+// prefix of another sorts before it, and its encoding is a prefix of the
+// other's, which is what lets a range bound on (tenant) cover every
+// (tenant, timestamp) key.
+
+const (
+	keyTagNil    = 0x01
+	keyTagInt    = 0x10
+	keyTagUint   = 0x11
+	keyTagFloat  = 0x12
+	keyTagTime   = 0x13
+	keyTagString = 0x14
+	keyTagBytes  = 0x15
+)
+
+// Times that fit in int64 Unix nanoseconds
+var (
+	minKeyTime = time.Unix(0, math.MinInt64)
+	maxKeyTime = time.Unix(0, math.MaxInt64)
+)
+
+// Encode the parts as an order-preserving key.  Parts may be nil, integers,
+// floats other than NaN, time.Times between 1678 and 2262, strings or []bytes.
+func EncodeKey(parts ...interface{}) (string, error) {
+	var out []byte
+	var buf [8]byte
+	putUint := func(tag byte, x uint64) {
+		binary.BigEndian.PutUint64(buf[:], x)
+		out = append(append(out, tag), buf[:]...)
+	}
+	putBytes := func(tag byte, b []byte) {
+		out = append(out, tag)
+		//Escape NULs so the terminator sorts before any continuation
+		for _, c := range b {
+			if c == 0 {
+				out = append(out, 0, 0xff)
+			} else {
+				out = append(out, c)
+			}
+		}
+		out = append(out, 0, 1)
+	}
+
+	for i, part := range parts {
+		switch v := part.(type) {
+		case nil:
+			out = append(out, keyTagNil)
+		case int:
+			putUint(keyTagInt, uint64(v)^1<<63)
+		case int8:
+			putUint(keyTagInt, uint64(v)^1<<63)
+		case int16:
+			putUint(keyTagInt, uint64(v)^1<<63)
+		case int32:
+			putUint(keyTagInt, uint64(v)^1<<63)
+		case int64:
+			putUint(keyTagInt, uint64(v)^1<<63)
+		case uint:
+			putUint(keyTagUint, uint64(v))
+		case uint8:
+			putUint(keyTagUint, uint64(v))
+		case uint16:
+			putUint(keyTagUint, uint64(v))
+		case uint32:
+			putUint(keyTagUint, uint64(v))
+		case uint64:
+			putUint(keyTagUint, v)
+		case float32:
+			if math.IsNaN(float64(v)) {
+				return "", fmt.Errorf("clownshoes: key part %d is NaN", i)
+			}
+			putUint(keyTagFloat, orderedFloatBits(float64(v)))
+		case float64:
+			if math.IsNaN(v) {
+				return "", fmt.Errorf("clownshoes: key part %d is NaN", i)
+			}
+			putUint(keyTagFloat, orderedFloatBits(v))
+		case time.Time:
+			if v.Before(minKeyTime) || v.After(maxKeyTime) {
+				return "", fmt.Errorf("clownshoes: key part %d is out of range", i)
+			}
+			putUint(keyTagTime, uint64(v.UnixNano())^1<<63)
+		case string:
+			putBytes(keyTagString, []byte(v))
+		case []byte:
+			putBytes(keyTagBytes, v)
+		default:
+			return "", fmt.Errorf("clownshoes: key part %d has unsupported type %T", i, part)
+		}
+	}
+	return string(out), nil
+}
+
+// Negative floats have every bit flipped, so larger magnitudes sort first, and
+// positive ones just the sign bit.  -0 is treated as 0.
+func orderedFloatBits(f float64) uint64 {
+	if f == 0 {
+		f = 0
+	}
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | 1<<63
+}
+
+// Decode a key made by EncodeKey.  Integers come back as int64 or uint64,
+// floats as float64 and times in UTC.
+func DecodeKey(key string) ([]interface{}, error) {
+	var parts []interface{}
+	corrupt := errors.New("clownshoes: malformed key")
+	for len(key) != 0 {
+		tag := key[0]
+		key = key[1:]
+		switch tag {
+		case keyTagNil:
+			parts = append(parts, nil)
+		case keyTagInt, keyTagUint, keyTagFloat, keyTagTime:
+			if len(key) < 8 {
+				return nil, corrupt
+			}
+			x := binary.BigEndian.Uint64([]byte(key[:8]))
+			key = key[8:]
+			switch tag {
+			case keyTagInt:
+				parts = append(parts, int64(x^1<<63))
+			case keyTagUint:
+				parts = append(parts, x)
+			case keyTagFloat:
+				if x&(1<<63) != 0 {
+					x &^= 1 << 63
+				} else {
+					x = ^x
+				}
+				parts = append(parts, math.Float64frombits(x))
+			case keyTagTime:
+				parts = append(parts, time.Unix(0, int64(x^1<<63)).UTC())
+			}
+		case keyTagString, keyTagBytes:
+			var b []byte
+			for {
+				i := strings.IndexByte(key, 0)
+				if i < 0 || i+1 == len(key) {
+					return nil, corrupt
+				}
+				b = append(b, key[:i]...)
+				next := key[i+1]
+				key = key[i+2:]
+				if next == 1 {
+					break
+				} else if next != 0xff {
+					return nil, corrupt
+				}
+				b = append(b, 0)
+			}
+			if tag == keyTagString {
+				parts = append(parts, string(b))
+			} else {
+				parts = append(parts, b)
+			}
+		default:
+			return nil, corrupt
+		}
+	}
+	return parts, nil
+}
+
+// The smallest string greater than every string with the given prefix, or ""
+// if there isn't one.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// Wrap a function returning a key's parts as an index key function.  Documents
+// it returns nil for, or parts EncodeKey rejects, get the key "", which range
+// lookups skip.  Use this for the key functions of ordered indexes passed to
+// LoadIndexes.
+func OrderedKeyFn(keyFn func(payload []byte) []interface{}) func([]byte) string {
+	return func(payload []byte) string {
+		parts := keyFn(payload)
+		if parts == nil {
+			return ""
+		}
+		key, err := EncodeKey(parts...)
+		if err != nil {
+			return ""
+		}
+		return key
+	}
+}
+
+// Add an index keyed by typed tuples, which keeps its keys in order for range
+// lookups.  Equality lookups with GetDocumentsWhere and the like take keys made
+// by EncodeKey.
+func (db *DocumentBundle) AddOrderedIndex(indexName string, keyFn func(payload []byte) []interface{}) {
+	db.Lock()
+	defer db.Unlock()
+	db.doAddIndexLike(indexName, &index{keyFn: OrderedKeyFn(keyFn), ordered: true})
+	db.publishIndexAdded(indexName)
+}
+
+// Keys from Lo to Hi inclusive, where a bound that's a prefix of a key covers
+// it: Lo (a) and Hi (a) together take in every key starting with a.  Nil bounds
+// are open.
+type KeyRange struct {
+	Lo, Hi []interface{}
+	Desc   bool //Visit the keys from highest to lowest
+}
+
+// Run proc over the documents whose keys in the named ordered index are in the
+// range, in key order, until it returns false.  Does nothing if there is no
+// such index.
+func (db *DocumentBundle) ForEachDocumentInRange(indexName string, r KeyRange, proc func(offset uint64, doc Document) bool) error {
+	var lo, hi string
+	var err error
+	if r.Lo != nil {
+		if lo, err = EncodeKey(r.Lo...); err != nil {
+			return err
+		}
+	}
+	if r.Hi != nil {
+		if hi, err = EncodeKey(r.Hi...); err != nil {
+			return err
+		}
+		hi = prefixEnd(hi)
+	}
+
+	db.readLock()
+	defer db.RUnlock()
+	idx, found := db.indexes[indexName]
+	if !found {
+		return nil
+	}
+	if !idx.ordered {
+		return errors.New("clownshoes: index " + indexName + " isn't ordered")
+	}
+	start := sort.SearchStrings(idx.sorted, lo)
+	if start < len(idx.sorted) && idx.sorted[start] == "" {
+		start++
+	}
+	end := len(idx.sorted)
+	if hi != "" {
+		end = sort.SearchStrings(idx.sorted, hi)
+	}
+
+	now := timeNow().UnixNano()
+	visit := func(key string) bool {
+		offsets := idx.lookup[key]
+		for i := range offsets {
+			offset := offsets[i]
+			if r.Desc {
+				offset = offsets[len(offsets)-1-i]
+			}
+			doc := db.doGetDocumentAt(offset)
+			if !doc.expiredAt(now) && !proc(offset, doc) {
+				return false
+			}
+		}
+		return true
+	}
+	if r.Desc {
+		for i := end - 1; i >= start; i-- {
+			if !visit(idx.sorted[i]) {
+				return nil
+			}
+		}
+	} else {
+		for i := start; i < end; i++ {
+			if !visit(idx.sorted[i]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Return the documents whose keys in the named ordered index are in the range,
+// in key order.
+func (db *DocumentBundle) GetDocumentsInRange(indexName string, r KeyRange) (docs []Document, err error) {
+	err = db.ForEachDocumentInRange(indexName, r, func(offset uint64, doc Document) bool {
+		docs = append(docs, doc)
+		return true
+	})
+	return docs, err
+}
@@ -0,0 +1,155 @@
+package clownshoes
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeKey(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	//Each in ascending order
+	series := [][]interface{}{
+		{int64(math.MinInt64), -1000, int8(-1), 0, int32(1), int64(math.MaxInt64)},
+		{uint8(0), uint(1), uint64(1 << 40), uint64(math.MaxUint64)},
+		{math.Inf(-1), -1e300, -2.5, float32(-1), 0.0, 1e-300, 3.0, math.Inf(1)},
+		{base.Add(-time.Hour), base, base.Add(time.Nanosecond)},
+		{"", "\x00", "\x00\x00", "\x00a", "a", "a\x00", "ab", "b"},
+		{[]byte{}, []byte{0}, []byte{1}, []byte{0xff}, []byte{0xff, 0}},
+	}
+	for _, values := range series {
+		var keys []string
+		for _, v := range values {
+			key, e := EncodeKey(v)
+			if e != nil {
+				t.Fatal("Couldn't encode", v, e)
+			}
+			keys = append(keys, key)
+		}
+		if !sort.StringsAreSorted(keys) {
+			t.Error("Encoding doesn't preserve order of", values)
+		}
+	}
+
+	//Composite keys order by each part in turn, and prefixes first
+	tuples := [][]interface{}{
+		{"acme"},
+		{"acme", base},
+		{"acme", base, 1},
+		{"acme", base.Add(time.Second)},
+		{"acme\x00"},
+		{"acmf", base.Add(-time.Hour)},
+	}
+	var keys []string
+	for _, tuple := range tuples {
+		key, _ := EncodeKey(tuple...)
+		keys = append(keys, key)
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Error("Composite encoding doesn't preserve order")
+	}
+
+	parts := []interface{}{nil, int64(-5), uint64(7), -0.5, base, "a\x00b", []byte{0, 0xff}}
+	key, _ := EncodeKey(parts...)
+	decoded, e := DecodeKey(key)
+	if e != nil || !reflect.DeepEqual(decoded, parts) {
+		t.Error("Round trip failed", decoded, e)
+	}
+	if _, e := EncodeKey(math.NaN()); e == nil {
+		t.Error("Expected error encoding NaN")
+	}
+	if _, e := EncodeKey(struct{}{}); e == nil {
+		t.Error("Expected error encoding struct")
+	}
+	if _, e := DecodeKey("\x14abc"); e == nil {
+		t.Error("Expected error decoding unterminated string")
+	}
+}
+
+func TestOrderedIndex(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	//Payloads are tenant:unix seconds
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 300; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf("t%d:%d", i%3, base.Unix()+int64(i)))))
+	}
+	db.PutDocument(NewDocument([]byte("garbage")))
+	keyFn := func(payload []byte) []interface{} {
+		fields := strings.Split(string(payload), ":")
+		if len(fields) != 2 {
+			return nil
+		}
+		secs, _ := strconv.ParseInt(fields[1], 10, 64)
+		return []interface{}{fields[0], time.Unix(secs, 0)}
+	}
+	db.AddOrderedIndex("tenant-time", keyFn)
+
+	check := func(stage string, total int) {
+		docs, e := db.GetDocumentsInRange("tenant-time", KeyRange{Lo: []interface{}{"t1", base.Add(10 * time.Second)}, Hi: []interface{}{"t1", base.Add(20 * time.Second)}})
+		var got []string
+		for _, doc := range docs {
+			got = append(got, string(doc.Payload))
+		}
+		want := []string{"t1:1577836810", "t1:1577836813", "t1:1577836816", "t1:1577836819"}
+		if e != nil || !reflect.DeepEqual(got, want) {
+			t.Error(stage, "wrong range", got, e)
+		}
+
+		//A prefix bound covers the whole tenant, and descending works
+		docs, _ = db.GetDocumentsInRange("tenant-time", KeyRange{Lo: []interface{}{"t2"}, Hi: []interface{}{"t2"}, Desc: true})
+		if len(docs) != 100 || string(docs[0].Payload) != "t2:1577837099" || string(docs[99].Payload) != "t2:1577836802" {
+			t.Error(stage, "wrong prefix range", len(docs))
+		}
+
+		//Unbounded skips documents without a key
+		var count int
+		var last []byte
+		db.ForEachDocumentInRange("tenant-time", KeyRange{}, func(offset uint64, doc Document) bool {
+			if bytes.Equal(doc.Payload, []byte("garbage")) || last != nil && string(last[:2]) > string(doc.Payload[:2]) {
+				t.Error(stage, "out of order", string(doc.Payload))
+			}
+			last = doc.Payload
+			count++
+			return true
+		})
+		if count != total {
+			t.Error(stage, "wrong count", count)
+		}
+	}
+	check("initial", 300)
+
+	//Keys follow replacement & removal
+	db.RemoveDocuments(func(b []byte) bool { return string(b) == "t1:1577836813" })
+	db.ReplaceDocuments(func(b []byte) ([]byte, bool) {
+		if string(b) == "t0:1577836800" {
+			return []byte("t1:1577836813"), true
+		}
+		return nil, false
+	})
+	db.Compact()
+	check("after compaction", 299)
+
+	key, _ := EncodeKey("t0", time.Unix(1577836803, 0))
+	if db.CountWhere("tenant-time", key) != 1 {
+		t.Error("Equality lookup on an encoded key failed")
+	}
+	db.AddIndex("plain", first2Bytes)
+	if e := db.ForEachDocumentInRange("plain", KeyRange{}, func(uint64, Document) bool { return true }); e == nil {
+		t.Error("Expected error for a range over an unordered index")
+	}
+}
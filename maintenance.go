@@ -0,0 +1,179 @@
+package clownshoes
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Checks & adjustments for inspecting possibly damaged files, which can't assume
+// any pointers are valid.
+
+var ErrNoDocument = errors.New("clownshoes: no document at that offset")
+
+// Whether there's a live document of this collection at the given offset.  The
+// first call walks every collection to record which one each live document is
+// in, and journal keeps that up to date, so later calls take constant time.
+func (db *DocumentBundle) doIsDocumentAt(offset uint64) bool {
+	root := db.root
+	//Readers may get here together, holding just the read lock
+	root.ownersMu.Lock()
+	defer root.ownersMu.Unlock()
+	if root.owners == nil {
+		root.owners = root.findOwners()
+	}
+	headPos, live := root.owners[offset]
+	return live && headPos == db.headPos
+}
+
+// Map each live document's offset to the list head of its collection, walking
+// each list forwards as far as its links are in bounds.  Called on the root.
+func (db *DocumentBundle) findOwners() map[uint64]uint64 {
+	owners := make(map[uint64]uint64)
+	tail := db.getTail()
+	heads := []uint64{db.headPos}
+	for i := 0; i < maxCollections; i++ {
+		slotPos := catalogStart + uint64(i)*catalogSlot
+		if db.collectionNameAt(slotPos) != "" {
+			heads = append(heads, slotPos+maxNameLength)
+		}
+	}
+	for _, headPos := range heads {
+		pos := uint64FromBytes(db.AsBytes, headPos)
+		count := uint64FromBytes(db.AsBytes, headPos+16)
+		//More steps than documents means we're going round in circles
+		for steps := uint64(0); pos != 0 && steps < count && db.docInBounds(pos, tail); steps++ {
+			owners[pos] = headPos
+			pos = uint64FromBytes(db.AsBytes, pos+4)
+		}
+	}
+	return owners
+}
+
+// Whether there's a live document at the given offset going by its links
+// alone: it's in bounds, and its neighbours point back at it, or this
+// collection's ends do.  Takes constant time without the map doIsDocumentAt
+// builds, but a document in the middle of another collection's list passes.
+func (db *DocumentBundle) doIsLinkedAt(offset uint64) bool {
+	tail := db.getTail()
+	if !db.docInBounds(offset, tail) {
+		return false
+	}
+	prev := uint64FromBytes(db.AsBytes, offset+12)
+	if prev == 0 {
+		if db.getFirstDocOffset() != offset {
+			return false
+		}
+	} else if !db.docInBounds(prev, tail) || uint64FromBytes(db.AsBytes, prev+4) != offset {
+		return false
+	}
+	next := uint64FromBytes(db.AsBytes, offset+4)
+	if next == 0 {
+		return db.getLastDocOffset() == offset
+	}
+	return db.docInBounds(next, tail) && uint64FromBytes(db.AsBytes, next+12) == offset
+}
+
+// Whether the document at pos, going by its size, lies between the start of
+// the data and end.
+func (db *DocumentBundle) docInBounds(pos, end uint64) bool {
+	if pos < dataStart || pos+docHeaderSize > end {
+		return false
+	}
+	size := uint64(uint32FromBytes(db.AsBytes, pos))
+	return size >= docHeaderSize && pos+size <= end
+}
+
+// Walk every collection's list forwards & backwards, checking that pointers are
+// in bounds and agree with each other, and that the counts in the header are
+// accurate.  Returns a description of each problem found.
+func (db *DocumentBundle) Verify() (problems []error) {
+	db.readLock()
+	defer db.RUnlock()
+
+	tail := db.getTail()
+	if tail > uint64(len(db.AsBytes)) {
+		return []error{fmt.Errorf("end of data %d is past end of mapping %d", tail, len(db.AsBytes))}
+	}
+	//More documents than this means we're going round in circles
+	maxDocs := (tail - dataStart) / docHeaderSize
+
+	for _, coll := range db.root.collectionViews() {
+		report := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Errorf("collection %q: "+format, append([]interface{}{coll.name}, args...)...))
+		}
+
+		var forward, bytes uint64
+		prev, pos := uint64(0), coll.getFirstDocOffset()
+		for pos != 0 {
+			if !db.docInBounds(pos, tail) {
+				report("forward walk reached invalid document at %d", pos)
+				break
+			}
+			doc := db.doGetDocumentAt(pos)
+			if doc.PrevDocOffset != prev {
+				report("document at %d points back to %d rather than %d", pos, doc.PrevDocOffset, prev)
+			}
+			forward++
+			bytes += doc.byteSize()
+			if forward > maxDocs {
+				report("forward walk doesn't terminate")
+				break
+			}
+			prev, pos = pos, doc.NextDocOffset
+		}
+		if pos == 0 && prev != coll.getLastDocOffset() {
+			report("forward walk ended at %d, but last document is %d", prev, coll.getLastDocOffset())
+		}
+
+		var backward uint64
+		next, pos := uint64(0), coll.getLastDocOffset()
+		for pos != 0 {
+			if !db.docInBounds(pos, tail) {
+				report("backward walk reached invalid document at %d", pos)
+				break
+			}
+			doc := db.doGetDocumentAt(pos)
+			if doc.NextDocOffset != next {
+				report("document at %d points forward to %d rather than %d", pos, doc.NextDocOffset, next)
+			}
+			backward++
+			if backward > maxDocs {
+				report("backward walk doesn't terminate")
+				break
+			}
+			next, pos = pos, doc.PrevDocOffset
+		}
+		if pos == 0 && next != coll.getFirstDocOffset() {
+			report("backward walk ended at %d, but first document is %d", next, coll.getFirstDocOffset())
+		}
+
+		if forward != backward {
+			report("%d documents walking forwards, %d walking backwards", forward, backward)
+		}
+		if forward != coll.getDocCount() || bytes != coll.getLiveBytes() {
+			report("header records %d documents in %d bytes, found %d in %d", coll.getDocCount(), coll.getLiveBytes(), forward, bytes)
+		}
+	}
+	return problems
+}
+
+// Extend the file & mapping by the given number of bytes.
+func (db *DocumentBundle) Grow(bytes uint64) error {
+	db.Lock()
+	defer db.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	return db.doReMmap(uint64(len(db.AsBytes)) + bytes)
+}
+
+// Truncate the file & mapping to the end of the last document, without moving
+// anything.  The next insert will grow it again.
+func (db *DocumentBundle) Shrink() error {
+	db.Lock()
+	defer db.Unlock()
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	return db.doReMmap(db.getTail())
+}
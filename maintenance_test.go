@@ -0,0 +1,105 @@
+package clownshoes
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	var offsets []uint64
+	for i := 0; i < 5; i++ {
+		offset, _ := db.PutDocument(NewDocument([]byte("document")))
+		offsets = append(offsets, offset)
+		db.Collection("other").PutDocument(NewDocument([]byte("other document")))
+	}
+	if problems := db.Verify(); len(problems) != 0 {
+		t.Error("Problems in valid DB", problems)
+	}
+
+	if doc, e := db.GetDocumentAt(offsets[2]); e != nil || string(doc.Payload) != "document" {
+		t.Error("Valid document not retrieved", e)
+	}
+	if _, e := db.GetDocumentAt(offsets[2] + 1); e != ErrNoDocument {
+		t.Error("Retrieved document at invalid offset")
+	}
+	if !db.doIsLinkedAt(offsets[2]) || db.doIsLinkedAt(offsets[2]+1) {
+		t.Error("Wrong answer checking links")
+	}
+	db.RemoveDocuments(func(b []byte) bool { return true })
+	for _, offset := range offsets {
+		if _, e := db.GetDocumentAt(offset); e != ErrNoDocument {
+			t.Error("Retrieved removed document")
+		}
+		if db.doIsLinkedAt(offset) {
+			t.Error("Removed document still linked")
+		}
+	}
+	offsets = offsets[:0]
+	for i := 0; i < 5; i++ {
+		offset, _ := db.PutDocument(NewDocument([]byte("document")))
+		offsets = append(offsets, offset)
+	}
+
+	//Break a back-pointer
+	db.setPrevDocOffset(offsets[3], offsets[1])
+	if problems := db.Verify(); len(problems) == 0 {
+		t.Error("Broken link not detected")
+	}
+	db.setPrevDocOffset(offsets[3], offsets[2])
+
+	//Make a cycle
+	db.setNextDocOffset(offsets[4], offsets[0])
+	if problems := db.Verify(); len(problems) == 0 {
+		t.Error("Cycle not detected")
+	}
+	db.setNextDocOffset(offsets[4], 0)
+
+	stats, _ := db.Stats()
+	if e := db.Shrink(); e != nil || uint64(len(db.AsBytes)) != stats.EndOffset {
+		t.Error("Shrink failed", e)
+	}
+	if e := db.Grow(4096); e != nil || uint64(len(db.AsBytes)) != stats.EndOffset+4096 {
+		t.Error("Grow failed", e)
+	}
+	db.PutDocument(NewDocument([]byte("document")))
+	if problems := db.Verify(); len(problems) != 0 {
+		t.Error("Problems after shrinking & growing", problems)
+	}
+}
+
+func TestVerifyUnopenedCollections(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db := NewDB(f.Name())
+	db.Collection("other").PutDocument(NewDocument([]byte("other document")))
+	db.Close()
+
+	//Readers may verify together without opening the collection
+	db = NewDB(f.Name())
+	defer db.Close()
+	done := make(chan []error)
+	for i := 0; i < 4; i++ {
+		go func() { done <- db.Verify() }()
+	}
+	for i := 0; i < 4; i++ {
+		if problems := <-done; len(problems) != 0 {
+			t.Error("Problems in valid DB", problems)
+		}
+	}
+	if len(db.collections) != 0 {
+		t.Error("Verify opened collections", len(db.collections))
+	}
+}
@@ -0,0 +1,403 @@
+package clownshoes
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Ordered reads sort the documents they find by a key function or comparator
+// before returning them.  Documents are collected in memory until they exceed
+// the budget, then sorted and written out as a run to a temp file; the runs
+// are merged at the end.  Ties keep the order the documents were found in.
+// With a limit, each run only keeps the documents that could make the page.
+// What's left in memory is sorted, and copied out of the mapping, before the
+// lock is released, so the merge afterwards doesn't read the file.
+
+type Ordering struct {
+	Key          func(payload []byte) []byte //Sort key, compared bytewise
+	Less         func(a, b []byte) bool      //Alternatively, a comparator on payloads
+	Desc         bool
+	Offset       int //Number of documents to skip, for pagination
+	Limit        int //Maximum number of documents to return, if nonzero
+	MemoryBudget int //Bytes of keys and payloads to hold before spilling; DefaultSortBudget if zero
+}
+
+const DefaultSortBudget = 64 << 20
+
+// Per-record bookkeeping counted against the budget
+const sortRecordOverhead = 64
+
+type sortRecord struct {
+	key    []byte
+	offset uint64
+	seq    uint64 //Order found in, for stability
+	doc    Document
+}
+
+type sorter struct {
+	ord  *Ordering
+	keep int //Records each run needs to keep, or 0 for all
+	mem  []sortRecord
+	size int
+	runs []*os.File
+	seq  uint64
+	err  error
+
+	settled bool //Memory is sorted and copied out of the mapping
+}
+
+func (ord *Ordering) check() error {
+	if (ord.Key == nil) == (ord.Less == nil) {
+		return errors.New("clownshoes: ordering needs exactly one of Key and Less")
+	}
+	if ord.Offset < 0 || ord.Limit < 0 {
+		return errors.New("clownshoes: negative offset or limit")
+	}
+	return nil
+}
+
+func newSorter(ord *Ordering) *sorter {
+	s := &sorter{ord: ord}
+	if ord.Limit != 0 {
+		s.keep = ord.Offset + ord.Limit
+	}
+	return s
+}
+
+func (s *sorter) less(a, b *sortRecord) bool {
+	cmp := 0
+	if s.ord.Less != nil {
+		if s.ord.Less(a.doc.Payload, b.doc.Payload) {
+			cmp = -1
+		} else if s.ord.Less(b.doc.Payload, a.doc.Payload) {
+			cmp = 1
+		}
+	} else {
+		cmp = bytes.Compare(a.key, b.key)
+	}
+	if s.ord.Desc {
+		cmp = -cmp
+	}
+	if cmp != 0 {
+		return cmp < 0
+	}
+	return a.seq < b.seq
+}
+
+// Sort what's in memory, keeping only what the page could need.
+func (s *sorter) sortMem() {
+	sort.Slice(s.mem, func(i, j int) bool { return s.less(&s.mem[i], &s.mem[j]) })
+	if s.keep != 0 && len(s.mem) > s.keep {
+		s.mem = s.mem[:s.keep]
+	}
+}
+
+// Sort what's in memory and copy the kept records' keys & payloads, which may
+// point into the mapping.  Must be called before the lock is released.
+func (s *sorter) settle() {
+	if s.err != nil {
+		return
+	}
+	s.sortMem()
+	for i := range s.mem {
+		rec := &s.mem[i]
+		rec.key = append([]byte(nil), rec.key...)
+		rec.doc.Payload = append([]byte(nil), rec.doc.Payload...)
+	}
+	s.settled = true
+}
+
+// Add a document found at offset.  Assumes the lock is held.
+func (s *sorter) add(offset uint64, doc Document) {
+	if s.err != nil {
+		return
+	}
+	rec := sortRecord{offset: offset, doc: doc}
+	if s.ord.Key != nil {
+		rec.key = s.ord.Key(doc.Payload)
+	}
+	s.push(rec)
+}
+
+// Add just a key & offset, for sorting without payloads.
+func (s *sorter) addKey(offset uint64, key []byte) {
+	if s.err != nil {
+		return
+	}
+	s.push(sortRecord{key: key, offset: offset})
+}
+
+func (s *sorter) push(rec sortRecord) {
+	rec.seq = s.seq
+	s.seq++
+	s.mem = append(s.mem, rec)
+	s.size += len(rec.key) + len(rec.doc.Payload) + sortRecordOverhead
+
+	budget := s.ord.MemoryBudget
+	if budget == 0 {
+		budget = DefaultSortBudget
+	}
+	if s.size > budget {
+		s.err = s.spill()
+	}
+}
+
+// Write the sorted contents of memory out as a run.
+func (s *sorter) spill() error {
+	s.sortMem()
+	f, err := ioutil.TempFile("", "clownshoes-sort")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	s.runs = append(s.runs, f)
+
+	w := bufio.NewWriter(f)
+	var buf [binary.MaxVarintLen64]byte
+	putUvarint := func(x uint64) {
+		w.Write(buf[:binary.PutUvarint(buf[:], x)])
+	}
+	for _, rec := range s.mem {
+		putUvarint(uint64(len(rec.key)))
+		w.Write(rec.key)
+		putUvarint(uint64(len(rec.doc.Payload)))
+		w.Write(rec.doc.Payload)
+		putUvarint(rec.offset)
+		putUvarint(rec.seq)
+		w.Write(buf[:binary.PutVarint(buf[:], rec.doc.Expires)])
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.mem, s.size = nil, 0
+	return nil
+}
+
+// Reads back a spilled run.
+type runReader struct {
+	r    *bufio.Reader
+	head sortRecord
+}
+
+func (rr *runReader) next() (bool, error) {
+	keyLen, err := binary.ReadUvarint(rr.r)
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	readBytes := func(n uint64) []byte {
+		b := make([]byte, n)
+		if _, e := io.ReadFull(rr.r, b); e != nil && err == nil {
+			err = e
+		}
+		return b
+	}
+	rec := sortRecord{}
+	if keyLen != 0 {
+		rec.key = readBytes(keyLen)
+	}
+	var payloadLen uint64
+	if err == nil {
+		payloadLen, err = binary.ReadUvarint(rr.r)
+	}
+	payload := readBytes(payloadLen)
+	if err == nil {
+		rec.offset, err = binary.ReadUvarint(rr.r)
+	}
+	if err == nil {
+		rec.seq, err = binary.ReadUvarint(rr.r)
+	}
+	if err == nil {
+		rec.doc.Expires, err = binary.ReadVarint(rr.r)
+	}
+	if err != nil {
+		return false, err
+	}
+	rec.doc.Size = docHeaderSize + uint32(payloadLen)
+	rec.doc.Payload = payload
+	rr.head = rec
+	return true, nil
+}
+
+// The in-memory run, as one more source for the merge.
+type memRun struct {
+	recs []sortRecord
+}
+
+type mergeSource interface {
+	current() *sortRecord
+	advance() (bool, error)
+}
+
+func (rr *runReader) current() *sortRecord   { return &rr.head }
+func (rr *runReader) advance() (bool, error) { return rr.next() }
+func (mr *memRun) current() *sortRecord      { return &mr.recs[0] }
+func (mr *memRun) advance() (bool, error)    { mr.recs = mr.recs[1:]; return len(mr.recs) != 0, nil }
+
+type mergeHeap struct {
+	s       *sorter
+	sources []mergeSource
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+func (h *mergeHeap) Less(i, j int) bool {
+	return h.s.less(h.sources[i].current(), h.sources[j].current())
+}
+func (h *mergeHeap) Swap(i, j int)      { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+func (h *mergeHeap) Push(x interface{}) { h.sources = append(h.sources, x.(mergeSource)) }
+func (h *mergeHeap) Pop() (x interface{}) {
+	x, h.sources = h.sources[len(h.sources)-1], h.sources[:len(h.sources)-1]
+	return x
+}
+
+// Merge the runs and memory, running proc over the requested page in order
+// until it returns false.  Closes the runs.
+func (s *sorter) finish(proc func(offset uint64, doc Document) bool) error {
+	return s.finishRecords(func(rec *sortRecord) bool {
+		return proc(rec.offset, rec.doc)
+	})
+}
+
+// As finish, but passing the whole records.
+func (s *sorter) finishRecords(proc func(rec *sortRecord) bool) error {
+	defer func() {
+		for _, f := range s.runs {
+			f.Close()
+		}
+	}()
+	if s.err != nil {
+		return s.err
+	}
+	if !s.settled {
+		s.sortMem()
+	}
+
+	h := &mergeHeap{s: s}
+	if len(s.mem) != 0 {
+		h.sources = append(h.sources, &memRun{s.mem})
+	}
+	for _, f := range s.runs {
+		rr := &runReader{r: bufio.NewReader(f)}
+		ok, err := rr.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.sources = append(h.sources, rr)
+		}
+	}
+	heap.Init(h)
+
+	for skipped, emitted := 0, 0; h.Len() != 0; {
+		if s.ord.Limit != 0 && emitted == s.ord.Limit {
+			return nil
+		}
+		src := h.sources[0]
+		rec := src.current()
+		if skipped < s.ord.Offset {
+			skipped++
+		} else {
+			emitted++
+			if !proc(rec) {
+				return nil
+			}
+		}
+		ok, err := src.advance()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// As ForEachDocument, but in the given order.  If proc stops early, the rest
+// of the sort is skipped.  The lock is released before proc is called.
+func (db *DocumentBundle) ForEachDocumentOrdered(ord Ordering, proc func(offset uint64, doc Document) bool) error {
+	if err := ord.check(); err != nil {
+		return err
+	}
+	s := newSorter(&ord)
+	db.fillSorter(s, func(now int64) {
+		for pos := db.getFirstDocOffset(); pos != 0 && s.err == nil; {
+			doc := db.doGetDocumentAt(pos)
+			if !doc.expiredAt(now) {
+				s.add(pos, doc)
+			}
+			pos = doc.NextDocOffset
+		}
+	})
+	return s.finish(proc)
+}
+
+// Run scan, which adds documents to s, and settle s, all under the read lock,
+// which is released even if a key function panics.  scan is passed the time
+// documents must not have expired by.
+func (db *DocumentBundle) fillSorter(s *sorter, scan func(now int64)) {
+	db.readLock()
+	defer db.RUnlock()
+	scan(timeNow().UnixNano())
+	s.settle()
+}
+
+// As GetDocuments, but in the given order.
+func (db *DocumentBundle) GetDocumentsOrdered(filter func([]byte) bool, ord Ordering) (docs []Document, err error) {
+	if err := ord.check(); err != nil {
+		return nil, err
+	}
+	s := newSorter(&ord)
+	db.fillSorter(s, func(now int64) {
+		for pos := db.getFirstDocOffset(); pos != 0 && s.err == nil; {
+			doc := db.doGetDocumentAt(pos)
+			if !doc.expiredAt(now) && filter(doc.Payload) {
+				s.add(pos, doc)
+			}
+			pos = doc.NextDocOffset
+		}
+	})
+	err = s.finish(func(offset uint64, doc Document) bool {
+		docs = append(docs, doc)
+		return true
+	})
+	return docs, err
+}
+
+// As GetDocumentsWhere, but in the given order.
+func (db *DocumentBundle) GetDocumentsWhereOrdered(indexName string, lookupKey string, ord Ordering) (docs []Document, err error) {
+	if err := ord.check(); err != nil {
+		return nil, err
+	}
+	s := newSorter(&ord)
+	db.fillSorter(s, func(now int64) {
+		if idx, found := db.indexes[indexName]; found {
+			for _, offset := range idx.get(lookupKey) {
+				if s.err != nil {
+					break
+				}
+				if doc := db.doGetDocumentAt(offset); !doc.expiredAt(now) {
+					s.add(offset, doc)
+				}
+			}
+		}
+	})
+	err = s.finish(func(offset uint64, doc Document) bool {
+		docs = append(docs, doc)
+		return true
+	})
+	return docs, err
+}
@@ -0,0 +1,104 @@
+package clownshoes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOrdering(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	//Keys descend as they're inserted, with duplicates to check stability
+	for i := 0; i < 1000; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf("%04d:%04d:g%d", (999-i)/2, i, i%2))))
+	}
+	db.AddIndex("group", func(payload []byte) string { return strings.Split(string(payload), ":")[2] })
+	byKey := func(payload []byte) []byte { return payload[:4] }
+	seq := func(doc Document) string { return string(doc.Payload[5:9]) }
+
+	for _, budget := range []int{0, 2000} {
+		docs, e := db.GetDocumentsOrdered(func([]byte) bool { return true }, Ordering{Key: byKey, MemoryBudget: budget})
+		if e != nil || len(docs) != 1000 {
+			t.Fatal("Wrong ordered results", len(docs), e)
+		}
+		for i := 1; i < len(docs); i++ {
+			a, b := string(docs[i-1].Payload), string(docs[i].Payload)
+			if a[:4] > b[:4] || a[:4] == b[:4] && a[5:9] > b[5:9] {
+				t.Fatal("Out of order with budget", budget, a, b)
+			}
+		}
+
+		//Pages, descending
+		docs, e = db.GetDocumentsOrdered(func(payload []byte) bool { return payload[0] == '0' },
+			Ordering{Key: byKey, Desc: true, Offset: 3, Limit: 3, MemoryBudget: budget})
+		if e != nil || len(docs) != 3 || seq(docs[0]) != "0003" || seq(docs[1]) != "0004" || seq(docs[2]) != "0005" {
+			t.Error("Wrong page with budget", budget, docs, e)
+		}
+
+		//A comparator over an index lookup
+		docs, e = db.GetDocumentsWhereOrdered("group", "g1", Ordering{Less: func(a, b []byte) bool { return string(a[5:9]) > string(b[5:9]) },
+			Limit: 2, MemoryBudget: budget})
+		if e != nil || len(docs) != 2 || seq(docs[0]) != "0999" || seq(docs[1]) != "0997" {
+			t.Error("Wrong comparator results with budget", budget, docs, e)
+		}
+
+		var offsets []uint64
+		db.ForEachDocumentOrdered(Ordering{Key: byKey, MemoryBudget: budget}, func(offset uint64, doc Document) bool {
+			offsets = append(offsets, offset)
+			return len(offsets) < 5
+		})
+		if len(offsets) != 5 {
+			t.Error("Expected to stop after 5 documents", offsets)
+		} else if doc, _ := db.GetDocumentAt(offsets[0]); string(doc.Payload) != "0000:0998:g0" {
+			t.Error("Wrong first document", string(doc.Payload))
+		}
+	}
+
+	if _, e := db.GetDocumentsOrdered(func([]byte) bool { return true }, Ordering{}); e == nil {
+		t.Error("Expected error without a key or comparator")
+	}
+
+	//A panicking key function doesn't leave the lock held
+	func() {
+		defer func() { recover() }()
+		db.GetDocumentsOrdered(func([]byte) bool { return true }, Ordering{Key: func([]byte) []byte { panic("oops") }})
+	}()
+	if _, e := db.PutDocument(NewDocument([]byte("0000:0000:g0"))); e != nil {
+		t.Error("Problem writing after a panic", e)
+	}
+}
+
+func TestOrderingCopiesResults(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	for _, payload := range []string{"b", "a", "c"} {
+		db.PutDocument(NewDocument([]byte(payload)))
+	}
+	docs, e := db.GetDocumentsOrdered(func([]byte) bool { return true }, Ordering{Key: func(payload []byte) []byte { return payload }})
+	if e != nil || len(docs) != 3 {
+		t.Fatal("Wrong ordered results", docs, e)
+	}
+
+	//Overwriting the documents in place mustn't change what was returned
+	db.ReplaceDocuments(func([]byte) ([]byte, bool) { return []byte("x"), true })
+	for i, want := range []string{"a", "b", "c"} {
+		if string(docs[i].Payload) != want {
+			t.Error("Result changed by a later write", i, string(docs[i].Payload))
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package clownshoes
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ProtoCodec encodes structs in the protocol buffers wire format, without
+// generated code or a schema beyond the struct itself.  Exported fields are
+// numbered by position starting at 1, or by a `clownshoes:"n"` tag; a tag of
+// "-" skips the field.  So long as numbers aren't reused, fields can be added
+// and removed without breaking existing documents, since unknown fields are
+// skipped when decoding.
+//
+// Mapping to the wire format:
+//   bool, uints              varint
+//   ints                     zigzag varint, as sint64
+//   float32, float64         fixed32, fixed64
+//   string, []byte           length-delimited
+//   structs                  length-delimited nested message
+//   slices of numbers        packed; decoding accepts unpacked too
+//   other slices             one field per element
+//   maps                     one nested message per entry, key 1 & value 2
+//   BinaryMarshalers         length-delimited, eg time.Time
+// Zero values are omitted as in proto3, including nil pointers, which decode as
+// nil.  Other pointers are followed and their values always written, so a
+// pointer to a zero value decodes as a pointer to zero.  Decoding a number too
+// large for its field is an error.  Interfaces, arrays, channels & functions
+// aren't supported.
+
+type ProtoCodec[T any] struct{}
+
+func (ProtoCodec[T]) Encode(v T) ([]byte, error) {
+	rv := reflect.ValueOf(&v).Elem()
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return []byte{}, nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, unsupportedType(rv.Type())
+	}
+	return encodeMessage([]byte{}, rv)
+}
+
+func (ProtoCodec[T]) Decode(payload []byte) (v T, err error) {
+	rv := reflect.ValueOf(&v).Elem()
+	if rv.Kind() == reflect.Ptr {
+		rv.Set(reflect.New(rv.Type().Elem()))
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return v, unsupportedType(rv.Type())
+	}
+	return v, decodeMessage(payload, rv)
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	errTruncated          = errors.New("clownshoes: truncated protobuf message")
+)
+
+func unsupportedType(t reflect.Type) error {
+	return fmt.Errorf("clownshoes: ProtoCodec can't encode %v", t)
+}
+
+// Field numbers of a struct type, cached per type.
+type protoMessage struct {
+	fields []protoField
+	byNum  map[uint64]int //Field number to struct field index
+}
+
+type protoField struct {
+	num   uint64
+	index int
+}
+
+var protoMessages sync.Map //reflect.Type to *protoMessage
+
+func messageFor(t reflect.Type) (*protoMessage, error) {
+	if cached, found := protoMessages.Load(t); found {
+		return cached.(*protoMessage), nil
+	}
+	msg := &protoMessage{byNum: make(map[uint64]int)}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("clownshoes")
+		if sf.PkgPath != "" || tag == "-" {
+			continue
+		}
+		num := uint64(i + 1)
+		if tag != "" {
+			n, err := strconv.ParseUint(tag, 10, 29)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("clownshoes: bad field number %q on %v.%s", tag, t, sf.Name)
+			}
+			num = n
+		}
+		if _, taken := msg.byNum[num]; taken {
+			return nil, fmt.Errorf("clownshoes: field number %d used twice in %v", num, t)
+		}
+		msg.byNum[num] = i
+		msg.fields = append(msg.fields, protoField{num, i})
+	}
+	protoMessages.Store(t, msg)
+	return msg, nil
+}
+
+// Wire type of a scalar kind that can be packed, or -1.
+func scalarWire(k reflect.Kind) int {
+	switch k {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return wireVarint
+	case reflect.Float32:
+		return wireFixed32
+	case reflect.Float64:
+		return wireFixed64
+	}
+	return -1
+}
+
+func appendTag(buf []byte, num uint64, wire int) []byte {
+	return binary.AppendUvarint(buf, num<<3|uint64(wire))
+}
+
+func appendBytes(buf []byte, num uint64, data []byte) []byte {
+	buf = appendTag(buf, num, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// Append a scalar's value without a tag.
+func appendScalar(buf []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 1)
+		}
+		return append(buf, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x := v.Int()
+		return binary.AppendUvarint(buf, uint64(x<<1)^uint64(x>>63))
+	case reflect.Float32:
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Float()))
+	}
+	return binary.AppendUvarint(buf, v.Uint())
+}
+
+func encodeMessage(buf []byte, v reflect.Value) ([]byte, error) {
+	msg, err := messageFor(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range msg.fields {
+		if buf, err = encodeField(buf, f.num, v.Field(f.index), true); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// Append field num with the given value.  Zero values are left out if
+// omitZero, but must be written for elements of repeated fields & maps.
+func encodeField(buf []byte, num uint64, v reflect.Value, omitZero bool) ([]byte, error) {
+	if omitZero && v.IsZero() {
+		return buf, nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			//Only possible for elements of repeated fields & maps
+			if v.Type().Elem().Kind() != reflect.Struct {
+				return nil, fmt.Errorf("clownshoes: ProtoCodec can't encode a nil %v in a slice or map", v.Type())
+			}
+			return appendBytes(buf, num, nil), nil
+		}
+		return encodeField(buf, num, v.Elem(), false)
+	}
+	if v.Type().Implements(binaryMarshalerType) {
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(buf, num, data), nil
+	}
+	if wire := scalarWire(v.Kind()); wire != -1 {
+		return appendScalar(appendTag(buf, num, wire), v), nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return appendBytes(buf, num, []byte(v.String())), nil
+	case reflect.Struct:
+		nested, err := encodeMessage(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(buf, num, nested), nil
+	case reflect.Slice:
+		elem := v.Type().Elem()
+		if elem.Kind() == reflect.Uint8 {
+			return appendBytes(buf, num, v.Bytes()), nil
+		}
+		if scalarWire(elem.Kind()) != -1 && !elem.Implements(binaryMarshalerType) {
+			var packed []byte
+			for i := 0; i < v.Len(); i++ {
+				packed = appendScalar(packed, v.Index(i))
+			}
+			return appendBytes(buf, num, packed), nil
+		}
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			if buf, err = encodeField(buf, num, v.Index(i), false); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		keys := v.MapKeys()
+		sortKeys(keys)
+		for _, k := range keys {
+			entry, err := encodeField(nil, 1, k, false)
+			if err != nil {
+				return nil, err
+			}
+			if entry, err = encodeField(entry, 2, v.MapIndex(k), false); err != nil {
+				return nil, err
+			}
+			buf = appendBytes(buf, num, entry)
+		}
+		return buf, nil
+	}
+	return nil, unsupportedType(v.Type())
+}
+
+// Put map keys in order so that encoding is deterministic, where the key type
+// makes that easy.
+func sortKeys(keys []reflect.Value) {
+	if len(keys) == 0 {
+		return
+	}
+	switch keys[0].Kind() {
+	case reflect.String:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Int() < keys[j].Int() })
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Uint() < keys[j].Uint() })
+	}
+}
+
+// Call fn with each field in the message.  For varint & fixed fields x is the
+// value; for length-delimited ones raw is.
+func forEachField(data []byte, fn func(num uint64, wire int, x uint64, raw []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		wire := int(key & 7)
+		var x uint64
+		var raw []byte
+		switch wire {
+		case wireVarint:
+			if x, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			x, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			x, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			raw, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return fmt.Errorf("clownshoes: unknown protobuf wire type %d", wire)
+		}
+		if err := fn(key>>3, wire, x, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeMessage(data []byte, v reflect.Value) error {
+	msg, err := messageFor(v.Type())
+	if err != nil {
+		return err
+	}
+	return forEachField(data, func(num uint64, wire int, x uint64, raw []byte) error {
+		index, found := msg.byNum[num]
+		if !found {
+			//From a newer version of the struct, or a removed field
+			return nil
+		}
+		return decodeField(v.Field(index), wire, x, raw)
+	})
+}
+
+// Set v, which must be addressable, from a field's value.  Repeated fields
+// append to v.
+func decodeField(v reflect.Value, wire int, x uint64, raw []byte) error {
+	mismatch := func() error {
+		return fmt.Errorf("clownshoes: wire type %d can't be decoded into %v", wire, v.Type())
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeField(v.Elem(), wire, x, raw)
+	}
+	if reflect.PtrTo(v.Type()).Implements(binaryUnmarshalerType) {
+		if wire != wireBytes {
+			return mismatch()
+		}
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(raw)
+	}
+	if expected := scalarWire(v.Kind()); expected != -1 {
+		if wire != expected {
+			return mismatch()
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(x != 0)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n := int64(x>>1) ^ -int64(x&1)
+			if v.OverflowInt(n) {
+				return fmt.Errorf("clownshoes: %d overflows %v", n, v.Type())
+			}
+			v.SetInt(n)
+		case reflect.Float32:
+			v.SetFloat(float64(math.Float32frombits(uint32(x))))
+		case reflect.Float64:
+			v.SetFloat(math.Float64frombits(x))
+		default:
+			if v.OverflowUint(x) {
+				return fmt.Errorf("clownshoes: %d overflows %v", x, v.Type())
+			}
+			v.SetUint(x)
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Slice && wire != wireBytes {
+		//An unpacked element of a repeated scalar field
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := decodeField(elem, wire, x, raw); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+		return nil
+	}
+	if wire != wireBytes {
+		return mismatch()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(raw))
+		return nil
+	case reflect.Struct:
+		return decodeMessage(raw, v)
+	case reflect.Slice:
+		elemType := v.Type().Elem()
+		if elemType.Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), raw...))
+			return nil
+		}
+		if elemWire := scalarWire(elemType.Kind()); elemWire != -1 && !elemType.Implements(binaryMarshalerType) {
+			//Packed
+			for len(raw) > 0 {
+				var x uint64
+				switch elemWire {
+				case wireVarint:
+					var n int
+					if x, n = binary.Uvarint(raw); n <= 0 {
+						return errTruncated
+					}
+					raw = raw[n:]
+				case wireFixed64:
+					if len(raw) < 8 {
+						return errTruncated
+					}
+					x, raw = binary.LittleEndian.Uint64(raw), raw[8:]
+				case wireFixed32:
+					if len(raw) < 4 {
+						return errTruncated
+					}
+					x, raw = uint64(binary.LittleEndian.Uint32(raw)), raw[4:]
+				}
+				elem := reflect.New(elemType).Elem()
+				decodeField(elem, elemWire, x, nil)
+				v.Set(reflect.Append(v, elem))
+			}
+			return nil
+		}
+		elem := reflect.New(elemType).Elem()
+		if err := decodeField(elem, wire, x, raw); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+		return nil
+	case reflect.Map:
+		key := reflect.New(v.Type().Key()).Elem()
+		value := reflect.New(v.Type().Elem()).Elem()
+		err := forEachField(raw, func(num uint64, wire int, x uint64, raw []byte) error {
+			switch num {
+			case 1:
+				return decodeField(key, wire, x, raw)
+			case 2:
+				return decodeField(value, wire, x, raw)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(key, value)
+		return nil
+	}
+	return unsupportedType(v.Type())
+}
@@ -0,0 +1,601 @@
+package clownshoes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Queries over JSON documents.  A condition is built from comparisons of
+// fields, named by dotted paths into the document with numeric segments
+// indexing arrays, combined with And, Or & Not.  The planner looks for indexes
+// made by AddFieldIndex on the fields compared: equality uses the key's posting
+// list, ranges walk the index's keys, And intersects the candidates of those
+// children it can answer from indexes and Or unions them if it can answer all
+// of them.  Anything else is a scan.  Candidates are always checked against
+// the whole condition, so indexes only ever narrow the search.  Documents that
+// aren't valid JSON never match.
+
+type Condition interface {
+	String() string
+	matches(doc interface{}) bool
+	check() error //Reports values that couldn't be converted to JSON
+}
+
+type SortField struct {
+	Path string
+	Desc bool
+}
+
+type Query struct {
+	Where  Condition   //Documents to return; nil for all of them
+	Sort   []SortField //Order of the results, by the first field then the next. Documents without the field sort first
+	Offset int         //Number of results to skip, for pagination
+	Limit  int         //Maximum number of results, or 0 for no limit
+}
+
+type eqCond struct {
+	path  string
+	value interface{}
+	key   string //Canonical JSON of value, as stored in field indexes
+	err   error
+}
+
+type rangeCond struct {
+	path  string
+	op    string
+	value interface{}
+	err   error
+}
+
+type andCond []Condition
+type orCond []Condition
+type notCond struct{ c Condition }
+
+// Convert a Go value to the form encoding/json decodes documents into.
+func normalizeJSON(v interface{}) (interface{}, string, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	var out interface{}
+	json.Unmarshal(encoded, &out)
+	//Re-encode so that equal values have equal keys, eg 1 & 1.0
+	encoded, _ = json.Marshal(out)
+	return out, string(encoded), nil
+}
+
+// Matches documents where the field at path equals value.
+func Eq(path string, value interface{}) Condition {
+	normal, key, err := normalizeJSON(value)
+	return &eqCond{path, normal, key, err}
+}
+
+func newRange(path, op string, value interface{}) Condition {
+	normal, _, err := normalizeJSON(value)
+	return &rangeCond{path, op, normal, err}
+}
+
+// Matches documents where the field at path is a number, string or bool
+// greater than value, which must be of the same kind.
+func Gt(path string, value interface{}) Condition { return newRange(path, ">", value) }
+
+// As Gt, for greater than or equal.
+func Gte(path string, value interface{}) Condition { return newRange(path, ">=", value) }
+
+// As Gt, for less than.
+func Lt(path string, value interface{}) Condition { return newRange(path, "<", value) }
+
+// As Gt, for less than or equal.
+func Lte(path string, value interface{}) Condition { return newRange(path, "<=", value) }
+
+// Matches documents where the field at path is between lo and hi inclusive.
+func Between(path string, lo, hi interface{}) Condition {
+	return And(Gte(path, lo), Lte(path, hi))
+}
+
+// Matches documents matching every condition.
+func And(conds ...Condition) Condition { return andCond(conds) }
+
+// Matches documents matching any condition.
+func Or(conds ...Condition) Condition { return orCond(conds) }
+
+// Matches documents not matching the condition.
+func Not(c Condition) Condition { return notCond{c} }
+
+func (c *eqCond) String() string {
+	return fmt.Sprintf("%s == %s", c.path, c.key)
+}
+
+func (c *eqCond) matches(doc interface{}) bool {
+	v, found := lookupPath(doc, c.path)
+	return found && reflect.DeepEqual(v, c.value)
+}
+
+func (c *eqCond) check() error { return c.err }
+
+func (c *rangeCond) String() string {
+	encoded, _ := json.Marshal(c.value)
+	return fmt.Sprintf("%s %s %s", c.path, c.op, encoded)
+}
+
+func (c *rangeCond) matches(doc interface{}) bool {
+	v, found := lookupPath(doc, c.path)
+	return found && c.accepts(v)
+}
+
+// Whether the value satisfies the comparison.
+func (c *rangeCond) accepts(v interface{}) bool {
+	cmp, comparable := compareScalars(v, c.value)
+	if !comparable {
+		return false
+	}
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	}
+	return cmp <= 0
+}
+
+func (c *rangeCond) check() error { return c.err }
+
+func joinConditions(conds []Condition, op string) string {
+	parts := make([]string, len(conds))
+	for i, c := range conds {
+		parts[i] = c.String()
+	}
+	return "(" + strings.Join(parts, " "+op+" ") + ")"
+}
+
+func (c andCond) String() string { return joinConditions(c, "AND") }
+
+func (c andCond) matches(doc interface{}) bool {
+	for _, child := range c {
+		if !child.matches(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c andCond) check() error {
+	for _, child := range c {
+		if err := child.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c orCond) String() string { return joinConditions(c, "OR") }
+
+func (c orCond) matches(doc interface{}) bool {
+	for _, child := range c {
+		if child.matches(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c orCond) check() error { return andCond(c).check() }
+
+func (c notCond) String() string               { return "NOT " + c.c.String() }
+func (c notCond) matches(doc interface{}) bool { return !c.c.matches(doc) }
+func (c notCond) check() error                 { return c.c.check() }
+
+// Return the value at the dotted path within a decoded JSON document.
+func lookupPath(doc interface{}, path string) (interface{}, bool) {
+	cur := doc
+	for _, segment := range strings.Split(path, ".") {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			next, found := node[segment]
+			if !found {
+				return nil, false
+			}
+			cur = next
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			cur = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// Compare two numbers, strings or bools.  The second result is false if they
+// aren't of the same kind.
+func compareScalars(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, true
+			case b:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+// Order of the kinds of JSON value when sorting: missing, null, bools, numbers,
+// strings, then arrays & objects.
+func kindRank(v interface{}, found bool) int {
+	if !found {
+		return 0
+	}
+	switch v.(type) {
+	case nil:
+		return 1
+	case bool:
+		return 2
+	case float64:
+		return 3
+	case string:
+		return 4
+	}
+	return 5
+}
+
+// Total order over JSON values, for sorting.
+func compareValues(a interface{}, aFound bool, b interface{}, bFound bool) int {
+	ra, rb := kindRank(a, aFound), kindRank(b, bFound)
+	if ra != rb {
+		return ra - rb
+	}
+	if cmp, ok := compareScalars(a, b); ok {
+		return cmp
+	}
+	if ra == 5 {
+		ea, _ := json.Marshal(a)
+		eb, _ := json.Marshal(b)
+		return bytes.Compare(ea, eb)
+	}
+	return 0
+}
+
+// Key function for field indexes: the canonical JSON of the field, or "" if
+// the document doesn't have it.
+func fieldKeyFn(path string) func([]byte) string {
+	return func(payload []byte) string {
+		var doc interface{}
+		if json.Unmarshal(payload, &doc) != nil {
+			return ""
+		}
+		v, found := lookupPath(doc, path)
+		if !found {
+			return ""
+		}
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// Create an index on the JSON field at the given dotted path, which queries
+// will use for conditions on that field.
+func (db *DocumentBundle) AddFieldIndex(indexName string, path string) {
+	db.Lock()
+	defer db.Unlock()
+	idx := db.doAddIndex(indexName, fieldKeyFn(path))
+	idx.field = path
+	db.publishIndexAdded(indexName)
+}
+
+// A node of a query plan, producing candidate offsets.
+type planNode struct {
+	op       string //lookup, range, intersect or union
+	index    string
+	cond     Condition
+	children []*planNode
+	estimate int //Upper bound on the number of candidates
+}
+
+// The field index on the given path, choosing by name if there are several.
+func (db *DocumentBundle) fieldIndex(path string) (string, *index) {
+	bestName := ""
+	var best *index
+	for name, idx := range db.indexes {
+		if idx.field == path && (best == nil || name < bestName) {
+			bestName, best = name, idx
+		}
+	}
+	return bestName, best
+}
+
+// Plan how to find candidates for the condition from indexes, or return nil if
+// that's not possible and we'll have to scan.
+func (db *DocumentBundle) planCondition(c Condition) *planNode {
+	switch c := c.(type) {
+	case *eqCond:
+		if name, idx := db.fieldIndex(c.path); idx != nil {
+			return &planNode{op: "lookup", index: name, cond: c, estimate: len(idx.lookup[c.key])}
+		}
+	case *rangeCond:
+		if name, idx := db.fieldIndex(c.path); idx != nil {
+			return &planNode{op: "range", index: name, cond: c, estimate: idx.postings}
+		}
+	case andCond:
+		node := &planNode{op: "intersect"}
+		for _, child := range c {
+			if childPlan := db.planCondition(child); childPlan != nil {
+				node.children = append(node.children, childPlan)
+			}
+		}
+		if len(node.children) == 0 {
+			return nil
+		} else if len(node.children) == 1 {
+			return node.children[0]
+		}
+		//Smallest first, so intersections shrink as fast as possible
+		sort.SliceStable(node.children, func(i, j int) bool {
+			return node.children[i].estimate < node.children[j].estimate
+		})
+		node.estimate = node.children[0].estimate
+		return node
+	case orCond:
+		node := &planNode{op: "union"}
+		for _, child := range c {
+			childPlan := db.planCondition(child)
+			if childPlan == nil {
+				return nil
+			}
+			node.children = append(node.children, childPlan)
+			node.estimate += childPlan.estimate
+		}
+		if len(node.children) == 0 {
+			return nil
+		}
+		return node
+	}
+	return nil
+}
+
+// Return the offsets the plan produces, in ascending order.
+func (db *DocumentBundle) doCandidates(node *planNode) []uint64 {
+	var out []uint64
+	switch node.op {
+	case "lookup":
+		out = append(out, db.indexes[node.index].lookup[node.cond.(*eqCond).key]...)
+	case "range":
+		cond := node.cond.(*rangeCond)
+		for key, offsets := range db.indexes[node.index].lookup {
+			var v interface{}
+			if key != "" && json.Unmarshal([]byte(key), &v) == nil && cond.accepts(v) {
+				out = append(out, offsets...)
+			}
+		}
+	case "intersect":
+		out = db.doCandidates(node.children[0])
+		for _, child := range node.children[1:] {
+			if len(out) == 0 {
+				break
+			}
+			out = intersectSorted(out, db.doCandidates(child))
+		}
+		return out
+	case "union":
+		for _, child := range node.children {
+			out = append(out, db.doCandidates(child)...)
+		}
+		sortOffsets(out)
+		return dedupeSorted(out)
+	}
+	sortOffsets(out)
+	return out
+}
+
+func sortOffsets(offsets []uint64) {
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+}
+
+func intersectSorted(a, b []uint64) []uint64 {
+	out := a[:0]
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func dedupeSorted(offsets []uint64) []uint64 {
+	out := offsets[:0]
+	for i, offset := range offsets {
+		if i == 0 || offset != offsets[i-1] {
+			out = append(out, offset)
+		}
+	}
+	return out
+}
+
+// Run proc over every live document matching the condition, with its decoded
+// form, until it returns false.  Uses indexes where the planner can.  Assumes
+// the lock is held.
+func (db *DocumentBundle) doMatch(where Condition, proc func(offset uint64, doc Document, value interface{}) bool) {
+	now := timeNow().UnixNano()
+	visit := func(offset uint64, doc Document) bool {
+		if doc.expiredAt(now) {
+			return true
+		}
+		var value interface{}
+		if json.Unmarshal(doc.Payload, &value) != nil {
+			return true
+		}
+		if where != nil && !where.matches(value) {
+			return true
+		}
+		return proc(offset, doc, value)
+	}
+
+	var plan *planNode
+	if where != nil {
+		plan = db.planCondition(where)
+	}
+	if plan != nil {
+		for _, offset := range db.doCandidates(plan) {
+			if !visit(offset, db.doGetDocumentAt(offset)) {
+				return
+			}
+		}
+		return
+	}
+	for pos := db.getFirstDocOffset(); pos != 0; {
+		doc := db.doGetDocumentAt(pos)
+		if !visit(pos, doc) {
+			return
+		}
+		pos = doc.NextDocOffset
+	}
+}
+
+func (q *Query) check() error {
+	if q.Offset < 0 || q.Limit < 0 {
+		return errors.New("clownshoes: negative offset or limit")
+	}
+	if q.Where != nil {
+		return q.Where.check()
+	}
+	return nil
+}
+
+// Return the documents matching the query.  Without a sort they come in order
+// of offset if indexes were used, and list order if not.
+func (db *DocumentBundle) Query(q Query) ([]Document, error) {
+	if err := q.check(); err != nil {
+		return nil, err
+	}
+	db.readLock()
+	defer db.RUnlock()
+
+	type match struct {
+		doc    Document
+		values []interface{}
+		found  []bool
+	}
+	var matches []match
+	db.doMatch(q.Where, func(offset uint64, doc Document, value interface{}) bool {
+		m := match{doc: doc}
+		for _, field := range q.Sort {
+			v, found := lookupPath(value, field.Path)
+			m.values = append(m.values, v)
+			m.found = append(m.found, found)
+		}
+		matches = append(matches, m)
+		//Without sorting, the first documents found are as good as any
+		return len(q.Sort) != 0 || q.Limit == 0 || len(matches) < q.Offset+q.Limit
+	})
+
+	if len(q.Sort) != 0 {
+		sort.SliceStable(matches, func(i, j int) bool {
+			for k, field := range q.Sort {
+				cmp := compareValues(matches[i].values[k], matches[i].found[k], matches[j].values[k], matches[j].found[k])
+				if field.Desc {
+					cmp = -cmp
+				}
+				if cmp != 0 {
+					return cmp < 0
+				}
+			}
+			return false
+		})
+	}
+	if q.Offset >= len(matches) {
+		return nil, nil
+	}
+	matches = matches[q.Offset:]
+	if q.Limit != 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+	docs := make([]Document, len(matches))
+	for i, m := range matches {
+		docs[i] = m.doc
+	}
+	return docs, nil
+}
+
+// Describe how the query would be run, one step per line.
+func (db *DocumentBundle) Explain(q Query) string {
+	db.readLock()
+	defer db.RUnlock()
+	var out strings.Builder
+	var plan *planNode
+	if q.Where != nil {
+		plan = db.planCondition(q.Where)
+	}
+	if plan == nil {
+		fmt.Fprintf(&out, "scan (%d documents)\n", db.getDocCount())
+	} else {
+		explainNode(&out, plan, 0)
+	}
+	if q.Where != nil {
+		fmt.Fprintf(&out, "filter %s\n", q.Where)
+	}
+	if len(q.Sort) != 0 {
+		fields := make([]string, len(q.Sort))
+		for i, field := range q.Sort {
+			fields[i] = field.Path
+			if field.Desc {
+				fields[i] += " desc"
+			}
+		}
+		fmt.Fprintf(&out, "sort %s\n", strings.Join(fields, ", "))
+	}
+	if q.Offset != 0 {
+		fmt.Fprintf(&out, "offset %d\n", q.Offset)
+	}
+	if q.Limit != 0 {
+		fmt.Fprintf(&out, "limit %d\n", q.Limit)
+	}
+	return out.String()
+}
+
+func explainNode(out *strings.Builder, node *planNode, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch node.op {
+	case "lookup", "range":
+		fmt.Fprintf(out, "%s%s %q %s (~%d)\n", indent, node.op, node.index, node.cond, node.estimate)
+	default:
+		fmt.Fprintf(out, "%s%s (~%d)\n", indent, node.op, node.estimate)
+		for _, child := range node.children {
+			explainNode(out, child, depth+1)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package clownshoes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	for i := 0; i < 100; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf(`{"name":"user%d","age":%d,"address":{"city":"c%d"},"tags":["t%d"]}`, i, i%50, i%3, i%2))))
+	}
+	db.PutDocument(NewDocument([]byte("not json")))
+	db.PutDocument(NewDocument([]byte(`{"name":"ageless"}`)))
+
+	names := func(docs []Document) string {
+		var out []string
+		for _, doc := range docs {
+			out = append(out, strings.Trim(fieldKeyFn("name")(doc.Payload), `"`))
+		}
+		return strings.Join(out, ",")
+	}
+	queries := []Query{
+		{Where: Eq("address.city", "c1"), Limit: 3},
+		{Where: And(Gte("age", 10), Lt("age", 12), Eq("tags.0", "t1"))},
+		{Where: Or(Eq("age", 3), Eq("name", "user4"))},
+		{Where: Not(Gt("age", 1)), Sort: []SortField{{"age", true}, {"name", false}}},
+		{Where: Between("age", 48, 100), Sort: []SortField{{"name", false}}, Limit: 2},
+		{Where: Not(Gt("age", 1)), Sort: []SortField{{"age", true}, {"name", false}}, Offset: 1, Limit: 2},
+		{Where: Eq("address.city", "c1"), Offset: 1, Limit: 2},
+	}
+	expected := []string{
+		"user1,user4,user7",
+		"user11,user61",
+		"user3,user4,user53",
+		"user1,user51,user0,user50,ageless",
+		"user48,user49",
+		"user51,user0",
+		"user4,user7",
+	}
+
+	check := func(stage string) {
+		for i, q := range queries {
+			docs, e := db.Query(q)
+			if e != nil {
+				t.Error(stage, "query failed", q.Where, e)
+			}
+			if got := names(docs); got != expected[i] {
+				t.Errorf("%s: %s gave %s, expected %s", stage, q.Where, got, expected[i])
+			}
+		}
+	}
+	check("scan")
+	if plan := db.Explain(queries[1]); !strings.HasPrefix(plan, "scan") {
+		t.Error("Expected a scan:\n" + plan)
+	}
+
+	db.AddFieldIndex("by-age", "age")
+	db.AddFieldIndex("by-city", "address.city")
+	db.AddFieldIndex("by-name", "name")
+	check("indexed")
+
+	plan := db.Explain(queries[1])
+	if !strings.HasPrefix(plan, "intersect") || !strings.Contains(plan, `range "by-age" age >= 10`) || !strings.Contains(plan, "filter") {
+		t.Error("Expected an intersection of ranges:\n" + plan)
+	}
+	if plan := db.Explain(queries[2]); !strings.HasPrefix(plan, "union") || !strings.Contains(plan, `lookup "by-name" name == "user4" (~1)`) {
+		t.Error("Expected a union of lookups:\n" + plan)
+	}
+	if plan := db.Explain(queries[3]); !strings.HasPrefix(plan, "scan") || !strings.Contains(plan, "sort age desc, name") {
+		t.Error("Expected a sorted scan:\n" + plan)
+	}
+
+	//Indexes survive compaction with their fields
+	db.RemoveDocuments(func(b []byte) bool { return string(b) == "not json" })
+	db.Compact()
+	check("compacted")
+	if plan := db.Explain(queries[0]); !strings.HasPrefix(plan, `lookup "by-city"`) {
+		t.Error("Field index lost in compaction:\n" + plan)
+	}
+
+	if _, e := db.Query(Query{Where: Eq("name", make(chan int))}); e == nil {
+		t.Error("Unencodable value accepted")
+	}
+	if _, e := db.Query(Query{Offset: -1}); e == nil {
+		t.Error("Expected error for a negative offset")
+	}
+	if _, e := db.Query(Query{Limit: -1}); e == nil {
+		t.Error("Expected error for a negative limit")
+	}
+}
@@ -0,0 +1,650 @@
+package clownshoes
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Primary/follower replication by shipping the change feed over TCP.  A
+// follower opens a connection and says which primary it last followed and the
+// last event it applied.  If the primary still retains the events after that it
+// sends them; otherwise it sends a snapshot of the file followed by every event
+// since.  Either way the stream then continues with live events, interspersed
+// with heartbeats which the follower acknowledges.
+//
+// Every allocation happens at the shared tail of the file, so applying the same
+// operations in the same order puts documents at the same offsets, and offsets
+// in the stream can be used as-is.  Followers check this as they go and start
+// over from a snapshot if they ever disagree.  Followers are read-only until
+// promoted, and never reap expired documents themselves; the primary's reaping
+// arrives as removals.
+
+type replKind int
+
+const (
+	replHello     replKind = iota //Follower to primary: Run & Seq of the last event applied
+	replSnapshot                  //Start of a snapshot: Run, Seq, Size & Indexes
+	replChunk                     //The next Data of the snapshot
+	replEvent                     //An Event to apply, and its Index if it added one
+	replHeartbeat                 //Seq is the primary's latest sequence number
+	replAck                       //Follower to primary: Seq is the last event applied
+)
+
+type replMessage struct {
+	Kind    replKind
+	Run     string                          //Identifies the Primary the sequence numbers belong to
+	Seq     uint64                          //Meaning depends on Kind
+	Size    uint64                          //Length of the snapshot
+	Data    []byte                          //Part of the snapshot
+	Event   ChangeEvent                     //Change to apply
+	Index   *indexMeta                      //Definition of the index added by an OpAddIndex Event
+	Indexes map[string]map[string]indexMeta //Definitions of the indexes on each collection at the time of the snapshot
+}
+
+const snapshotChunkSize = 1 << 20
+
+var ErrDiverged = errors.New("clownshoes: follower has diverged from the primary")
+
+// Serves the changes to a DocumentBundle to followers.
+type Primary struct {
+	DB                *DocumentBundle
+	HeartbeatInterval time.Duration //How often to tell followers the latest sequence number. Defaults to 1s
+	BufferSize        int           //Events queued for a follower before it's disconnected to catch up later. Defaults to 10000
+	run               string
+	mu                sync.Mutex
+	listeners         map[net.Listener]struct{}
+	followers         map[*followerConn]struct{}
+}
+
+type followerConn struct {
+	conn  net.Conn
+	acked uint64
+}
+
+// The state of a connected follower, as seen by the primary.
+type FollowerInfo struct {
+	Addr     string //Remote address of the follower
+	AckedSeq uint64 //Last event the follower reported applying
+	Lag      uint64 //Number of events the follower is behind by
+}
+
+// Return a Primary for the given DB, retaining the last history events so that
+// followers can reconnect without a fresh snapshot.
+func NewPrimary(db *DocumentBundle, history int) *Primary {
+	db.SetChangeHistory(history)
+	runID := make([]byte, 8)
+	rand.Read(runID)
+	return &Primary{
+		DB:        db,
+		run:       hex.EncodeToString(runID),
+		listeners: make(map[net.Listener]struct{}),
+		followers: make(map[*followerConn]struct{}),
+	}
+}
+
+// Listen on the given TCP address and serve followers until Close is called.
+func (p *Primary) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(l)
+}
+
+// Serve followers connecting to the given listener until Close is called.
+func (p *Primary) Serve(l net.Listener) error {
+	p.mu.Lock()
+	p.listeners[l] = struct{}{}
+	p.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.mu.Lock()
+			_, open := p.listeners[l]
+			p.mu.Unlock()
+			if !open {
+				return nil
+			}
+			return err
+		}
+		go p.serveFollower(conn)
+	}
+}
+
+// Stop listening and disconnect all followers.
+func (p *Primary) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	for l := range p.listeners {
+		delete(p.listeners, l)
+		if e := l.Close(); e != nil {
+			err = e
+		}
+	}
+	for f := range p.followers {
+		f.conn.Close()
+	}
+	return err
+}
+
+// Return the state of each connected follower.
+func (p *Primary) Followers() []FollowerInfo {
+	latest := p.DB.LastChangeSeq()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []FollowerInfo
+	for f := range p.followers {
+		info := FollowerInfo{Addr: f.conn.RemoteAddr().String(), AckedSeq: f.acked}
+		if latest > f.acked {
+			info.Lag = latest - f.acked
+		}
+		out = append(out, info)
+	}
+	return out
+}
+
+func (p *Primary) serveFollower(conn net.Conn) {
+	defer conn.Close()
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	var hello replMessage
+	if err := dec.Decode(&hello); err != nil || hello.Kind != replHello {
+		return
+	}
+
+	bufSize := p.BufferSize
+	if bufSize <= 0 {
+		bufSize = 10000
+	}
+	opts := WatchOptions{BufferSize: bufSize, Policy: CloseSubscription, AllCollections: true}
+	var sub *Subscription
+	if hello.Run == p.run && hello.Seq > 0 && hello.Seq <= p.DB.LastChangeSeq() {
+		opts.Since = hello.Seq
+		//Fall back to a snapshot if the history is gone
+		sub, _ = p.DB.WatchWithOptions(nil, opts)
+	}
+	if sub == nil {
+		var err error
+		if sub, err = p.sendSnapshot(enc, opts); err != nil {
+			return
+		}
+	}
+	defer sub.Close()
+
+	f := &followerConn{conn: conn}
+	p.mu.Lock()
+	p.followers[f] = struct{}{}
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.followers, f)
+		p.mu.Unlock()
+	}()
+
+	//Read acks until the connection fails, then end the subscription so the
+	//writer notices
+	go func() {
+		defer sub.Close()
+		for {
+			var msg replMessage
+			if err := dec.Decode(&msg); err != nil {
+				return
+			}
+			if msg.Kind == replAck {
+				p.mu.Lock()
+				f.acked = msg.Seq
+				p.mu.Unlock()
+			}
+		}
+	}()
+
+	interval := p.HeartbeatInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var msg replMessage
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				//Overflowed or disconnected.  The follower reconnects & resumes
+				return
+			}
+			msg = replMessage{Kind: replEvent, Event: ev, Index: ev.indexMeta}
+		case <-ticker.C:
+			msg = replMessage{Kind: replHeartbeat, Seq: p.DB.LastChangeSeq()}
+		}
+		if err := enc.Encode(msg); err != nil {
+			return
+		}
+	}
+}
+
+// Send a snapshot of the file, returning a subscription to every change made
+// after it was taken.  The file is copied to a temporary file under the read
+// lock so that writers aren't held up by the network.
+func (p *Primary) sendSnapshot(enc *gob.Encoder, opts WatchOptions) (*Subscription, error) {
+	tmp, err := ioutil.TempFile("", "clownshoes-snapshot")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	db := p.DB
+	db.RLock()
+	root := db.root
+	sub, _ := db.WatchWithOptions(nil, opts)
+	seq := db.LastChangeSeq()
+	size := root.getTail()
+	_, err = tmp.Write(root.AsBytes[:size])
+	indexes := make(map[string]map[string]indexMeta)
+	for _, coll := range root.openedCollections() {
+		indexes[coll.name] = make(map[string]indexMeta)
+		for idxName, idx := range coll.indexes {
+			indexes[coll.name][idxName] = idx.meta()
+		}
+	}
+	db.RUnlock()
+	if err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	err = enc.Encode(replMessage{Kind: replSnapshot, Run: p.run, Seq: seq, Size: size, Indexes: indexes})
+	if _, seekErr := tmp.Seek(0, 0); err == nil {
+		err = seekErr
+	}
+	buf := make([]byte, snapshotChunkSize)
+	for err == nil {
+		var n int
+		n, err = tmp.Read(buf)
+		if n > 0 {
+			if encErr := enc.Encode(replMessage{Kind: replChunk, Data: buf[:n]}); encErr != nil {
+				err = encErr
+			}
+		}
+	}
+	if err != io.EOF {
+		sub.Close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Maintains a read-only copy of a primary's DB.
+type Follower struct {
+	DB            *DocumentBundle                //The copy.  Collection handles obtained before a snapshot is installed must not be used afterwards
+	IndexKeyFns   map[string]func([]byte) string //Key functions for indexes added on the primary, by index name, wrapped by OrderedKeyFn, GeoKeyFn or VectorKeyFn for those kinds. Indexes without one aren't replicated
+	IndexFilters  map[string]func([]byte) bool   //Filters for indexes that are partial on the primary, by index name. Partial indexes without one aren't replicated
+	RetryInterval time.Duration                  //How long to wait before reconnecting. Defaults to 1s
+	mu            sync.Mutex
+	run           string
+	applied       uint64
+	primarySeq    uint64
+	lastContact   time.Time
+	err           error
+	conn          net.Conn
+	promoted      bool
+	running       chan struct{}
+}
+
+// Return a Follower maintaining the given DB, which becomes read-only.  Its
+// contents are replaced by a snapshot on first connecting, so it must not have
+// been opened with Options.ReadOnly.
+func NewFollower(db *DocumentBundle, indexKeyFns map[string]func([]byte) string) *Follower {
+	db.Lock()
+	db.root.readOnly = true
+	db.Unlock()
+	return &Follower{DB: db, IndexKeyFns: indexKeyFns}
+}
+
+// Follow the primary at the given address, reconnecting whenever the connection
+// fails, until the follower is promoted.
+func (f *Follower) Run(addr string) error {
+	f.mu.Lock()
+	if f.running != nil {
+		f.mu.Unlock()
+		return errors.New("clownshoes: follower is already running")
+	}
+	if f.DB.root.options.ReadOnly {
+		f.mu.Unlock()
+		return ErrReadOnly
+	}
+	done := make(chan struct{})
+	f.running = done
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.running = nil
+		f.mu.Unlock()
+		close(done)
+	}()
+
+	retry := f.RetryInterval
+	if retry <= 0 {
+		retry = time.Second
+	}
+	for {
+		err := f.session(addr)
+		f.mu.Lock()
+		promoted := f.promoted
+		if !promoted {
+			f.err = err
+		}
+		f.mu.Unlock()
+		if promoted {
+			return nil
+		}
+		time.Sleep(retry)
+	}
+}
+
+// Stop following and allow writes.  Waits for any event being applied to
+// finish.  The DB can then be served to other followers with NewPrimary.
+func (f *Follower) Promote() {
+	f.mu.Lock()
+	f.promoted = true
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	done := f.running
+	f.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	f.DB.Lock()
+	f.DB.root.readOnly = false
+	f.DB.Unlock()
+}
+
+// Sequence number, on the primary, of the last event applied.
+func (f *Follower) AppliedSeq() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.applied
+}
+
+// Number of events the primary had made, as of the last contact, that haven't
+// been applied yet.
+func (f *Follower) Lag() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.primarySeq > f.applied {
+		return f.primarySeq - f.applied
+	}
+	return 0
+}
+
+// When a message was last received from the primary.
+func (f *Follower) LastContact() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastContact
+}
+
+// The error that ended the last connection to the primary, if any.
+func (f *Follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Connect to the primary and apply what it sends until something goes wrong.
+func (f *Follower) session(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	f.mu.Lock()
+	if f.promoted {
+		f.mu.Unlock()
+		return nil
+	}
+	f.conn = conn
+	hello := replMessage{Kind: replHello, Run: f.run, Seq: f.applied}
+	f.mu.Unlock()
+
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	if err := enc.Encode(hello); err != nil {
+		return err
+	}
+
+	var snapshot replMessage
+	var snapFile *os.File
+	var received uint64
+	defer func() {
+		if snapFile != nil {
+			snapFile.Close()
+			os.Remove(snapFile.Name())
+		}
+	}()
+	for {
+		var msg replMessage
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		f.mu.Lock()
+		f.lastContact = timeNow()
+		f.mu.Unlock()
+
+		switch msg.Kind {
+		case replSnapshot:
+			if snapFile, err = ioutil.TempFile("", "clownshoes-snapshot"); err != nil {
+				return err
+			}
+			snapshot = msg
+		case replChunk:
+			if snapFile == nil {
+				return errors.New("clownshoes: snapshot data without a snapshot")
+			}
+			if _, err := snapFile.Write(msg.Data); err != nil {
+				return err
+			}
+			if received += uint64(len(msg.Data)); received == snapshot.Size {
+				if err := f.installSnapshot(snapshot, snapFile); err != nil {
+					return err
+				}
+			}
+		case replEvent:
+			msg.Event.indexMeta = msg.Index
+			if err := f.applyEvent(msg.Event); err != nil {
+				//Start over from a snapshot next time
+				f.mu.Lock()
+				f.run, f.applied = "", 0
+				f.mu.Unlock()
+				return err
+			}
+		case replHeartbeat:
+			f.mu.Lock()
+			if msg.Seq > f.primarySeq {
+				f.primarySeq = msg.Seq
+			}
+			ack := replMessage{Kind: replAck, Seq: f.applied}
+			f.mu.Unlock()
+			if err := enc.Encode(ack); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Replace the DB's contents with the snapshot in the given file.
+func (f *Follower) installSnapshot(snapshot replMessage, snapFile *os.File) error {
+	db := f.DB
+	db.Lock()
+	defer db.Unlock()
+	root := db.root
+
+	//Keep indexes added locally, and use their key functions if the primary
+	//has indexes of the same name
+	localIndexes := make(map[string]map[string]*index)
+	for _, coll := range root.openedCollections() {
+		localIndexes[coll.name] = make(map[string]*index)
+		for idxName, idx := range coll.indexes {
+			localIndexes[coll.name][idxName] = idx
+		}
+		//Background builds & on-disk postings can't survive the handles going
+		//stale
+		coll.builds = nil
+		coll.releaseIndexes()
+	}
+
+	if uint64(len(root.AsBytes)) <= snapshot.Size {
+		if err := root.doReMmap(snapshot.Size + 1000000000); err != nil {
+			return err
+		}
+	}
+	if _, err := snapFile.ReadAt(root.AsBytes[:snapshot.Size], 0); err != nil {
+		return err
+	}
+	//The primary's journal means nothing to tail readers of this file
+	root.journal(journalReset, 0)
+
+	//Every collection handle & offset is now stale
+	root.indexes = make(map[string]*index, 0)
+	root.expiry = expiryTracker{}
+	root.collections = make(map[string]*DocumentBundle)
+	for name, metas := range snapshot.Indexes {
+		if localIndexes[name] == nil {
+			localIndexes[name] = make(map[string]*index)
+		}
+		for idxName, m := range metas {
+			keyFn, found := f.IndexKeyFns[idxName]
+			if !found {
+				continue
+			}
+			if like := m.like(keyFn, f.IndexFilters[idxName]); like != nil {
+				localIndexes[name][idxName] = like
+			} else {
+				delete(localIndexes[name], idxName)
+			}
+		}
+	}
+	for name, idxs := range localIndexes {
+		coll := root
+		if name != "" {
+			var err error
+			if coll, err = root.doCreateCollection(name); err != nil {
+				continue
+			}
+		}
+		for idxName, like := range idxs {
+			coll.doAddIndexLike(idxName, like)
+		}
+	}
+	root.publishChange(ChangeEvent{Op: OpCompact})
+
+	f.mu.Lock()
+	f.run, f.applied = snapshot.Run, snapshot.Seq
+	if snapshot.Seq > f.primarySeq {
+		f.primarySeq = snapshot.Seq
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+// Apply a change from the primary, checking it lands where it did there.
+func (f *Follower) applyEvent(ev ChangeEvent) error {
+	f.mu.Lock()
+	expected := f.applied + 1
+	f.mu.Unlock()
+	if ev.Seq != expected {
+		return fmt.Errorf("clownshoes: expected change %d from primary, got %d", expected, ev.Seq)
+	}
+
+	db := f.DB
+	db.Lock()
+	err := f.doApplyEvent(ev)
+	db.Unlock()
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.applied = ev.Seq
+	if ev.Seq > f.primarySeq {
+		f.primarySeq = ev.Seq
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *Follower) doApplyEvent(ev ChangeEvent) error {
+	root := f.DB.root
+	if ev.Op == OpDropCollection {
+		if err := root.doDropCollection(ev.Collection); err != ErrNoSuchCollection {
+			return err
+		}
+		//Never had anything in it
+		return nil
+	}
+	coll := root
+	if ev.Collection != "" {
+		var err error
+		if coll, err = root.doCreateCollection(ev.Collection); err != nil {
+			return err
+		}
+	}
+
+	switch ev.Op {
+	case OpPut:
+		doc := Document{Payload: ev.Payload, Expires: ev.Expires}
+		doc.Size = uint32(doc.byteSize())
+		if coll.doAppendDocument(doc) != ev.NewOffset {
+			return ErrDiverged
+		}
+	case OpReplace:
+		//We share the primary's offsets, so this only has to catch divergence
+		if !coll.doIsLinkedAt(ev.OldOffset) {
+			return ErrDiverged
+		}
+		curDoc := coll.doGetDocumentAt(ev.OldOffset)
+		newDoc := Document{Payload: ev.Payload, Expires: ev.Expires}
+		if _, newOffset := coll.doRewriteDocument(ev.OldOffset, curDoc, newDoc); newOffset != ev.NewOffset {
+			return ErrDiverged
+		}
+	case OpRemove:
+		if !coll.doIsLinkedAt(ev.OldOffset) {
+			return ErrDiverged
+		}
+		coll.doUnlinkDocumentAt(ev.OldOffset)
+	case OpCompact:
+		//The primary reports a compaction once per collection, but one compacts
+		//them all
+		if ev.Collection == "" {
+			return root.doCompact()
+		}
+		return nil
+	case OpAddIndex:
+		keyFn, found := f.IndexKeyFns[ev.Index]
+		if !found || ev.indexMeta == nil {
+			return nil
+		}
+		if like := ev.indexMeta.like(keyFn, f.IndexFilters[ev.Index]); like != nil {
+			coll.doAddIndexLike(ev.Index, like)
+		} else {
+			//An index we can't maintain would give different answers from the
+			//primary's, so drop any older one of the same name
+			coll.doRemoveIndex(ev.Index)
+		}
+	case OpRemoveIndex:
+		coll.doRemoveIndex(ev.Index)
+	}
+	coll.publishChange(ev)
+	return nil
+}
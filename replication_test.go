@@ -0,0 +1,172 @@
+package clownshoes
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	f1, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f1.Close()
+	db := NewDB(f1.Name())
+	defer os.Remove(f1.Name())
+	f2, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f2.Close()
+	copyDB := NewDB(f2.Name())
+	defer os.Remove(f2.Name())
+
+	identity := func(b []byte) string { return string(b) }
+	users := db.Collection("users")
+	users.AddIndex("identity", identity)
+	for i := 0; i < 50; i++ {
+		db.PutDocument(NewDocument([]byte("before")))
+		users.PutDocument(NewDocument([]byte("user")))
+	}
+	length := func(b []byte) []interface{} { return []interface{}{int64(len(b))} }
+	db.AddOrderedIndex("length", length)
+	short := func(b []byte) bool { return len(b) < 6 }
+	db.AddPartialIndex("short", identity, short)
+	vectorFn := func(b []byte) []float32 { return []float32{float32(len(b))} }
+
+	primary := NewPrimary(db, 1000)
+	primary.HeartbeatInterval = 10 * time.Millisecond
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	go primary.Serve(l)
+	defer primary.Close()
+
+	//The follower has no filter for "short", so can't maintain it
+	follower := NewFollower(copyDB, map[string]func([]byte) string{
+		"identity": identity, "length": OrderedKeyFn(length), "short": identity, "vector": VectorKeyFn(vectorFn),
+	})
+	follower.RetryInterval = 10 * time.Millisecond
+	go follower.Run(l.Addr().String())
+	caughtUp := func() bool { return follower.AppliedSeq() == db.LastChangeSeq() && follower.Lag() == 0 }
+	waitFor(t, "snapshot", caughtUp)
+
+	if _, e := copyDB.PutDocument(NewDocument([]byte("nope"))); e != ErrReadOnly {
+		t.Error("Follower accepted a write", e)
+	}
+	if len(copyDB.Collection("users").GetDocumentsWhere("identity", "user")) != 50 {
+		t.Error("Index not rebuilt from snapshot")
+	}
+	inRange := 0
+	e = copyDB.ForEachDocumentInRange("length", KeyRange{Lo: []interface{}{int64(6)}, Hi: []interface{}{int64(6)}}, func(offset uint64, doc Document) bool {
+		inRange++
+		return true
+	})
+	if e != nil || inRange != 50 {
+		t.Error("Ordered index not replicated from snapshot", e, inRange)
+	}
+	if state, _ := copyDB.IndexStatus("short"); state != IndexAbsent {
+		t.Error("Partial index built without its filter")
+	}
+
+	//Live changes of every kind
+	for i := 0; i < 50; i++ {
+		db.PutDocument(NewDocument([]byte("after")))
+	}
+	db.PutDocument(NewExpiringDocument([]byte("temporary"), time.Now().Add(time.Hour)))
+	users.ReplaceDocuments(func(b []byte) ([]byte, bool) { return []byte("a longer user"), true })
+	db.RemoveDocuments(func(b []byte) bool { return string(b) == "before" })
+	sessions := db.Collection("sessions")
+	sessions.PutDocument(NewDocument([]byte("session")))
+	sessions.AddIndex("identity", identity)
+	db.DropCollection("sessions")
+	db.Compact()
+	db.PutDocument(NewDocument([]byte("last")))
+	db.AddVectorIndex("vector", vectorFn, VectorIndexOptions{Dimensions: 1, HNSW: true})
+	db.AddPartialIndex("short", identity, short)
+	waitFor(t, "live changes", caughtUp)
+	if matches, e := copyDB.NearestNeighbors("vector", []float32{5}, 1, MetricEuclidean); e != nil || len(matches) != 1 || string(matches[0].Doc.Payload) != "after" {
+		t.Error("Vector index not replicated", e, matches)
+	}
+	if state, _ := copyDB.IndexStatus("short"); state != IndexAbsent {
+		t.Error("Partial index added without its filter")
+	}
+
+	//Removing an index on the primary releases the follower's copy
+	if e := copyDB.AddCompactIndex("compact", identity, CompactIndexOptions{}); e != nil {
+		t.Fatal("Couldn't add compact index to follower", e)
+	}
+	compact := copyDB.indexes["compact"].compact
+	db.RemoveIndex("compact")
+	waitFor(t, "index removal", caughtUp)
+	copyDB.RLock()
+	if _, found := copyDB.indexes["compact"]; found || compact.table != nil {
+		t.Error("Removed index left on follower")
+	}
+	copyDB.RUnlock()
+
+	sameData := func() bool {
+		db.RLock()
+		defer db.RUnlock()
+		copyDB.RLock()
+		defer copyDB.RUnlock()
+		return bytes.Equal(db.AsBytes[dataStart:db.getTail()], copyDB.AsBytes[dataStart:copyDB.getTail()])
+	}
+	if !sameData() {
+		t.Error("Follower's documents differ from the primary's")
+	}
+	if len(copyDB.Collection("users").GetDocumentsWhere("identity", "a longer user")) != 50 {
+		t.Error("Index not maintained on follower")
+	}
+	for _, name := range copyDB.CollectionNames() {
+		if name == "sessions" {
+			t.Error("Dropped collection still on follower")
+		}
+	}
+	if copyDB.GetDocuments(func(b []byte) bool { return string(b) == "temporary" })[0].Expires == 0 {
+		t.Error("Expiry not replicated")
+	}
+	waitFor(t, "acknowledgement", func() bool {
+		infos := primary.Followers()
+		return len(infos) == 1 && infos[0].AckedSeq == db.LastChangeSeq() && infos[0].Lag == 0
+	})
+
+	//Dropping the connection resumes from history rather than a new snapshot
+	sub := copyDB.Watch(func(ev ChangeEvent) bool { return ev.Op == OpCompact })
+	primary.mu.Lock()
+	for fc := range primary.followers {
+		fc.conn.Close()
+	}
+	primary.mu.Unlock()
+	db.PutDocument(NewDocument([]byte("while disconnected")))
+	waitFor(t, "resumption", caughtUp)
+	select {
+	case <-sub.C:
+		t.Error("Follower reinstalled a snapshot to resume")
+	default:
+	}
+	sub.Close()
+	if !sameData() {
+		t.Error("Follower's documents differ after resuming")
+	}
+
+	follower.Promote()
+	if _, e := copyDB.PutDocument(NewDocument([]byte("promoted"))); e != nil {
+		t.Error("Promoted follower rejected a write", e)
+	}
+}
@@ -0,0 +1,122 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Just enough RESP2 to talk to redis-cli & client libraries: requests are arrays
+// of bulk strings, or inline commands separated by spaces.
+
+var errProtocol = errors.New("protocol error")
+
+// Limits on what a client may send, so a short request can't make us allocate
+// much more than it actually delivers.
+const (
+	maxArgs    = 64 * 1024
+	maxBulkLen = 64 << 20
+	maxLineLen = 64 * 1024
+)
+
+// Read one command, returning its arguments.
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		//Inline command
+		var args [][]byte
+		for _, field := range strings.Fields(line) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, errProtocol
+	}
+	var args [][]byte
+	for i := 0; i < n; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, errProtocol
+		}
+		//The buffer grows as the bytes arrive rather than trusting the size
+		var arg bytes.Buffer
+		if _, err = io.CopyN(&arg, r, int64(size)); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		//Trailing CRLF
+		var crlf [2]byte
+		if _, err = io.ReadFull(r, crlf[:]); err != nil {
+			return nil, err
+		}
+		args = append(args, arg.Bytes())
+	}
+	return args, nil
+}
+
+// Read a line of at most maxLineLen bytes.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineLen {
+			return "", errProtocol
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		} else if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func (w writer) error(s string) {
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
+
+func (w writer) integer(n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func (w writer) bulk(b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w writer) arrayHeader(n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
@@ -0,0 +1,368 @@
+// Package resp serves a collection of a DocumentBundle over the Redis protocol,
+// as a string key-value store.
+//
+// Supported commands are PING, ECHO, GET, SET (with EX, PX, NX & XX), DEL,
+// EXISTS, SCAN (with MATCH & COUNT), DBSIZE, COMMAND and QUIT.  Clownshoes has no
+// transactions, so MULTI & EXEC are refused.
+//
+// Each key-value pair is one document, consisting of the key's length as a
+// little endian uint32, the key, then the value.  They're looked up through an
+// index on the key, and SET with an expiry uses document expiry.
+package resp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bnyeggen/clownshoes"
+)
+
+// Name of the index on keys, which the server adds to its collection
+const KeyIndex = "resp-key"
+
+type Server struct {
+	DB *clownshoes.DocumentBundle //The collection holding the key-value pairs
+
+	writeLock sync.Mutex //Makes check-then-modify sequences like SET NX atomic
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+// Return a server storing its data in the given collection, adding the key
+// index if necessary.
+func New(db *clownshoes.DocumentBundle) *Server {
+	if !db.HasIndexNamed(KeyIndex) {
+		db.AddIndex(KeyIndex, func(payload []byte) string {
+			key, _, _ := decodeEntry(payload)
+			return string(key)
+		})
+	}
+	return &Server{DB: db, listeners: make(map[net.Listener]struct{}), conns: make(map[net.Conn]struct{})}
+}
+
+func encodeEntry(key, value []byte) []byte {
+	out := make([]byte, 4+len(key)+len(value))
+	binary.LittleEndian.PutUint32(out, uint32(len(key)))
+	copy(out[4:], key)
+	copy(out[4+len(key):], value)
+	return out
+}
+
+func decodeEntry(payload []byte) (key, value []byte, ok bool) {
+	if len(payload) < 4 {
+		return nil, nil, false
+	}
+	keyLen := binary.LittleEndian.Uint32(payload)
+	if uint64(keyLen) > uint64(len(payload)-4) {
+		return nil, nil, false
+	}
+	return payload[4 : 4+keyLen], payload[4+keyLen:], true
+}
+
+// Listen on the given TCP address and serve connections until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve connections from the listener until it fails or Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// Stop listening and close all connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	w := writer{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err == errProtocol {
+			w.error("ERR protocol error")
+			w.Flush()
+			return
+		} else if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !s.dispatch(args, w) {
+			w.Flush()
+			return
+		}
+		//Pipelined commands get their replies together
+		if r.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// Run a command, writing the reply.  Returns false if the connection should
+// be closed.
+func (s *Server) dispatch(args [][]byte, w writer) bool {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "ECHO":
+		if len(args) != 1 {
+			w.error("ERR wrong number of arguments for 'echo' command")
+		} else {
+			w.bulk(args[0])
+		}
+	case "QUIT":
+		w.simple("OK")
+		return false
+	case "COMMAND":
+		//Clients ask for command docs on connect; an empty reply is fine
+		w.arrayHeader(0)
+	case "GET":
+		s.get(args, w)
+	case "SET":
+		s.set(args, w)
+	case "DEL":
+		s.del(args, w)
+	case "EXISTS":
+		s.exists(args, w)
+	case "SCAN":
+		s.scan(args, w)
+	case "DBSIZE":
+		w.integer(int64(s.DB.Count()))
+	case "MULTI", "EXEC", "DISCARD", "WATCH":
+		w.error("ERR transactions are not supported")
+	default:
+		w.error("ERR unknown command '" + strings.ToLower(name) + "'")
+	}
+	return true
+}
+
+// Return the value for the key, or nil if it's absent
+func (s *Server) lookup(key []byte) []byte {
+	var value []byte
+	s.DB.ForEachDocumentWhere(KeyIndex, string(key), func(offset uint64, doc clownshoes.Document) bool {
+		_, v, _ := decodeEntry(doc.Payload)
+		value = append([]byte{}, v...)
+		return false
+	})
+	return value
+}
+
+func (s *Server) get(args [][]byte, w writer) {
+	if len(args) != 1 {
+		w.error("ERR wrong number of arguments for 'get' command")
+		return
+	}
+	w.bulk(s.lookup(args[0]))
+}
+
+func (s *Server) set(args [][]byte, w writer) {
+	if len(args) < 2 {
+		w.error("ERR wrong number of arguments for 'set' command")
+		return
+	}
+	key, value := args[0], args[1]
+	var expires time.Time
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(args) {
+				w.error("ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if strings.ToUpper(string(args[i])) == "PX" {
+				unit = time.Millisecond
+			}
+			expires = time.Now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	exists := s.lookup(key) != nil
+	if (nx && exists) || (xx && !exists) {
+		w.bulk(nil)
+		return
+	}
+	doc := clownshoes.NewDocument(encodeEntry(key, value))
+	if !expires.IsZero() {
+		doc = clownshoes.NewExpiringDocument(doc.Payload, expires)
+	}
+	//Replaces the old expiry too, and leaves the old value if it fails
+	if _, err := s.DB.SetDocumentWhere(KeyIndex, string(key), doc); err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+func (s *Server) del(args [][]byte, w writer) {
+	if len(args) == 0 {
+		w.error("ERR wrong number of arguments for 'del' command")
+		return
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	var removed int64
+	for _, key := range args {
+		//Expired documents can still be removed, but don't count as present
+		present := s.lookup(key) != nil
+		if _, err := s.DB.RemoveDocumentsWhere(KeyIndex, string(key), func([]byte) bool { return true }); err != nil {
+			w.error("ERR " + err.Error())
+			return
+		}
+		if present {
+			removed++
+		}
+	}
+	w.integer(removed)
+}
+
+func (s *Server) exists(args [][]byte, w writer) {
+	if len(args) == 0 {
+		w.error("ERR wrong number of arguments for 'exists' command")
+		return
+	}
+	var found int64
+	for _, key := range args {
+		if s.lookup(key) != nil {
+			found++
+		}
+	}
+	w.integer(found)
+}
+
+// The cursor is the offset to resume from.  Documents are stored in ascending
+// order of offset, so this visits every key present throughout the scan, unless
+// the DB is compacted in the meantime.  Each page starts at the cursor's
+// document, unless it has been removed since, when the page walks from the
+// start.
+func (s *Server) scan(args [][]byte, w writer) {
+	if len(args) < 1 {
+		w.error("ERR wrong number of arguments for 'scan' command")
+		return
+	}
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		w.error("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				w.error("ERR syntax error")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+	if len(args)%2 == 0 {
+		w.error("ERR syntax error")
+		return
+	}
+
+	var keys [][]byte
+	next := uint64(0)
+	visited := 0
+	proc := func(offset uint64, doc clownshoes.Document) bool {
+		if offset < cursor {
+			return true
+		}
+		if visited == count {
+			next = offset
+			return false
+		}
+		visited++
+		key, _, ok := decodeEntry(doc.Payload)
+		if ok {
+			if matched, _ := path.Match(pattern, string(key)); matched {
+				keys = append(keys, append([]byte(nil), key...))
+			}
+		}
+		return true
+	}
+	//Resume from the cursor's document, or if that's gone, skip everything
+	//before it
+	if cursor == 0 || s.DB.ForEachDocumentFrom(cursor, proc) != nil {
+		s.DB.ForEachDocument(proc)
+	}
+
+	w.arrayHeader(2)
+	w.bulk([]byte(strconv.FormatUint(next, 10)))
+	w.arrayHeader(len(keys))
+	for _, key := range keys {
+		w.bulk(key)
+	}
+}
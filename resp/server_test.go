@@ -0,0 +1,217 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bnyeggen/clownshoes"
+)
+
+// A minimal RESP client
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *client) do(args ...string) (interface{}, error) {
+	fmt.Fprintf(c.conn, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.conn, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return c.reply()
+}
+
+type respError string
+
+func (c *client) reply() (interface{}, error) {
+	line, err := readLine(c.r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		var n int64
+		fmt.Sscan(line[1:], &n)
+		return n, nil
+	case '$':
+		var n int
+		fmt.Sscan(line[1:], &n)
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		var n int
+		fmt.Sscan(line[1:], &n)
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, errProtocol
+}
+
+func TestRESP(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesRESPTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db := clownshoes.NewDB(f.Name())
+
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal("Problem listening", e)
+	}
+	s := New(db.Collection("redis"))
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, e := net.Dial("tcp", l.Addr().String())
+	if e != nil {
+		t.Fatal("Problem connecting", e)
+	}
+	c := &client{conn, bufio.NewReader(conn)}
+
+	expect := func(want interface{}, args ...string) {
+		got, err := c.do(args...)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %#v, %v, wanted %#v", args, got, err, want)
+		}
+	}
+	expect("PONG", "PING")
+	expect("OK", "SET", "greeting", "hello")
+	expect("hello", "GET", "greeting")
+	expect("OK", "SET", "greeting", "hi there")
+	expect("hi there", "GET", "greeting")
+	expect(nil, "GET", "missing")
+	expect(nil, "SET", "greeting", "ignored", "NX")
+	expect(nil, "SET", "other", "ignored", "XX")
+	expect("OK", "SET", "other", "value", "NX")
+	expect("OK", "SET", "binary\x00key", "\r\nvalue\r\n")
+	expect("\r\nvalue\r\n", "GET", "binary\x00key")
+	expect(int64(3), "DBSIZE")
+	expect(int64(2), "EXISTS", "greeting", "other", "missing")
+	expect(int64(1), "DEL", "other", "missing")
+	expect(int64(0), "EXISTS", "other")
+
+	//Expiry
+	expect("OK", "SET", "ephemeral", "value", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	expect(nil, "GET", "ephemeral")
+	expect(int64(0), "EXISTS", "ephemeral")
+	expect("OK", "SET", "lasting", "value", "EX", "100")
+	expect("OK", "SET", "lasting", "forever")
+	if docs := s.DB.GetDocumentsWhere(KeyIndex, "lasting"); len(docs) != 1 || docs[0].Expires != 0 {
+		t.Error("SET didn't clear the old expiry", docs)
+	}
+
+	//A rejected SET keeps the old value
+	s.DB.AddHooks(clownshoes.Hooks{BeforeReplace: func(uint64, []byte, []byte) ([]byte, error) {
+		return nil, errors.New("no")
+	}})
+	expect(respError("ERR no"), "SET", "greeting", "rejected")
+	expect("hi there", "GET", "greeting")
+	s.DB.ClearHooks()
+
+	//Scan the whole keyspace in small steps
+	for i := 0; i < 25; i++ {
+		c.do("SET", fmt.Sprintf("key:%d", i), "x")
+	}
+	cursor := "0"
+	seen := make(map[string]bool)
+	for page := 0; ; page++ {
+		//Removing the cursor's document doesn't lose the keys after it
+		if page == 1 {
+			offset, _ := strconv.ParseUint(cursor, 10, 64)
+			doc, _ := s.DB.GetDocumentAt(offset)
+			key, _, _ := decodeEntry(doc.Payload)
+			c.do("DEL", string(key))
+			c.do("SET", string(key), "x")
+		}
+		reply, err := c.do("SCAN", cursor, "MATCH", "key:*", "COUNT", "7")
+		if err != nil {
+			t.Fatal("Scan failed", err)
+		}
+		parts := reply.([]interface{})
+		for _, key := range parts[1].([]interface{}) {
+			seen[key.(string)] = true
+		}
+		cursor = parts[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 25 {
+		t.Error("Scan missed keys", len(seen))
+	}
+
+	expect(respError("ERR transactions are not supported"), "MULTI")
+	expect(respError("ERR unknown command 'bogus'"), "BOGUS")
+	expect(respError("ERR wrong number of arguments for 'get' command"), "GET")
+
+	//Inline commands & pipelining
+	fmt.Fprintf(conn, "PING\r\nECHO inline\r\n")
+	if got, _ := c.reply(); got != "PONG" {
+		t.Error("Wrong reply to inline PING", got)
+	}
+	if got, _ := c.reply(); got != "inline" {
+		t.Error("Wrong reply to inline ECHO", got)
+	}
+	expect("OK", "QUIT")
+
+	//Data lives in the collection, & the index survives a restart of the server
+	s2 := New(db.Collection("redis"))
+	if value := s2.lookup([]byte("greeting")); string(value) != "hi there" {
+		t.Error("Data not visible to new server", string(value))
+	}
+	if len(db.Collection("redis").GetIndexNames()) != 1 {
+		t.Error("Key index added twice")
+	}
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	read := func(in string) ([][]byte, error) {
+		return readCommand(bufio.NewReader(strings.NewReader(in)))
+	}
+	args, err := read("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n")
+	if err != nil || !reflect.DeepEqual(args, [][]byte{[]byte("GET"), []byte("k")}) {
+		t.Errorf("Got %q, %v", args, err)
+	}
+	for _, in := range []string{
+		"*" + strconv.Itoa(maxArgs+1) + "\r\n",
+		"*1\r\n$" + strconv.Itoa(maxBulkLen+1) + "\r\n",
+		strings.Repeat("x", maxLineLen+1) + "\r\n",
+		"*1\r\n$" + strings.Repeat("1", maxLineLen) + "\r\n",
+	} {
+		if _, err := read(in); err != errProtocol {
+			t.Errorf("Expected a protocol error for %.20q..., got %v", in, err)
+		}
+	}
+	//A claimed size isn't allocated up front, and a short body is an error
+	if _, err := read("*1\r\n$" + strconv.Itoa(maxBulkLen) + "\r\nabc"); err != io.ErrUnexpectedEOF {
+		t.Error("Expected a short bulk string to fail, got", err)
+	}
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A small predicate language for filtered scans.
+//
+//	expr  := and ("or" and)*
+//	and   := unary ("and" unary)*
+//	unary := "not" unary | "(" expr ")" | test
+//	test  := ("contains" | "prefix" | "suffix" | "equals") string
+//	       | path ("==" | "!=" | "<" | "<=" | ">" | ">=") literal
+//	       | path "exists"
+//
+// Strings are double quoted with Go escapes.  Paths start with a dot and pick
+// out a field of a JSON object payload, like .user.name.  Literals are JSON
+// numbers, strings, true, false or null; ordering comparisons only hold
+// between two numbers or two strings.  For example
+//
+//	.age >= 18 and not (.name == "bob" or contains "deleted")
+
+type token struct {
+	text   string
+	quoted bool //Was a string literal, so text is the unquoted value
+}
+
+func tokenize(expr string) ([]token, error) {
+	var out []token
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(' || c == ')':
+			out = append(out, token{expr[i : i+1], false})
+			i++
+		case c == '"':
+			//Find the closing quote, skipping escaped characters
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s, err := strconv.Unquote(expr[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string at %d: %v", i, err)
+			}
+			out = append(out, token{s, true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(expr) && !unicode.IsSpace(rune(expr[j])) && expr[j] != '(' && expr[j] != ')' && expr[j] != '"' {
+				j++
+			}
+			out = append(out, token{expr[i:j], false})
+			i = j
+		}
+	}
+	return out, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) next() (token, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	return t, nil
+}
+
+// Whether the next token is the given unquoted keyword, consuming it if so
+func (p *parser) accept(keyword string) bool {
+	t, ok := p.peek()
+	if ok && !t.quoted && t.text == keyword {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// Parse a predicate expression into a function of a payload.  The empty
+// expression matches everything.
+func ParsePredicate(expr string) (func([]byte) bool, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return func([]byte) bool { return true }, nil
+	}
+	p := &parser{tokens: tokens}
+	pred, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	return pred, nil
+}
+
+func (p *parser) parseOr() (func([]byte) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(b []byte) bool { return l(b) || right(b) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (func([]byte) bool, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(b []byte) bool { return l(b) && right(b) }
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (func([]byte) bool, error) {
+	if p.accept("not") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(b []byte) bool { return !inner(b) }, nil
+	}
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	}
+	return p.parseTest()
+}
+
+func (p *parser) parseTest() (func([]byte) bool, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.quoted {
+		return nil, fmt.Errorf("unexpected string %q", t.text)
+	}
+
+	if strings.HasPrefix(t.text, ".") {
+		path := strings.Split(t.text[1:], ".")
+		op, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if !op.quoted && op.text == "exists" {
+			return func(b []byte) bool {
+				_, found := lookupPath(b, path)
+				return found
+			}, nil
+		}
+		lit, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		var want interface{}
+		if lit.quoted {
+			want = lit.text
+		} else if err = json.Unmarshal([]byte(lit.text), &want); err != nil {
+			return nil, fmt.Errorf("bad literal %q", lit.text)
+		}
+		//Arrays & objects can't be compared, and aren't in the grammar
+		switch want.(type) {
+		case []interface{}, map[string]interface{}:
+			return nil, fmt.Errorf("bad literal %q", lit.text)
+		}
+		cmp, err := comparison(op.text)
+		if err != nil {
+			return nil, err
+		}
+		return func(b []byte) bool {
+			got, found := lookupPath(b, path)
+			return found && cmp(got, want)
+		}, nil
+	}
+
+	arg, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if !arg.quoted {
+		return nil, fmt.Errorf("%s needs a quoted string", t.text)
+	}
+	s := []byte(arg.text)
+	switch t.text {
+	case "contains":
+		return func(b []byte) bool { return bytes.Contains(b, s) }, nil
+	case "prefix":
+		return func(b []byte) bool { return bytes.HasPrefix(b, s) }, nil
+	case "suffix":
+		return func(b []byte) bool { return bytes.HasSuffix(b, s) }, nil
+	case "equals":
+		return func(b []byte) bool { return bytes.Equal(b, s) }, nil
+	}
+	return nil, fmt.Errorf("unknown test %q", t.text)
+}
+
+// Return the value at the given path in a JSON object payload
+func lookupPath(payload []byte, path []string) (interface{}, bool) {
+	var cur interface{}
+	if json.Unmarshal(payload, &cur) != nil {
+		return nil, false
+	}
+	for _, field := range path {
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = obj[field]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func comparison(op string) (func(got, want interface{}) bool, error) {
+	//-2 when the values aren't comparable
+	order := func(got, want interface{}) int {
+		switch w := want.(type) {
+		case float64:
+			if g, ok := got.(float64); ok {
+				if g < w {
+					return -1
+				} else if g > w {
+					return 1
+				}
+				return 0
+			}
+		case string:
+			if g, ok := got.(string); ok {
+				return strings.Compare(g, w)
+			}
+		}
+		return -2
+	}
+	equal := func(got, want interface{}) bool {
+		if o := order(got, want); o != -2 {
+			return o == 0
+		}
+		//Bools & nulls
+		return got == want
+	}
+	switch op {
+	case "==":
+		return equal, nil
+	case "!=":
+		return func(got, want interface{}) bool { return !equal(got, want) }, nil
+	case "<":
+		return func(got, want interface{}) bool { return order(got, want) == -1 }, nil
+	case "<=":
+		return func(got, want interface{}) bool { o := order(got, want); return o == -1 || o == 0 }, nil
+	case ">":
+		return func(got, want interface{}) bool { return order(got, want) == 1 }, nil
+	case ">=":
+		return func(got, want interface{}) bool { o := order(got, want); return o == 0 || o == 1 }, nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", op)
+}
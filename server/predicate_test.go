@@ -0,0 +1,46 @@
+package server
+
+import "testing"
+
+func TestPredicates(t *testing.T) {
+	doc := []byte(`{"name": "alice", "age": 30, "admin": true, "address": {"city": "Oslo"}, "tags": [1]}`)
+	cases := map[string]bool{
+		``:                                  true,
+		`contains "alice"`:                  true,
+		`prefix "{\"name\""`:                true,
+		`suffix "}"`:                        true,
+		`equals "alice"`:                    false,
+		`.name == "alice"`:                  true,
+		`.name != "alice"`:                  false,
+		`.age >= 30 and .age < 31`:          true,
+		`.age > 30`:                         false,
+		`.age > "30"`:                       false,
+		`.admin == true`:                    true,
+		`.address.city == "Oslo"`:           true,
+		`.address.zip exists`:               false,
+		`not .address.zip exists`:           true,
+		`.name == "bob" or contains "Oslo"`: true,
+		`not (.name == "bob" or contains "Oslo")`:          false,
+		`.name == "bob" or .age == 30 and .admin == false`: false,
+	}
+	for expr, want := range cases {
+		pred, err := ParsePredicate(expr)
+		if err != nil {
+			t.Error("Failed to parse", expr, err)
+			continue
+		}
+		if pred(doc) != want {
+			t.Error("Wrong result for", expr)
+		}
+	}
+
+	if pred, _ := ParsePredicate(`.name exists`); pred([]byte("not json")) {
+		t.Error("Path matched non-JSON payload")
+	}
+
+	for _, bad := range []string{`contains`, `contains alice`, `.age ~ 3`, `(.age == 3`, `"alice"`, `contains "unterminated`, `.age == 3 )`, `.tags == [1]`, `.address != {}`} {
+		if _, err := ParsePredicate(bad); err == nil {
+			t.Error("Parsed invalid expression", bad)
+		}
+	}
+}
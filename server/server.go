@@ -0,0 +1,272 @@
+// Package server exposes a DocumentBundle over HTTP.
+//
+// Endpoints, all of which take an optional collection parameter naming the
+// collection to use.  Only inserts create collections; otherwise one that
+// doesn't exist is not found.  Documents have no IDs besides their offsets, so
+// to fetch documents by an ID of your own, index it and use the index lookup.
+//
+//	POST   /documents               insert the request body, of at most
+//	                                MaxBodyBytes, optionally with a ttl parameter
+//	                                such as 30m.  Responds {"Offset": n}
+//	GET    /documents/{offset}      the payload at the given offset
+//	DELETE /documents/{offset}      remove the document at the given offset
+//	GET    /documents?q=expr        documents matching a predicate (see
+//	                                ParsePredicate), optionally with a limit
+//	GET    /indexes/{name}/{key}    documents with the given key in an index
+//	POST   /compact                 compact the file
+//	POST   /backup?name=n           CopyDB into the configured backup directory
+//
+// Listings are streamed as JSON lines of the form {"Offset": n, "Payload":
+// base64}.  Every request is subject to the server's timeout; a listing that
+// runs out of time is cut off mid-stream, and writes to a client too slow to
+// keep up fail at the deadline, so no request holds the DB's lock past it.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bnyeggen/clownshoes"
+)
+
+// Default limit on the size of an inserted document
+const DefaultMaxBodyBytes = 64 << 20
+
+type Server struct {
+	DB           *clownshoes.DocumentBundle
+	Timeout      time.Duration //Per-request limit, 0 for none
+	BackupDir    string        //Where backups are written.  Backups are refused if empty
+	MaxBodyBytes int64         //Largest request body accepted, DefaultMaxBodyBytes if 0
+}
+
+// Return a server for the given DB with the given per-request timeout.
+func New(db *clownshoes.DocumentBundle, timeout time.Duration) *Server {
+	return &Server{DB: db, Timeout: timeout}
+}
+
+type listedDocument struct {
+	Offset  uint64
+	Payload []byte
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if s.Timeout > 0 {
+		deadline := time.Now().Add(s.Timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+		//Listings write while holding the read lock, so a client that stops
+		//reading mustn't be able to block them past the deadline.  The
+		//deadline is the connection's, so lift it for the next request
+		rc := http.NewResponseController(w)
+		if rc.SetWriteDeadline(deadline) == nil {
+			defer rc.SetWriteDeadline(time.Time{})
+		}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	db := s.DB
+	if name := r.URL.Query().Get("collection"); name != "" {
+		var err error
+		if parts[0] == "documents" && len(parts) == 1 && r.Method == "POST" {
+			db, err = db.CreateCollection(name)
+		} else {
+			db, err = db.OpenCollection(name)
+		}
+		if err == clownshoes.ErrNoSuchCollection {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err == clownshoes.ErrReadOnly {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case parts[0] == "documents" && len(parts) == 1 && r.Method == "POST":
+		s.put(w, r, db)
+	case parts[0] == "documents" && len(parts) == 1 && r.Method == "GET":
+		s.scan(ctx, w, r, db)
+	case parts[0] == "documents" && len(parts) == 2 && r.Method == "GET":
+		s.get(w, parts[1], db)
+	case parts[0] == "documents" && len(parts) == 2 && r.Method == "DELETE":
+		s.remove(w, parts[1], db)
+	case parts[0] == "indexes" && len(parts) == 3 && r.Method == "GET":
+		s.lookup(ctx, w, r, db, parts[1], parts[2])
+	case parts[0] == "compact" && len(parts) == 1 && r.Method == "POST":
+		if err := db.Compact(); err != nil {
+			http.Error(w, err.Error(), mutationStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] == "backup" && len(parts) == 1 && r.Method == "POST":
+		s.backup(w, r, db)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, db *clownshoes.DocumentBundle) {
+	limit := s.MaxBodyBytes
+	if limit == 0 {
+		limit = DefaultMaxBodyBytes
+	}
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	doc := clownshoes.NewDocument(payload)
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		doc = clownshoes.NewExpiringDocument(payload, time.Now().Add(d))
+	}
+	offset, err := db.PutDocument(doc)
+	if err != nil {
+		http.Error(w, err.Error(), mutationStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct{ Offset uint64 }{offset})
+}
+
+// Status code for a failed mutation: forbidden on a read-only DB, otherwise
+// the error came from a hook rejecting it.
+func mutationStatus(err error) int {
+	if err == clownshoes.ErrReadOnly {
+		return http.StatusForbidden
+	}
+	return http.StatusUnprocessableEntity
+}
+
+func parseOffset(w http.ResponseWriter, s string) (uint64, bool) {
+	offset, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		http.Error(w, "bad offset", http.StatusBadRequest)
+		return 0, false
+	}
+	return offset, true
+}
+
+func (s *Server) get(w http.ResponseWriter, offsetStr string, db *clownshoes.DocumentBundle) {
+	offset, ok := parseOffset(w, offsetStr)
+	if !ok {
+		return
+	}
+	doc, err := db.GetDocumentAt(offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(doc.Payload)
+}
+
+func (s *Server) remove(w http.ResponseWriter, offsetStr string, db *clownshoes.DocumentBundle) {
+	offset, ok := parseOffset(w, offsetStr)
+	if !ok {
+		return
+	}
+	err := db.RemoveDocumentAt(offset)
+	if err == clownshoes.ErrNoDocument {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), mutationStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stream the documents produced by iterate as JSON lines, stopping at the limit
+// parameter or the deadline.
+func (s *Server) list(ctx context.Context, w http.ResponseWriter, r *http.Request, iterate func(func(uint64, clownshoes.Document) bool)) {
+	limit := -1
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	iterate(func(offset uint64, doc clownshoes.Document) bool {
+		if count == limit || ctx.Err() != nil {
+			return false
+		}
+		if enc.Encode(listedDocument{offset, doc.Payload}) != nil {
+			//Client went away
+			return false
+		}
+		count++
+		if flusher != nil && count%100 == 0 {
+			flusher.Flush()
+		}
+		return true
+	})
+}
+
+func (s *Server) scan(ctx context.Context, w http.ResponseWriter, r *http.Request, db *clownshoes.DocumentBundle) {
+	pred, err := ParsePredicate(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.list(ctx, w, r, func(proc func(uint64, clownshoes.Document) bool) {
+		db.ForEachDocument(func(offset uint64, doc clownshoes.Document) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			return !pred(doc.Payload) || proc(offset, doc)
+		})
+	})
+}
+
+func (s *Server) lookup(ctx context.Context, w http.ResponseWriter, r *http.Request, db *clownshoes.DocumentBundle, indexName, key string) {
+	if !db.HasIndexNamed(indexName) {
+		http.Error(w, "no such index", http.StatusNotFound)
+		return
+	}
+	s.list(ctx, w, r, func(proc func(uint64, clownshoes.Document) bool) {
+		db.ForEachDocumentWhere(indexName, key, proc)
+	})
+}
+
+func (s *Server) backup(w http.ResponseWriter, r *http.Request, db *clownshoes.DocumentBundle) {
+	name := r.URL.Query().Get("name")
+	if s.BackupDir == "" {
+		http.Error(w, "backups not configured", http.StatusForbidden)
+		return
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		http.Error(w, "bad backup name", http.StatusBadRequest)
+		return
+	}
+	dest := filepath.Join(s.BackupDir, name)
+	if err := db.CopyDB(dest, dest+".indexes"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bnyeggen/clownshoes"
+)
+
+func TestServer(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesServerTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db := clownshoes.NewDB(f.Name())
+	db.AddIndex("first", func(b []byte) string { return string(b[:1]) })
+
+	backupDir, _ := ioutil.TempDir("", "ClownshoesServerBackups")
+	defer os.RemoveAll(backupDir)
+	s := New(db, time.Minute)
+	s.BackupDir = backupDir
+	s.MaxBodyBytes = 16
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Request failed", err)
+		}
+		return resp
+	}
+	listing := func(path string) (docs []listedDocument) {
+		resp := do("GET", path, "")
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var doc listedDocument
+			json.Unmarshal(scanner.Bytes(), &doc)
+			docs = append(docs, doc)
+		}
+		return docs
+	}
+
+	var offsets []uint64
+	for _, payload := range []string{`{"n": 1}`, `{"n": 2}`, `[3]`} {
+		resp := do("POST", "/documents", payload)
+		var created struct{ Offset uint64 }
+		json.NewDecoder(resp.Body).Decode(&created)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Error("Put failed", resp.Status)
+		}
+		offsets = append(offsets, created.Offset)
+	}
+	do("POST", "/documents?collection=other", `{"n": 4}`).Body.Close()
+	if resp := do("POST", "/documents", `{"n": "too long"}`); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Oversized document accepted", resp.Status)
+	}
+
+	resp := do("GET", "/documents/"+strconv.FormatUint(offsets[1], 10), "")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `{"n": 2}` {
+		t.Error("Wrong document", string(body))
+	}
+	if resp = do("GET", "/documents/1", ""); resp.StatusCode != http.StatusNotFound {
+		t.Error("Got document at bad offset", resp.Status)
+	}
+
+	if docs := listing("/documents?q=" + url.QueryEscape(".n >= 2")); len(docs) != 1 || docs[0].Offset != offsets[1] {
+		t.Error("Wrong scan results", docs)
+	}
+	if docs := listing("/documents?limit=2"); len(docs) != 2 {
+		t.Error("Limit not applied", docs)
+	}
+	if docs := listing("/documents?collection=other"); len(docs) != 1 || string(docs[0].Payload) != `{"n": 4}` {
+		t.Error("Wrong collection scanned", docs)
+	}
+	//Reads don't create collections
+	for _, path := range []string{"/documents?collection=nope", "/documents/1?collection=nope", "/indexes/first/x?collection=nope"} {
+		if resp = do("GET", path, ""); resp.StatusCode != http.StatusNotFound {
+			t.Error("Read from missing collection", path, resp.Status)
+		}
+	}
+	if resp = do("DELETE", "/documents/1?collection=nope", ""); resp.StatusCode != http.StatusNotFound {
+		t.Error("Delete from missing collection", resp.Status)
+	}
+	if names := db.CollectionNames(); len(names) != 1 || names[0] != "other" {
+		t.Error("Reads created collections", names)
+	}
+	if resp = do("GET", "/documents?q=bogus", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Bad predicate accepted", resp.Status)
+	}
+	if resp = do("GET", "/documents?q="+url.QueryEscape(".n == [1]"), ""); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Array literal accepted", resp.Status)
+	}
+	if docs := listing("/indexes/first/" + url.PathEscape("{")); len(docs) != 2 {
+		t.Error("Wrong indexed lookup results", docs)
+	}
+	if resp = do("GET", "/indexes/missing/x", ""); resp.StatusCode != http.StatusNotFound {
+		t.Error("Lookup in missing index succeeded", resp.Status)
+	}
+
+	if resp = do("DELETE", "/documents/"+strconv.FormatUint(offsets[0], 10), ""); resp.StatusCode != http.StatusNoContent {
+		t.Error("Delete failed", resp.Status)
+	}
+	if resp = do("DELETE", "/documents/"+strconv.FormatUint(offsets[0], 10), ""); resp.StatusCode != http.StatusNotFound {
+		t.Error("Deleted twice", resp.Status)
+	}
+	if resp = do("POST", "/compact", ""); resp.StatusCode != http.StatusNoContent {
+		t.Error("Compact failed", resp.Status)
+	}
+	if docs := listing("/documents"); len(docs) != 2 {
+		t.Error("Wrong documents after delete & compact", docs)
+	}
+
+	if resp = do("POST", "/backup?name=../escape", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Backup outside directory accepted", resp.Status)
+	}
+	if resp = do("POST", "/backup?name=snapshot", ""); resp.StatusCode != http.StatusNoContent {
+		t.Error("Backup failed", resp.Status)
+	}
+	backup := clownshoes.NewDB(filepath.Join(backupDir, "snapshot"))
+	if backup.Count() != 2 {
+		t.Error("Wrong backup contents", backup.Count())
+	}
+}
+
+func TestServerTimeout(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesServerTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db := clownshoes.NewDB(f.Name())
+	for i := 0; i < 1000; i++ {
+		db.PutDocument(clownshoes.NewDocument([]byte("document")))
+	}
+
+	s := New(db, time.Minute)
+	req := httptest.NewRequest("GET", "/documents", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if strings.Count(rec.Body.String(), "\n") != 1000 {
+		t.Error("Fast scan cut short", strings.Count(rec.Body.String(), "\n"))
+	}
+
+	s.Timeout = time.Nanosecond
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if strings.Count(rec.Body.String(), "\n") == 1000 {
+		t.Error("Scan not cut off by timeout")
+	}
+}
+
+func TestServerSlowClient(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesServerTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db := clownshoes.NewDB(f.Name())
+	payload := []byte(strings.Repeat("x", 10000))
+	for i := 0; i < 3000; i++ {
+		db.PutDocument(clownshoes.NewDocument(payload))
+	}
+	ts := httptest.NewServer(New(db, 200*time.Millisecond))
+	defer ts.Close()
+
+	//Start a listing far larger than the socket buffers, and never read it
+	conn, e := net.Dial("tcp", ts.Listener.Addr().String())
+	if e != nil {
+		t.Fatal("Problem connecting", e)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /documents HTTP/1.1\r\nHost: test\r\n\r\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		db.PutDocument(clownshoes.NewDocument([]byte("writer")))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writer blocked by a client that stopped reading")
+	}
+}
@@ -0,0 +1,392 @@
+package clownshoes
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// A ShardedBundle partitions documents across several files by a function of
+// their payloads, so that writes to different shards don't contend for the same
+// lock.  Each shard is an ordinary DocumentBundle.  Operations that can be
+// confined to one shard are; the rest run on every shard in parallel, so
+// filters and replacers passed to them must be safe for concurrent use.
+
+// Where a document lives in a ShardedBundle.
+type Location struct {
+	Shard  int    //Index of the shard in Shards
+	Offset uint64 //Offset of the document within the shard
+}
+
+type ShardedBundle struct {
+	Shards   []*DocumentBundle
+	shardKey func([]byte) string
+	mu       sync.RWMutex
+	routed   map[string]bool //Indexes keyed by the shard key, whose lookups need only one shard
+}
+
+// Open or create a DocumentBundle at each location (see NewDB), and shard
+// documents among them by the hash of shardKey applied to their payloads.  The
+// same locations must be given in the same order every time.  Panics if any
+// shard can't be opened; use OpenShardedDB to get the error instead.
+func NewShardedDB(locations []string, shardKey func([]byte) string) *ShardedBundle {
+	shards := make([]*DocumentBundle, len(locations))
+	for i, location := range locations {
+		shards[i] = NewDB(location)
+	}
+	return &ShardedBundle{Shards: shards, shardKey: shardKey, routed: make(map[string]bool)}
+}
+
+// As NewShardedDB, but opening each shard with OpenDB.  If any can't be opened
+// the rest are closed.
+func OpenShardedDB(locations []string, opts Options, shardKey func([]byte) string) (*ShardedBundle, error) {
+	shards := make([]*DocumentBundle, 0, len(locations))
+	for _, location := range locations {
+		shard, err := OpenDB(location, opts)
+		if err != nil {
+			for _, opened := range shards {
+				opened.Close()
+			}
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+	return &ShardedBundle{Shards: shards, shardKey: shardKey, routed: make(map[string]bool)}, nil
+}
+
+// The shard responsible for documents with the given shard key.
+func (sb *ShardedBundle) shardForKey(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(sb.Shards)))
+}
+
+func (sb *ShardedBundle) shardFor(payload []byte) int {
+	return sb.shardForKey(sb.shardKey(payload))
+}
+
+// Run fn on every shard concurrently, returning the error from the first shard
+// that failed.
+func (sb *ShardedBundle) fanOut(fn func(i int, shard *DocumentBundle) error) error {
+	errs := make([]error, len(sb.Shards))
+	var wg sync.WaitGroup
+	for i, shard := range sb.Shards {
+		wg.Add(1)
+		go func(i int, shard *DocumentBundle) {
+			defer wg.Done()
+			errs[i] = fn(i, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The single shard that can hold documents with the given key in the named
+// index, or -1 if it could be any of them.
+func (sb *ShardedBundle) route(indexName, lookupKey string) int {
+	sb.mu.RLock()
+	defer sb.mu.RUnlock()
+	if sb.routed[indexName] {
+		return sb.shardForKey(lookupKey)
+	}
+	return -1
+}
+
+// Add the index to every shard.
+func (sb *ShardedBundle) AddIndex(indexName string, keyFn func([]byte) string) {
+	sb.fanOut(func(i int, shard *DocumentBundle) error {
+		shard.AddIndex(indexName, keyFn)
+		return nil
+	})
+	sb.mu.Lock()
+	delete(sb.routed, indexName)
+	sb.mu.Unlock()
+}
+
+// Add an index keyed by the shard key to every shard.  Lookups with it only
+// consult the shard the key belongs to.
+func (sb *ShardedBundle) AddShardKeyIndex(indexName string) {
+	sb.AddIndex(indexName, sb.shardKey)
+	sb.mu.Lock()
+	sb.routed[indexName] = true
+	sb.mu.Unlock()
+}
+
+// Remove the index from every shard.
+func (sb *ShardedBundle) RemoveIndex(indexName string) {
+	sb.fanOut(func(i int, shard *DocumentBundle) error {
+		shard.RemoveIndex(indexName)
+		return nil
+	})
+	sb.mu.Lock()
+	delete(sb.routed, indexName)
+	sb.mu.Unlock()
+}
+
+// Insert the document into the shard its key belongs to.
+func (sb *ShardedBundle) PutDocument(doc Document) (Location, error) {
+	i := sb.shardFor(doc.Payload)
+	offset, err := sb.Shards[i].PutDocument(doc)
+	return Location{i, offset}, err
+}
+
+// Return the document at the given location, or ErrNoDocument.
+func (sb *ShardedBundle) GetDocumentAt(loc Location) (Document, error) {
+	if loc.Shard < 0 || loc.Shard >= len(sb.Shards) {
+		return Document{}, ErrNoDocument
+	}
+	return sb.Shards[loc.Shard].GetDocumentAt(loc.Offset)
+}
+
+// Remove the document at the given location.
+func (sb *ShardedBundle) RemoveDocumentAt(loc Location) error {
+	if loc.Shard < 0 || loc.Shard >= len(sb.Shards) {
+		return ErrNoDocument
+	}
+	return sb.Shards[loc.Shard].RemoveDocumentAt(loc.Offset)
+}
+
+// Return the documents with the given key in the named index, from every shard
+// or just the one the key belongs to for shard key indexes.
+func (sb *ShardedBundle) GetDocumentsWhere(indexName string, lookupKey string) (docs []Document) {
+	if i := sb.route(indexName, lookupKey); i != -1 {
+		return sb.Shards[i].GetDocumentsWhere(indexName, lookupKey)
+	}
+	results := make([][]Document, len(sb.Shards))
+	sb.fanOut(func(i int, shard *DocumentBundle) error {
+		results[i] = shard.GetDocumentsWhere(indexName, lookupKey)
+		return nil
+	})
+	for _, result := range results {
+		docs = append(docs, result...)
+	}
+	return docs
+}
+
+// Return every document for which filter returns true, scanning the shards in
+// parallel.  Results are in shard order.
+func (sb *ShardedBundle) GetDocuments(filter func([]byte) bool) (docs []Document) {
+	results := make([][]Document, len(sb.Shards))
+	sb.fanOut(func(i int, shard *DocumentBundle) error {
+		results[i] = shard.GetDocuments(filter)
+		return nil
+	})
+	for _, result := range results {
+		docs = append(docs, result...)
+	}
+	return docs
+}
+
+// Run proc over every live document, one shard after another, stopping early if
+// it returns false.
+func (sb *ShardedBundle) ForEachDocument(proc func(loc Location, doc Document) bool) {
+	for i, shard := range sb.Shards {
+		stopped := false
+		shard.ForEachDocument(func(offset uint64, doc Document) bool {
+			stopped = !proc(Location{i, offset}, doc)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// As ForEachDocument, but over the documents with the given key in the named
+// index.
+func (sb *ShardedBundle) ForEachDocumentWhere(indexName string, lookupKey string, proc func(loc Location, doc Document) bool) {
+	first, last := 0, len(sb.Shards)-1
+	if i := sb.route(indexName, lookupKey); i != -1 {
+		first, last = i, i
+	}
+	for i := first; i <= last; i++ {
+		stopped := false
+		sb.Shards[i].ForEachDocumentWhere(indexName, lookupKey, func(offset uint64, doc Document) bool {
+			stopped = !proc(Location{i, offset}, doc)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// Run the replacer over every document as ReplaceDocuments does, in parallel
+// across shards.  A document whose new payload belongs in another shard is
+// inserted there once every shard has been processed, and only then removed
+// from its old one, so one whose insert fails stays where it was.
+func (sb *ShardedBundle) ReplaceDocuments(replacer func([]byte) ([]byte, bool)) (uint64, error) {
+	return sb.replace("", "", replacer)
+}
+
+// As ReplaceDocuments, but for documents with the given key in the named index.
+func (sb *ShardedBundle) ReplaceDocumentsWhere(indexName string, lookupKey string, replacer func([]byte) ([]byte, bool)) (uint64, error) {
+	return sb.replace(indexName, lookupKey, replacer)
+}
+
+// A replaced document bound for another shard
+type shardMove struct {
+	offset   uint64 //Where the original is in its shard
+	original []byte //Its payload when it was replaced
+	doc      Document
+}
+
+func (sb *ShardedBundle) replace(indexName, lookupKey string, replacer func([]byte) ([]byte, bool)) (uint64, error) {
+	counters := make([]uint64, len(sb.Shards))
+	moves := make([][]shardMove, len(sb.Shards))
+	only := -1
+	if indexName != "" {
+		only = sb.route(indexName, lookupKey)
+	}
+	err := sb.fanOut(func(i int, shard *DocumentBundle) error {
+		if only != -1 && i != only {
+			return nil
+		}
+		var err error
+		counters[i], moves[i], err = sb.replaceInShard(i, indexName, lookupKey, replacer)
+		return err
+	})
+
+	//Shard locks are taken one at a time, so moves can't deadlock
+	counter := uint64(0)
+	for i := range sb.Shards {
+		counter += counters[i]
+		for _, move := range moves[i] {
+			moveErr := sb.move(i, move)
+			if moveErr == nil {
+				counter++
+			} else if err == nil {
+				err = moveErr
+			}
+		}
+	}
+	return counter, err
+}
+
+// Insert a replaced document into its new shard, then remove the original
+// from shard i.  The shard was unlocked in between, so the original is only
+// removed if it's still there unchanged; otherwise, or if the removal fails,
+// the copy is removed again and ErrNoDocument or the hook's error returned.
+func (sb *ShardedBundle) move(i int, move shardMove) error {
+	loc, err := sb.PutDocument(move.doc)
+	if err != nil {
+		return err
+	}
+	if err = sb.Shards[i].removeDocumentIf(move.offset, move.original); err != nil {
+		sb.RemoveDocumentAt(loc)
+	}
+	return err
+}
+
+// Replace documents in shard i in place if their new payloads still belong
+// there, otherwise return them to be moved, leaving the originals in place.
+// Only documents with the given key are considered if indexName isn't "".
+func (sb *ShardedBundle) replaceInShard(i int, indexName, lookupKey string, replacer func([]byte) ([]byte, bool)) (counter uint64, moves []shardMove, err error) {
+	shard := sb.Shards[i]
+	shard.Lock()
+	defer shard.Unlock()
+	if err = shard.checkWritable(); err != nil {
+		return 0, nil, err
+	}
+
+	//Snapshot the offsets, so documents that move to the end aren't seen twice
+	var offsets []uint64
+	if indexName != "" {
+		if idx, found := shard.indexes[indexName]; found {
+			offsets = append(offsets, idx.get(lookupKey)...)
+		}
+	} else {
+		shard.doForEachDocument(func(offset uint64, doc Document) {
+			offsets = append(offsets, offset)
+		})
+	}
+
+	now := timeNow().UnixNano()
+	for _, offset := range offsets {
+		curDoc := shard.doGetDocumentAt(offset)
+		if curDoc.expiredAt(now) {
+			continue
+		}
+		newPayload, modified := replacer(curDoc.Payload)
+		if !modified {
+			continue
+		}
+		if sb.shardFor(newPayload) != i {
+			//The payloads may point into the mapping
+			doc := Document{Payload: append([]byte(nil), newPayload...), Expires: curDoc.Expires}
+			moves = append(moves, shardMove{offset, append([]byte(nil), curDoc.Payload...), doc})
+			continue
+		}
+		if _, err = shard.doReplaceDocument(offset, NewDocument(newPayload)); err != nil {
+			return counter, moves, err
+		}
+		counter++
+	}
+	return counter, moves, nil
+}
+
+// Remove every document for which filter returns true, in parallel across
+// shards.  Returns the total removed, and the first error from any shard.
+func (sb *ShardedBundle) RemoveDocuments(filter func([]byte) bool) (uint64, error) {
+	counters := make([]uint64, len(sb.Shards))
+	err := sb.fanOut(func(i int, shard *DocumentBundle) (err error) {
+		counters[i], err = shard.RemoveDocuments(filter)
+		return err
+	})
+	return sum(counters), err
+}
+
+// As RemoveDocuments, but for documents with the given key in the named index.
+func (sb *ShardedBundle) RemoveDocumentsWhere(indexName string, lookupKey string, filter func([]byte) bool) (uint64, error) {
+	if i := sb.route(indexName, lookupKey); i != -1 {
+		return sb.Shards[i].RemoveDocumentsWhere(indexName, lookupKey, filter)
+	}
+	counters := make([]uint64, len(sb.Shards))
+	err := sb.fanOut(func(i int, shard *DocumentBundle) (err error) {
+		counters[i], err = shard.RemoveDocumentsWhere(indexName, lookupKey, filter)
+		return err
+	})
+	return sum(counters), err
+}
+
+// Number of live documents across all shards.
+func (sb *ShardedBundle) Count() uint64 {
+	counters := make([]uint64, len(sb.Shards))
+	sb.fanOut(func(i int, shard *DocumentBundle) error {
+		counters[i] = shard.Count()
+		return nil
+	})
+	return sum(counters)
+}
+
+// Compact every shard in parallel.
+func (sb *ShardedBundle) Compact() error {
+	return sb.fanOut(func(i int, shard *DocumentBundle) error {
+		return shard.Compact()
+	})
+}
+
+// Flush every shard to disk.
+func (sb *ShardedBundle) Sync() error {
+	return sb.fanOut(func(i int, shard *DocumentBundle) error {
+		return shard.Sync()
+	})
+}
+
+// Close every shard.
+func (sb *ShardedBundle) Close() error {
+	return sb.fanOut(func(i int, shard *DocumentBundle) error {
+		return shard.Close()
+	})
+}
+
+func sum(counters []uint64) (total uint64) {
+	for _, c := range counters {
+		total += c
+	}
+	return total
+}
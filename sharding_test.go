@@ -0,0 +1,163 @@
+package clownshoes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestShardedBundle(t *testing.T) {
+	var locations []string
+	for i := 0; i < 4; i++ {
+		f, e := ioutil.TempFile("", "ClownshoesDBTest")
+		if e != nil {
+			t.Error("Problem creating db", e)
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+		locations = append(locations, f.Name())
+	}
+	//Payloads are "user:n"; the user is the shard key
+	user := func(b []byte) string { return string(b[:bytes.IndexByte(b, ':')]) }
+	sb := NewShardedDB(locations, user)
+	sb.AddShardKeyIndex("user")
+	sb.AddIndex("identity", func(b []byte) string { return string(b) })
+
+	for i := 0; i < 200; i++ {
+		loc, e := sb.PutDocument(NewDocument([]byte(fmt.Sprintf("user%d:%d", i%20, i))))
+		if e != nil || loc.Shard != sb.shardForKey(fmt.Sprintf("user%d", i%20)) {
+			t.Error("Document put in the wrong shard", loc, e)
+		}
+		if doc, e := sb.GetDocumentAt(loc); e != nil || user(doc.Payload) != fmt.Sprintf("user%d", i%20) {
+			t.Error("Couldn't get document back by location", e)
+		}
+	}
+	used := 0
+	for _, shard := range sb.Shards {
+		if shard.Count() != 0 {
+			used++
+		}
+	}
+	if used < 2 || sb.Count() != 200 {
+		t.Error("Documents not spread across shards", used, sb.Count())
+	}
+
+	all := func(b []byte) bool { return true }
+	if len(sb.GetDocuments(all)) != 200 {
+		t.Error("Scan missed documents")
+	}
+	if len(sb.GetDocumentsWhere("user", "user3")) != 10 || len(sb.GetDocumentsWhere("identity", "user3:23")) != 1 {
+		t.Error("Indexed lookup failed")
+	}
+	seen := 0
+	sb.ForEachDocumentWhere("user", "user3", func(loc Location, doc Document) bool {
+		seen++
+		return seen < 5
+	})
+	if seen != 5 {
+		t.Error("ForEachDocumentWhere didn't stop early", seen)
+	}
+
+	//Changing the shard key moves documents
+	ct, e := sb.ReplaceDocumentsWhere("user", "user3", func(b []byte) ([]byte, bool) {
+		return append([]byte("moved"), b[len("user3"):]...), true
+	})
+	if e != nil || ct != 10 {
+		t.Error("Replacement failed", ct, e)
+	}
+	if len(sb.GetDocumentsWhere("user", "user3")) != 0 || len(sb.GetDocumentsWhere("user", "moved")) != 10 {
+		t.Error("Replaced documents not routed to their new shard")
+	}
+	ct, _ = sb.ReplaceDocuments(func(b []byte) ([]byte, bool) { return append(b, '!'), true })
+	if ct != 200 || len(sb.GetDocumentsWhere("identity", "user4:24!")) != 1 {
+		t.Error("Replacement across shards failed", ct)
+	}
+
+	ct, e = sb.RemoveDocuments(func(b []byte) bool { return bytes.HasPrefix(b, []byte("user1:")) })
+	if e != nil || ct != 10 {
+		t.Error("Removal across shards failed", ct, e)
+	}
+	if e := sb.Compact(); e != nil || sb.Count() != 190 {
+		t.Error("Compaction failed", e)
+	}
+	if len(sb.GetDocumentsWhere("user", "moved")) != 10 {
+		t.Error("Index not rebuilt after compaction")
+	}
+}
+
+func TestShardedMoveRejected(t *testing.T) {
+	var locations []string
+	for i := 0; i < 4; i++ {
+		f, e := ioutil.TempFile("", "ClownshoesDBTest")
+		if e != nil {
+			t.Error("Problem creating db", e)
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+		locations = append(locations, f.Name())
+	}
+	user := func(b []byte) string { return string(b[:bytes.IndexByte(b, ':')]) }
+	sb := NewShardedDB(locations, user)
+	sb.AddShardKeyIndex("user")
+	for i := 0; i < 40; i++ {
+		sb.PutDocument(NewDocument([]byte(fmt.Sprintf("user%d:%d", i%20, i))))
+	}
+	rejected := errors.New("rejected")
+	for _, shard := range sb.Shards {
+		shard.AddHooks(Hooks{BeforePut: func(payload []byte) ([]byte, error) {
+			return nil, rejected
+		}})
+	}
+
+	//Every move's insert fails, so nothing should be lost
+	ct, e := sb.ReplaceDocuments(func(b []byte) ([]byte, bool) {
+		return append([]byte("moved"), b...), true
+	})
+	if e != rejected {
+		t.Error("Rejected insert not reported", e)
+	}
+	if sb.Count() != 40 || len(sb.GetDocumentsWhere("user", "user3")) != 2 {
+		t.Error("Documents lost when their inserts were rejected", ct, sb.Count())
+	}
+	for _, doc := range sb.GetDocuments(func(b []byte) bool { return true }) {
+		if !bytes.HasPrefix(doc.Payload, []byte("user")) {
+			t.Error("Document moved despite rejection", string(doc.Payload))
+		}
+	}
+}
+
+func TestShardedMoveReusedOffset(t *testing.T) {
+	var locations []string
+	for i := 0; i < 2; i++ {
+		f, e := ioutil.TempFile("", "ClownshoesDBTest")
+		if e != nil {
+			t.Error("Problem creating db", e)
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+		locations = append(locations, f.Name())
+	}
+	user := func(b []byte) string { return string(b[:bytes.IndexByte(b, ':')]) }
+	sb := NewShardedDB(locations, user)
+	loc, _ := sb.PutDocument(NewDocument([]byte("a:1")))
+	shard := sb.Shards[loc.Shard]
+
+	//The original is removed and its offset reused before the move finishes
+	shard.RemoveDocumentAt(loc.Offset)
+	if offset, _ := shard.PutDocument(NewDocument([]byte("a:2"))); offset != loc.Offset {
+		t.Skip("Offset wasn't reused", offset, loc.Offset)
+	}
+	move := shardMove{loc.Offset, []byte("a:1"), NewDocument([]byte("b:1"))}
+	if e := sb.move(loc.Shard, move); e != ErrNoDocument {
+		t.Error("Expected ErrNoDocument moving a reused offset, got", e)
+	}
+	if doc, e := sb.GetDocumentAt(loc); e != nil || string(doc.Payload) != "a:2" {
+		t.Error("Unrelated document removed by a stale move", string(doc.Payload), e)
+	}
+	if sb.Count() != 1 {
+		t.Error("Moved copy not removed again", sb.Count())
+	}
+}
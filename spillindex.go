@@ -0,0 +1,462 @@
+package clownshoes
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+)
+
+// Spill indexes keep each key's posting list compressed, as the sorted offsets'
+// uvarint deltas, in a byte slice rather than a slice of offsets.  When the
+// lists held in memory, with their keys & bookkeeping, outgrow the index's
+// budget, the least recently used are moved to a sidecar file mapped into
+// memory, key and all, and read from there until a change brings them back.
+// Spilled lists are found through a hash table of their positions in the
+// sidecar, in a second mapped file, so the index's heap grows with the lists
+// in memory rather than all the keys.  Space freed in the sidecar is reclaimed
+// by sliding the lists after it down once it's half the file.  Like the table
+// of a compact index, both files are unlinked as soon as they're created, and
+// spill indexes aren't included in index dumps.
+
+type SpillIndexOptions struct {
+	MemoryBudget int64  //Bytes of lists, keys & bookkeeping to keep in memory.  DefaultIndexMemoryBudget if zero
+	Dir          string //Where to write the sidecar; the DB file's directory if empty
+}
+
+const DefaultIndexMemoryBudget = 64 << 20
+
+// Smallest size of the sidecar, which doubles as it fills
+const minSidecarSize = 1 << 20
+
+// Smallest number of slots in the hash table of spilled lists
+const minSpillSlots = 1 << 12
+
+// Memory taken by a list held in memory besides its key & offsets: the map
+// entry, pointer & struct
+const spillListOverhead = 96
+
+// A list held in memory
+type postingList struct {
+	hot   []byte //Compressed offsets
+	count int    //Number of offsets
+	last  uint64 //Largest offset, so new documents can be appended without decoding
+	used  uint64 //When the list was last used, for choosing which to spill
+}
+
+// A list in the sidecar, which holds the uvarint length of the key, the key,
+// the count, the largest offset, and the length of the compressed offsets,
+// followed by them
+type spilledList struct {
+	key      []byte
+	count    int
+	last     uint64
+	postings []byte
+	size     int64 //Bytes taken in the sidecar
+}
+
+type spillIndex struct {
+	opts      SpillIndexOptions
+	dir       string
+	lists     map[string]*postingList //Lists held in memory
+	hotBytes  int64                   //Memory taken by those lists, their keys & bookkeeping
+	clock     uint64
+	file      *os.File
+	sidecar   []byte //Mapped sidecar file of spilled lists
+	end       int64  //Bytes of the sidecar written
+	garbage   int64  //Bytes of the sidecar no longer used by any list
+	tableFile *os.File
+	table     []byte //Mapped hash table of spilled lists: uint64 slots of their positions + 2, 1 if deleted or 0 if empty
+	spilled   int    //Number of spilled lists
+	usedSlots int    //Slots that aren't empty, counting deleted ones
+	err       error  //Why the last spill failed, if it did; the lists stay in memory
+}
+
+// Add an index like AddIndex, but keeping its postings compressed, and within
+// opts.MemoryBudget bytes in memory by moving the least recently used to disk,
+// along with their keys.
+func (db *DocumentBundle) AddSpillIndex(indexName string, keyFn func([]byte) string, opts SpillIndexOptions) error {
+	if opts.MemoryBudget == 0 {
+		opts.MemoryBudget = DefaultIndexMemoryBudget
+	}
+	if opts.MemoryBudget < 0 {
+		return errors.New("clownshoes: memory budget must be positive")
+	}
+	db.Lock()
+	defer db.Unlock()
+	dir := opts.Dir
+	if dir == "" {
+		dir = filepath.Dir(db.root.FileLoc)
+	}
+	db.doAddIndexLike(indexName, &index{keyFn: keyFn, spill: &spillIndex{opts: opts, dir: dir}})
+	db.publishIndexAdded(indexName)
+	return nil
+}
+
+// Empty the index, dropping the sidecar.
+func (s *spillIndex) reset() {
+	s.release()
+	s.lists = make(map[string]*postingList)
+	s.hotBytes, s.end, s.garbage, s.spilled, s.usedSlots, s.err = 0, 0, 0, 0, 0, nil
+}
+
+// Unmap and close the sidecar & table.
+func (s *spillIndex) release() {
+	if s.sidecar != nil {
+		syscall.Munmap(s.sidecar)
+		s.sidecar = nil
+	}
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if s.table != nil {
+		syscall.Munmap(s.table)
+		s.table = nil
+	}
+	if s.tableFile != nil {
+		s.tableFile.Close()
+		s.tableFile = nil
+	}
+}
+
+func decodePostings(b []byte, count int) []uint64 {
+	offsets := make([]uint64, 0, count)
+	prev := uint64(0)
+	for len(b) != 0 {
+		delta, n := binary.Uvarint(b)
+		b = b[n:]
+		prev += delta
+		offsets = append(offsets, prev)
+	}
+	return offsets
+}
+
+func encodePostings(offsets []uint64) []byte {
+	out := make([]byte, 0, len(offsets)*2)
+	var buf [binary.MaxVarintLen64]byte
+	prev := uint64(0)
+	for _, offset := range offsets {
+		out = append(out, buf[:binary.PutUvarint(buf[:], offset-prev)]...)
+		prev = offset
+	}
+	return out
+}
+
+// Memory taken by a list held in memory under the key.
+func listBytes(key string, l *postingList) int64 {
+	return int64(len(key) + len(l.hot) + spillListOverhead)
+}
+
+// The spilled list at pos in the sidecar.
+func (s *spillIndex) spilledAt(pos int64) spilledList {
+	b := s.sidecar[pos:]
+	n := 0
+	next := func() uint64 {
+		x, w := binary.Uvarint(b[n:])
+		n += w
+		return x
+	}
+	keyLen := int(next())
+	key := b[n : n+keyLen]
+	n += keyLen
+	count, last, size := int(next()), next(), int(next())
+	postings := b[n : n+size]
+	return spilledList{key, count, last, postings, int64(n + size)}
+}
+
+// FNV-1a, for the table of spilled lists
+func spillHash(key string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (s *spillIndex) slot(i int) uint64 {
+	return binary.LittleEndian.Uint64(s.table[8*i:])
+}
+
+func (s *spillIndex) setSlot(i int, v uint64) {
+	binary.LittleEndian.PutUint64(s.table[8*i:], v)
+}
+
+// Find the key's list in the sidecar, returning its slot in the table.
+func (s *spillIndex) findSpilled(key string) (int, spilledList, bool) {
+	slots := len(s.table) / 8
+	if slots == 0 {
+		return 0, spilledList{}, false
+	}
+	for i := int(spillHash(key) & uint64(slots-1)); ; i = (i + 1) & (slots - 1) {
+		v := s.slot(i)
+		if v == 0 {
+			return 0, spilledList{}, false
+		}
+		if v == 1 {
+			continue
+		}
+		if l := s.spilledAt(int64(v - 2)); string(l.key) == key {
+			return i, l, true
+		}
+	}
+}
+
+// Record the position of a spilled list in the table, growing it if need be.
+func (s *spillIndex) addSpilled(key string, pos int64) error {
+	if 2*(s.usedSlots+1) > len(s.table)/8 {
+		if err := s.rehash(); err != nil {
+			return err
+		}
+	}
+	slots := len(s.table) / 8
+	i := int(spillHash(key) & uint64(slots-1))
+	for s.slot(i) > 1 {
+		i = (i + 1) & (slots - 1)
+	}
+	if s.slot(i) == 0 {
+		s.usedSlots++
+	}
+	s.setSlot(i, uint64(pos)+2)
+	s.spilled++
+	return nil
+}
+
+// Write the table of spilled lists out afresh, big enough for twice as many,
+// dropping deleted slots.
+func (s *spillIndex) rehash() error {
+	slots := minSpillSlots
+	for slots < 4*(s.spilled+1) {
+		slots *= 2
+	}
+	f, err := ioutil.TempFile(s.dir, "clownshoes-index")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	if err = f.Truncate(int64(8 * slots)); err != nil {
+		f.Close()
+		return err
+	}
+	mapped, err := syscall.Mmap(int(f.Fd()), 0, 8*slots, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	old := s.table
+	s.table = mapped
+	s.spilled, s.usedSlots = 0, 0
+	for i := 0; i < len(old)/8; i++ {
+		if v := binary.LittleEndian.Uint64(old[8*i:]); v > 1 {
+			s.addSpilled(string(s.spilledAt(int64(v-2)).key), int64(v-2))
+		}
+	}
+	if old != nil {
+		syscall.Munmap(old)
+		s.tableFile.Close()
+	}
+	s.tableFile = f
+	return nil
+}
+
+// The key's list in memory, bringing it back from the sidecar or starting it
+// if need be.
+func (s *spillIndex) take(key string) *postingList {
+	l := s.lists[key]
+	if l == nil {
+		l = &postingList{}
+		if i, spilled, found := s.findSpilled(key); found {
+			l.hot = append([]byte(nil), spilled.postings...)
+			l.count, l.last = spilled.count, spilled.last
+			s.setSlot(i, 1)
+			s.spilled--
+			s.garbage += spilled.size
+		}
+		s.lists[key] = l
+		s.hotBytes += listBytes(key, l)
+	}
+	s.clock++
+	l.used = s.clock
+	return l
+}
+
+// Replace the list's contents, keeping hotBytes up to date.
+func (s *spillIndex) set(l *postingList, hot []byte) {
+	s.hotBytes += int64(len(hot)) - int64(len(l.hot))
+	l.hot = hot
+}
+
+func (s *spillIndex) add(key string, offset uint64) {
+	l := s.take(key)
+	if l.count == 0 || offset > l.last {
+		var buf [binary.MaxVarintLen64]byte
+		s.set(l, append(l.hot, buf[:binary.PutUvarint(buf[:], offset-l.last)]...))
+		l.last = offset
+	} else {
+		offsets := decodePostings(l.hot, l.count+1)
+		i := sortSearchOffsets(offsets, offset)
+		offsets = append(offsets, 0)
+		copy(offsets[i+1:], offsets[i:])
+		offsets[i] = offset
+		s.set(l, encodePostings(offsets))
+	}
+	l.count++
+	s.enforceBudget()
+}
+
+// Returns whether the offset was there.
+func (s *spillIndex) remove(key string, offset uint64) bool {
+	offsets := s.get(key)
+	i := sortSearchOffsets(offsets, offset)
+	if i == len(offsets) || offsets[i] != offset {
+		return false
+	}
+	l := s.take(key)
+	l.count--
+	if l.count == 0 {
+		s.hotBytes -= listBytes(key, l)
+		delete(s.lists, key)
+		return true
+	}
+	offsets = append(offsets[:i], offsets[i+1:]...)
+	l.last = offsets[len(offsets)-1]
+	s.set(l, encodePostings(offsets))
+	s.enforceBudget()
+	return true
+}
+
+func sortSearchOffsets(offsets []uint64, offset uint64) int {
+	return sort.Search(len(offsets), func(i int) bool { return offsets[i] >= offset })
+}
+
+// Safe under the read lock, since only the list's last use is updated.
+func (s *spillIndex) get(key string) []uint64 {
+	if l := s.lists[key]; l != nil {
+		atomic.StoreUint64(&l.used, atomic.AddUint64(&s.clock, 1))
+		return decodePostings(l.hot, l.count)
+	}
+	if _, spilled, found := s.findSpilled(key); found {
+		return decodePostings(spilled.postings, spilled.count)
+	}
+	return nil
+}
+
+func (s *spillIndex) keyCount() int {
+	return len(s.lists) + s.spilled
+}
+
+func (s *spillIndex) forEachKey(proc func(key string, offsets []uint64)) {
+	for key, l := range s.lists {
+		proc(key, decodePostings(l.hot, l.count))
+	}
+	for i := 0; i < len(s.table)/8; i++ {
+		if v := s.slot(i); v > 1 {
+			spilled := s.spilledAt(int64(v - 2))
+			proc(string(spilled.key), decodePostings(spilled.postings, spilled.count))
+		}
+	}
+}
+
+// Spill the least recently used lists until those in memory take up three
+// quarters of the budget, so it isn't done on every change.
+func (s *spillIndex) enforceBudget() {
+	if s.hotBytes <= s.opts.MemoryBudget || s.err != nil {
+		return
+	}
+	keys := make([]string, 0, len(s.lists))
+	for key := range s.lists {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return s.lists[keys[i]].used < s.lists[keys[j]].used })
+	for _, key := range keys {
+		if s.hotBytes <= s.opts.MemoryBudget*3/4 {
+			return
+		}
+		if s.err = s.spill(key); s.err != nil {
+			return
+		}
+	}
+}
+
+// Move a list & its key to the sidecar.
+func (s *spillIndex) spill(key string) error {
+	l := s.lists[key]
+	if s.garbage > s.end/2 {
+		s.reclaim()
+	}
+	record := binary.AppendUvarint(nil, uint64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendUvarint(record, uint64(l.count))
+	record = binary.AppendUvarint(record, l.last)
+	record = binary.AppendUvarint(record, uint64(len(l.hot)))
+	record = append(record, l.hot...)
+	if need := s.end + int64(len(record)); need > int64(len(s.sidecar)) {
+		if err := s.grow(need); err != nil {
+			return err
+		}
+	}
+	copy(s.sidecar[s.end:], record)
+	if err := s.addSpilled(key, s.end); err != nil {
+		return err
+	}
+	s.end += int64(len(record))
+	s.hotBytes -= listBytes(key, l)
+	delete(s.lists, key)
+	return nil
+}
+
+// Make the sidecar at least size bytes long.
+func (s *spillIndex) grow(size int64) error {
+	if s.file == nil {
+		f, err := ioutil.TempFile(s.dir, "clownshoes-index")
+		if err != nil {
+			return err
+		}
+		os.Remove(f.Name())
+		s.file = f
+	}
+	newSize := int64(len(s.sidecar)) * 2
+	if newSize < minSidecarSize {
+		newSize = minSidecarSize
+	}
+	for newSize < size {
+		newSize *= 2
+	}
+	if err := s.file.Truncate(newSize); err != nil {
+		return err
+	}
+	mapped, err := syscall.Mmap(int(s.file.Fd()), 0, int(newSize), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	if s.sidecar != nil {
+		syscall.Munmap(s.sidecar)
+	}
+	s.sidecar = mapped
+	return nil
+}
+
+// Slide the spilled lists down over the space freed between them.
+func (s *spillIndex) reclaim() {
+	var slots []int
+	for i := 0; i < len(s.table)/8; i++ {
+		if s.slot(i) > 1 {
+			slots = append(slots, i)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return s.slot(slots[i]) < s.slot(slots[j]) })
+	s.end = 0
+	for _, i := range slots {
+		pos := int64(s.slot(i) - 2)
+		size := s.spilledAt(pos).size
+		copy(s.sidecar[s.end:], s.sidecar[pos:pos+size])
+		s.setSlot(i, uint64(s.end)+2)
+		s.end += size
+	}
+	s.garbage = 0
+}
@@ -0,0 +1,140 @@
+package clownshoes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPostingEncoding(t *testing.T) {
+	offsets := []uint64{8, 300, 301, 1 << 40, 1<<63 + 5}
+	if out := decodePostings(encodePostings(offsets), len(offsets)); !reflect.DeepEqual(out, offsets) {
+		t.Error("Round trip gave", out)
+	}
+	if len(encodePostings([]uint64{100, 101, 102, 103})) != 4 {
+		t.Error("Close offsets should take a byte each")
+	}
+
+	s := &spillIndex{opts: SpillIndexOptions{MemoryBudget: 1 << 20}}
+	s.reset()
+	for _, offset := range []uint64{50, 10, 30, 70} {
+		s.add("k", offset)
+	}
+	if !s.remove("k", 30) || s.remove("k", 30) || s.remove("missing", 30) {
+		t.Error("Wrong result removing")
+	}
+	s.add("k", 60)
+	if out := s.get("k"); !reflect.DeepEqual(out, []uint64{10, 50, 60, 70}) {
+		t.Error("Offsets out of order", out)
+	}
+}
+
+func TestSpilledKeys(t *testing.T) {
+	s := &spillIndex{opts: SpillIndexOptions{MemoryBudget: 1 << 12}, dir: os.TempDir()}
+	s.reset()
+	defer s.release()
+	for i := 0; i < 3*minSpillSlots; i++ {
+		s.add(fmt.Sprint("key", i), uint64(i))
+	}
+	if len(s.table)/8 <= minSpillSlots || s.keyCount() != 3*minSpillSlots {
+		t.Error("Table of spilled keys didn't grow", len(s.table)/8, s.keyCount())
+	}
+	for i := 0; i < 3*minSpillSlots; i += 2 {
+		if !s.remove(fmt.Sprint("key", i), uint64(i)) {
+			t.Fatal("Couldn't remove", i)
+		}
+	}
+	for i := 0; i < 3*minSpillSlots; i++ {
+		if out := s.get(fmt.Sprint("key", i)); (i%2 == 0) != (len(out) == 0) || len(out) == 1 && out[0] != uint64(i) {
+			t.Fatal("Wrong offsets for", i, out)
+		}
+	}
+	keys := 0
+	s.forEachKey(func(key string, offsets []uint64) { keys++ })
+	if keys != 3*minSpillSlots/2 || s.keyCount() != keys {
+		t.Error("Wrong number of keys", keys, s.keyCount())
+	}
+}
+
+func TestSpillIndex(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	for i := 0; i < 20000; i++ {
+		db.PutDocument(NewDocument([]byte(fmt.Sprintf("k%d:%d", i%2000, i))))
+	}
+	keyFn := func(b []byte) string { return strings.Split(string(b), ":")[0] }
+	db.AddIndex("memory", keyFn)
+	if e := db.AddSpillIndex("spill", keyFn, SpillIndexOptions{MemoryBudget: 4096, Dir: os.TempDir()}); e != nil {
+		t.Fatal("Couldn't add spill index", e)
+	}
+	spill := db.indexes["spill"].spill
+
+	sorted := func(docs []Document) []string {
+		var out []string
+		for _, doc := range docs {
+			out = append(out, string(doc.Payload))
+		}
+		sort.Strings(out)
+		return out
+	}
+	check := func(stage string) {
+		if spill.hotBytes > 4096 || len(spill.lists)*spillListOverhead > 4096 {
+			t.Error(stage, "over budget", spill.hotBytes, len(spill.lists))
+		}
+		for i := 0; i < 2100; i += 3 {
+			key := fmt.Sprintf("k%d", i)
+			if a, b := sorted(db.GetDocumentsWhere("memory", key)), sorted(db.GetDocumentsWhere("spill", key)); !reflect.DeepEqual(a, b) {
+				t.Fatal(stage, "lookups differ for", key, len(a), len(b))
+			}
+		}
+		if a, b := db.DistinctKeys("memory"), db.DistinctKeys("spill"); !reflect.DeepEqual(a, b) {
+			t.Error(stage, "distinct keys differ", len(a), len(b))
+		}
+		stats, _ := db.Stats()
+		if stats.Indexes["memory"] != stats.Indexes["spill"] {
+			t.Error(stage, "stats differ", stats.Indexes)
+		}
+	}
+	check("built")
+	if spill.end == 0 {
+		t.Error("Nothing was spilled")
+	}
+
+	//Changes bring spilled lists back into memory, leaving space to reclaim
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 300; i++ {
+			db.PutDocument(NewDocument([]byte(fmt.Sprintf("k%d:new%d", 2000+i%50, round))))
+		}
+		db.RemoveDocumentsWhere("memory", fmt.Sprintf("k%d", 14+round), func([]byte) bool { return true })
+		db.ReplaceDocumentsWhere("memory", fmt.Sprintf("k%d", 21+round), func(b []byte) ([]byte, bool) {
+			return []byte("k2001:" + string(b) + " moved somewhere longer"), true
+		})
+		for i := 0; i < 2000; i += 5 {
+			db.RemoveDocumentsWhere("spill", fmt.Sprintf("k%d", i), func(b []byte) bool {
+				return strings.HasSuffix(string(b), fmt.Sprintf("%d", round))
+			})
+		}
+		check(fmt.Sprint("round ", round))
+	}
+	if db.ExistsWhere("spill", "k14") || db.CountWhere("spill", "k2001") != db.CountWhere("memory", "k2001") {
+		t.Error("Wrong counts after changes")
+	}
+
+	db.Compact()
+	check("compacted")
+
+	db.RemoveIndex("spill")
+	if spill.sidecar != nil {
+		t.Error("Sidecar left mapped")
+	}
+}
@@ -0,0 +1,80 @@
+package clownshoes
+
+import "os"
+
+type IndexStats struct {
+	Keys     int //Number of distinct keys
+	Postings int //Number of document offsets across all keys
+}
+
+// Statistics for a collection and the file it's in.  Document counts & sizes are
+// maintained by the mutation paths and stored in the header, so gathering them
+// doesn't require a scan.
+type Stats struct {
+	FirstDocOffset uint64                //Offset of this collection's first document, or 0 if it's empty
+	LastDocOffset  uint64                //Offset of this collection's last document, or 0 if it's empty
+	EndOffset      uint64                //Offset just past the last document in the file
+	DocCount       uint64                //Live documents in this collection
+	LiveBytes      uint64                //Bytes occupied by this collection's live documents, including headers
+	FileDocCount   uint64                //Live documents in every collection in the file
+	FileLiveBytes  uint64                //Bytes occupied by live documents in every collection
+	DeadBytes      uint64                //Bytes between the header & the end of the last document that don't belong to a live document
+	FileSize       int64                 //Size of the file on disk
+	MappedSize     uint64                //Size of the mapping, which may be larger than the used region
+	Fragmentation  float64               //DeadBytes as a proportion of the used region, 0 if it's empty
+	Indexes        map[string]IndexStats //Per-index statistics for this collection
+}
+
+// Number of live documents in the collection.  Documents which have expired but
+// not been reaped are included.
+func (db *DocumentBundle) Count() uint64 {
+	db.readLock()
+	defer db.RUnlock()
+	return db.getDocCount()
+}
+
+// Gather statistics for the collection & file.  A high Fragmentation indicates a
+// Compact is worthwhile.
+func (db *DocumentBundle) Stats() (Stats, error) {
+	db.readLock()
+	defer db.RUnlock()
+
+	out := Stats{
+		FirstDocOffset: db.getFirstDocOffset(),
+		LastDocOffset:  db.getLastDocOffset(),
+		EndOffset:      db.getTail(),
+		DocCount:       db.getDocCount(),
+		LiveBytes:      db.getLiveBytes(),
+		MappedSize:     uint64(len(db.AsBytes)),
+		Indexes:        make(map[string]IndexStats, len(db.indexes)),
+	}
+	//Read the counts of unopened collections straight from the catalog
+	root := db.root
+	out.FileDocCount = root.getDocCount()
+	out.FileLiveBytes = root.getLiveBytes()
+	for i := 0; i < maxCollections; i++ {
+		slotPos := catalogStart + uint64(i)*catalogSlot
+		if root.collectionNameAt(slotPos) != "" {
+			headPos := slotPos + maxNameLength
+			out.FileDocCount += uint64FromBytes(db.AsBytes, headPos+16)
+			out.FileLiveBytes += uint64FromBytes(db.AsBytes, headPos+24)
+		}
+	}
+	//Dropped collections' documents are dead too
+	used := db.getTail() - dataStart
+	out.DeadBytes = used - out.FileLiveBytes
+	if used > 0 {
+		out.Fragmentation = float64(out.DeadBytes) / float64(used)
+	}
+
+	for name, idx := range db.indexes {
+		out.Indexes[name] = IndexStats{idx.keyCount(), idx.postings}
+	}
+
+	info, err := os.Stat(db.FileLoc)
+	if err != nil {
+		return out, err
+	}
+	out.FileSize = info.Size()
+	return out, nil
+}
@@ -0,0 +1,73 @@
+package clownshoes
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	db.AddIndex("ftb", first2Bytes)
+	users := db.Collection("users")
+	for i := 0; i < 10; i++ {
+		db.PutDocument(NewDocument([]byte("aa document")))
+		db.PutDocument(NewDocument([]byte("bb document")))
+		users.PutDocument(NewDocument([]byte("user")))
+	}
+	docSize := uint64(docHeaderSize + len("aa document"))
+	userSize := uint64(docHeaderSize + len("user"))
+
+	stats, e := db.Stats()
+	if e != nil {
+		t.Error("Problem gathering stats", e)
+	}
+	if stats.DocCount != 20 || db.Count() != 20 || stats.LiveBytes != 20*docSize {
+		t.Error("Wrong collection counts", stats)
+	}
+	if stats.FileDocCount != 30 || stats.FileLiveBytes != 20*docSize+10*userSize {
+		t.Error("Wrong file counts", stats)
+	}
+	if stats.DeadBytes != 0 || stats.Fragmentation != 0 {
+		t.Error("Dead bytes in fresh DB", stats)
+	}
+	if stats.Indexes["ftb"].Keys != 2 || stats.Indexes["ftb"].Postings != 20 {
+		t.Error("Wrong index stats", stats.Indexes)
+	}
+	if stats.MappedSize != uint64(len(db.AsBytes)) || stats.FileSize != int64(stats.MappedSize) {
+		t.Error("Wrong sizes", stats)
+	}
+
+	//Removing from the front leaves dead space
+	db.RemoveDocumentsWhere("ftb", "aa", func(b []byte) bool { return true })
+	stats, _ = db.Stats()
+	if stats.DocCount != 10 || stats.DeadBytes != 10*docSize || stats.Indexes["ftb"].Keys != 1 {
+		t.Error("Wrong stats after removal", stats)
+	}
+	if stats.Fragmentation <= 0 {
+		t.Error("No fragmentation after removal", stats)
+	}
+
+	//Shrinking in place leaves dead space, but not dead documents
+	db.ReplaceDocuments(func(b []byte) ([]byte, bool) { return b[:2], true })
+	stats, _ = db.Stats()
+	if stats.DocCount != 10 || stats.LiveBytes != 10*(docHeaderSize+2) {
+		t.Error("Wrong stats after replacement", stats)
+	}
+
+	db.Compact()
+	stats, _ = db.Stats()
+	if stats.DocCount != 10 || stats.DeadBytes != 0 || stats.FileLiveBytes != 10*(docHeaderSize+2)+10*userSize {
+		t.Error("Wrong stats after compaction", stats)
+	}
+	if users.Count() != 10 {
+		t.Error("Wrong count for named collection", users.Count())
+	}
+}
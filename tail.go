@@ -0,0 +1,235 @@
+package clownshoes
+
+import (
+	"os"
+	"syscall"
+)
+
+// Tail readers.  A process that opens a file with Options.Tail maps it
+// read-only without a flock, alongside a writer in another process.  Changes
+// within the mapped region show up through the shared mapping right away, but
+// when the writer grows the file it remaps, which we notice from the
+// generation counter in the header.  Before each read we compare the header's
+// generation & modification counters with those last seen, remapping if the
+// generation has changed, and catching up on any modifications.
+//
+// The writer records each change in the journal, a ring of entries following
+// the header page, each numbered by the modification count it brought the file
+// to, and holding the offset of the document changed, its collection, and
+// whether it was written there or removed.  Tail readers replay the entries
+// they haven't seen, removing each offset from the indexes under the key it
+// had, which they keep for the purpose since the payload may have been
+// overwritten, then re-indexing the document there if it's still live.  A
+// compaction or dropped collection invalidates everything, as does falling
+// more than a journal's length behind, so the indexes are rebuilt.
+//
+// There's no locking between processes around changes, so a read that
+// overlaps one may see it half done.  But tail readers hold a shared open file
+// description lock on the file, which doesn't conflict with flocks, and the
+// writer only truncates the file if it can take an exclusive one, so a
+// compaction or shrink leaves the file its size while they have it open, and
+// their mappings never extend past its end.  Tailing suits a writer that
+// mostly appends.
+
+const (
+	journalEntries   = 4096
+	journalEntrySize = 16
+)
+
+// Kinds of journal entry
+const (
+	journalPut    = iota //A document was written at the offset
+	journalRemove        //The document at the offset was unlinked
+	journalReset         //Offsets changed wholesale, or a collection was dropped
+)
+
+// Record a change to the document at offset in the journal, and count it.
+// Entries are the modification count, then the offset in the low 48 bits,
+// the position of the collection's list head in the next 12, and the kind.
+func (db *DocumentBundle) journal(kind uint64, offset uint64) {
+	seq := uint64FromBytes(db.AsBytes, modificationsPos) + 1
+	pos := journalStart + seq%journalEntries*journalEntrySize
+	db.writePointer(pos, seq)
+	db.writePointer(pos+8, offset|db.headPos<<48|kind<<60)
+	db.writePointer(modificationsPos, seq)
+	db.root.trackOwner(kind, offset, db.headPos)
+}
+
+// Keep the record of which collection each live document is in, if there is
+// one, up to date with a change.
+func (db *DocumentBundle) trackOwner(kind, offset, headPos uint64) {
+	if db.owners == nil {
+		return
+	}
+	switch kind {
+	case journalPut:
+		db.owners[offset] = headPos
+	case journalRemove:
+		delete(db.owners, offset)
+	case journalReset:
+		db.owners = nil
+	}
+}
+
+// Acquire the read lock, first catching up with other processes' changes if
+// this is a tail reader.
+func (db *DocumentBundle) readLock() {
+	if db.root.options.Tail {
+		db.refresh()
+	}
+	db.RLock()
+}
+
+func (db *DocumentBundle) headerVersion() [2]uint64 {
+	return [2]uint64{uint64FromBytes(db.AsBytes, generationPos), uint64FromBytes(db.AsBytes, modificationsPos)}
+}
+
+// Remap and catch up if the writer has changed anything since we last looked.
+// If remapping fails the old mapping is kept, and we try again next time.
+func (db *DocumentBundle) refresh() {
+	root := db.root
+	db.RLock()
+	version := root.headerVersion()
+	db.RUnlock()
+	if version == root.seenVersion {
+		return
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	version = root.headerVersion()
+	if version[0] != root.seenVersion[0] {
+		if root.doRemapFile() != nil {
+			return
+		}
+		version = root.headerVersion()
+	}
+	seen := root.seenVersion[1]
+	root.seenVersion = version
+	if version[1] == seen || root.doReplayJournal(seen, version[1]) {
+		return
+	}
+	root.owners = nil
+	for _, coll := range root.openedCollections() {
+		for _, idx := range coll.indexes {
+			coll.doRebuildIndex(idx)
+		}
+		coll.restartIndexBuilds()
+		coll.expiry = expiryTracker{}
+	}
+}
+
+// Apply the changes after modification seen, up to and including mods, from
+// the journal.  Returns false if they're no longer all there, or the indexes
+// need rebuilding anyway.  Called on the root, with the write lock held.
+func (db *DocumentBundle) doReplayJournal(seen, mods uint64) bool {
+	if mods < seen || mods-seen > journalEntries {
+		return false
+	}
+	//Only the last change to each document matters, keyed by list head & offset
+	last := make(map[[2]uint64]uint64)
+	for seq := seen + 1; seq <= mods; seq++ {
+		pos := journalStart + seq%journalEntries*journalEntrySize
+		if uint64FromBytes(db.AsBytes, pos) != seq {
+			//The writer has lapped us
+			return false
+		}
+		entry := uint64FromBytes(db.AsBytes, pos+8)
+		kind := entry >> 60
+		if kind == journalReset {
+			return false
+		}
+		last[[2]uint64{entry >> 48 & 0xfff, entry & (1<<48 - 1)}] = kind
+	}
+
+	//An offset may have left one collection and joined another, so removals go
+	//first
+	for change, kind := range last {
+		if kind == journalRemove {
+			db.trackOwner(kind, change[1], change[0])
+		}
+	}
+	for change, kind := range last {
+		if kind == journalPut {
+			db.trackOwner(kind, change[1], change[0])
+		}
+	}
+
+	colls := make(map[uint64]*DocumentBundle)
+	for _, coll := range db.openedCollections() {
+		colls[coll.headPos] = coll
+	}
+	for change, kind := range last {
+		//Collections that haven't been opened have no indexes
+		if coll, found := colls[change[0]]; found {
+			if !coll.doApplyChange(change[1], kind == journalPut) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Bring the collection's indexes & builds up to date with the document at
+// offset having been written there, if put, or removed.  Returns false if the
+// document is out of bounds.
+func (db *DocumentBundle) doApplyChange(offset uint64, put bool) bool {
+	var doc Document
+	if put {
+		if !db.docInBounds(offset, min(db.getTail(), uint64(len(db.AsBytes)))) {
+			return false
+		}
+		doc = db.doGetDocumentAt(offset)
+	}
+	reindex := func(idx *index) {
+		idx.removeOffset(offset)
+		if !put {
+			return
+		}
+		if key, covered := idx.keyOf(doc.Payload); covered {
+			idx.add(key, offset)
+		}
+	}
+	for _, idx := range db.indexes {
+		reindex(idx)
+	}
+	for _, b := range db.builds {
+		if b.err != nil {
+			continue
+		}
+		if b.cursor == offset && !put {
+			//The scan would carry on from an unlinked document
+			b.reset(true)
+			continue
+		}
+		b.guard(func() {
+			reindex(b.idx)
+			b.touched[offset] = true
+		})
+	}
+	db.untrackExpiry(offset)
+	if put {
+		db.trackExpiry(doc, offset)
+	}
+	return true
+}
+
+// Map the whole of the file as it is now, read-only.  Called on the root.
+func (db *DocumentBundle) doRemapFile() error {
+	file, err := os.Open(db.FileLoc)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stats, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	newArr, err := syscall.Mmap(int(file.Fd()), 0, int(stats.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	oldArr := db.AsBytes
+	db.setMapping(newArr)
+	return syscall.Munmap(oldArr)
+}
@@ -0,0 +1,33 @@
+package clownshoes
+
+import (
+	"os"
+	"syscall"
+)
+
+// Open file description locks, which don't conflict with flocks, and unlike
+// fcntl's other locks conflict within a process too.  Since Linux 3.15.
+const (
+	fOFDSetLock     = 37 //F_OFD_SETLK
+	fOFDSetLockWait = 38 //F_OFD_SETLKW
+)
+
+// Take a shared lock on the file, held until it's closed, to show a tail reader
+// has it mapped.  Waits while the writer truncates it.
+func lockAsTailReader(file *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_RDLCK}
+	err := syscall.FcntlFlock(file.Fd(), fOFDSetLockWait, &lock)
+	if err == syscall.EINVAL {
+		//An older kernel, so the writer can't tell we're here either
+		return nil
+	}
+	return err
+}
+
+// Try to take an exclusive lock on the file, held until it's closed, returning
+// false if tail readers have it mapped.
+func lockOutTailReaders(file *os.File) bool {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK}
+	err := syscall.FcntlFlock(file.Fd(), fOFDSetLock, &lock)
+	return err != syscall.EAGAIN && err != syscall.EACCES
+}
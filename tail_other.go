@@ -0,0 +1,16 @@
+//go:build !linux
+
+package clownshoes
+
+import "os"
+
+// Without open file description locks, the writer can't tell whether tail
+// readers have the file mapped, and truncates it regardless.
+
+func lockAsTailReader(file *os.File) error {
+	return nil
+}
+
+func lockOutTailReaders(file *os.File) bool {
+	return true
+}
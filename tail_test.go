@@ -0,0 +1,150 @@
+package clownshoes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTailReader(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	writer, e := OpenDB(f.Name(), Options{})
+	if e != nil {
+		t.Fatal("Problem opening db", e)
+	}
+	defer writer.Close()
+	writer.PutDocument(NewDocument([]byte("first")))
+
+	//A separate mapping of the same file behaves like another process's
+	reader, e := OpenDB(f.Name(), Options{Tail: true})
+	if e != nil {
+		t.Fatal("Tail reader locked out by writer", e)
+	}
+	defer reader.Close()
+	reader.AddIndex("identity", func(b []byte) string { return string(b) })
+	all := func(b []byte) bool { return true }
+	if len(reader.GetDocuments(all)) != 1 {
+		t.Error("Tail reader doesn't see existing documents")
+	}
+	if _, e := reader.PutDocument(NewDocument([]byte("nope"))); e != ErrReadOnly {
+		t.Error("Tail reader accepted a write", e)
+	}
+
+	writer.PutDocument(NewDocument([]byte("second")))
+	if len(reader.GetDocuments(all)) != 2 || len(reader.GetDocumentsWhere("identity", "second")) != 1 {
+		t.Error("Tail reader doesn't see appended document")
+	}
+
+	//Growth past the reader's mapping.  Skipping ahead saves filling the first
+	//gigabyte
+	oldSize := len(reader.AsBytes)
+	writer.Grow(1000000)
+	writer.Lock()
+	writer.setTail(uint64(oldSize) + 100)
+	writer.Unlock()
+	offset, _ := writer.PutDocument(NewDocument([]byte("beyond")))
+	if doc, e := reader.GetDocumentAt(offset); e != nil || string(doc.Payload) != "beyond" {
+		t.Error("Tail reader didn't remap after growth", e)
+	}
+	if len(reader.AsBytes) <= oldSize {
+		t.Error("Tail reader mapping didn't grow")
+	}
+
+	//Compaction moves everything, but mustn't truncate the file under the
+	//reader's mapping
+	writer.RemoveDocuments(func(b []byte) bool { return string(b) == "first" })
+	writer.Compact()
+	if info, _ := os.Stat(f.Name()); info.Size() != int64(len(reader.AsBytes)) {
+		t.Error("File truncated while a tail reader had it open", info.Size())
+	}
+	docs := reader.GetDocuments(all)
+	if len(docs) != 2 || string(docs[0].Payload) != "second" || string(docs[1].Payload) != "beyond" {
+		t.Error("Tail reader didn't follow compaction", len(docs))
+	}
+	if hits := reader.GetDocumentsWhere("identity", "beyond"); len(hits) != 1 || string(hits[0].Payload) != "beyond" {
+		t.Error("Tail reader's index not rebuilt after compaction")
+	}
+	mapped := len(reader.AsBytes)
+	reader.Close()
+	if writer.Shrink(); len(writer.AsBytes) >= mapped {
+		t.Error("File not truncated once the tail reader closed it")
+	}
+}
+
+func TestTailReaderCatchesUp(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	writer, e := OpenDB(f.Name(), Options{})
+	if e != nil {
+		t.Fatal("Problem opening db", e)
+	}
+	defer writer.Close()
+	for i := 0; i < 100; i++ {
+		writer.PutDocument(NewDocument([]byte(fmt.Sprintf("doc%d", i))))
+	}
+	reader, e := OpenDB(f.Name(), Options{Tail: true})
+	if e != nil {
+		t.Fatal("Problem opening tail reader", e)
+	}
+	defer reader.Close()
+	calls := 0
+	reader.AddIndex("identity", func(b []byte) string {
+		calls++
+		return string(b)
+	})
+	others := writer.Collection("others")
+	otherReader := reader.Collection("others")
+	otherReader.AddIndex("identity", func(b []byte) string { return string(b) })
+
+	//Changes are applied one at a time, rather than re-indexing everything
+	calls = 0
+	writer.ReplaceDocuments(func(b []byte) ([]byte, bool) { return []byte("doc-3"), string(b) == "doc3" })
+	last, _ := writer.PutDocument(NewDocument([]byte("new")))
+	if len(reader.GetDocumentsWhere("identity", "new")) != 1 || len(reader.GetDocumentsWhere("identity", "doc-3")) != 1 ||
+		len(reader.GetDocumentsWhere("identity", "doc3")) != 0 {
+		t.Error("Tail reader's index didn't follow put & replace")
+	}
+	if calls > 5 {
+		t.Error("Tail reader re-indexed everything", calls)
+	}
+
+	//The last document's space is reused by another collection
+	writer.RemoveDocumentAt(last)
+	if offset, _ := others.PutDocument(NewDocument([]byte("other"))); offset != last {
+		t.Error("Space not reused", offset, last)
+	}
+	if len(reader.GetDocumentsWhere("identity", "new")) != 0 || len(reader.GetDocumentsWhere("identity", "other")) != 0 ||
+		len(otherReader.GetDocumentsWhere("identity", "other")) != 1 {
+		t.Error("Tail reader's indexes didn't follow reuse across collections")
+	}
+
+	//Falling further behind than the journal goes back means starting over
+	for i := 0; i < journalEntries+10; i++ {
+		writer.PutDocument(NewDocument([]byte("more")))
+	}
+	writer.RemoveDocuments(func(b []byte) bool { return string(b) == "doc5" })
+	if len(reader.GetDocumentsWhere("identity", "more")) != journalEntries+10 || len(reader.GetDocumentsWhere("identity", "doc5")) != 0 {
+		t.Error("Tail reader didn't catch up after falling behind")
+	}
+
+	done := reader.AddIndexAsync("async", func(b []byte) string { return string(b) })
+	writer.PutDocument(NewDocument([]byte("late")))
+	writer.RemoveDocuments(func(b []byte) bool { return string(b) == "doc7" })
+	if e := <-done; e != nil {
+		t.Error("Tail reader's background build failed", e)
+	}
+	if len(reader.GetDocumentsWhere("async", "late")) != 1 || len(reader.GetDocumentsWhere("async", "doc7")) != 0 ||
+		len(reader.GetDocumentsWhere("async", "doc8")) != 1 {
+		t.Error("Tail reader's background build missed changes")
+	}
+}
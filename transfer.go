@@ -0,0 +1,220 @@
+package clownshoes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Bulk import & export of payloads in a few simple formats.
+
+type Format int
+
+const (
+	JSONLines      Format = iota //One JSON value per line.  Payloads must be valid JSON
+	RawLines                     //One payload per line.  Payloads must not contain newlines, or end in a carriage return, which is taken as part of a CRLF
+	Base64Lines                  //One standard base64 encoded payload per line
+	LengthPrefixed               //Each payload preceded by its length as a little endian uint32
+)
+
+var formatNames = map[string]Format{
+	"jsonl":  JSONLines,
+	"raw":    RawLines,
+	"base64": Base64Lines,
+	"binary": LengthPrefixed,
+}
+
+// Return the format with the given name: jsonl, raw, base64 or binary.
+func ParseFormat(name string) (Format, error) {
+	format, found := formatNames[name]
+	if !found {
+		return 0, fmt.Errorf("clownshoes: unknown format %q", name)
+	}
+	return format, nil
+}
+
+var ErrUnexportable = errors.New("clownshoes: payload can't be represented in this format")
+
+// Write every document for which filter returns true to w in the given format.
+// A nil filter exports everything.  Returns the number of documents written.
+func (db *DocumentBundle) ExportDocuments(w io.Writer, format Format, filter func([]byte) bool) (counter uint64, err error) {
+	out := bufio.NewWriter(w)
+	var compacted bytes.Buffer
+	header := make([]byte, 4)
+	db.ForEachDocument(func(offset uint64, doc Document) bool {
+		if filter != nil && !filter(doc.Payload) {
+			return true
+		}
+		switch format {
+		case JSONLines:
+			compacted.Reset()
+			if err = json.Compact(&compacted, doc.Payload); err != nil {
+				err = fmt.Errorf("%v at offset %d: %v", ErrUnexportable, offset, err)
+				return false
+			}
+			compacted.WriteByte('\n')
+			_, err = out.Write(compacted.Bytes())
+		case RawLines:
+			if bytes.IndexByte(doc.Payload, '\n') != -1 {
+				err = fmt.Errorf("%v at offset %d: contains a newline", ErrUnexportable, offset)
+				return false
+			}
+			//Importing would strip it along with the newline
+			if bytes.HasSuffix(doc.Payload, []byte("\r")) {
+				err = fmt.Errorf("%v at offset %d: ends in a carriage return", ErrUnexportable, offset)
+				return false
+			}
+			out.Write(doc.Payload)
+			err = out.WriteByte('\n')
+		case Base64Lines:
+			encoder := base64.NewEncoder(base64.StdEncoding, out)
+			encoder.Write(doc.Payload)
+			encoder.Close()
+			err = out.WriteByte('\n')
+		case LengthPrefixed:
+			uint32ToBytes(header, 0, uint32(len(doc.Payload)))
+			out.Write(header)
+			_, err = out.Write(doc.Payload)
+		}
+		if err != nil {
+			return false
+		}
+		counter++
+		return true
+	})
+	if err != nil {
+		return counter, err
+	}
+	return counter, out.Flush()
+}
+
+type ImportOptions struct {
+	BatchSize int                            //Documents inserted per acquisition of the write lock.  Defaults to 1000
+	StartAt   uint64                         //Number of records (lines, for line formats) to skip, for resuming an interrupted import
+	Progress  func(records uint64)           //If set, called after each batch with the number of records consumed so far, including skipped ones
+	Indexes   map[string]func([]byte) string //Indexes to add once everything is loaded, which is cheaper than maintaining them throughout
+}
+
+// Read documents from r in the given format and insert them in batches.  Returns
+// the number of records consumed including skipped ones; on error this is the
+// number before the one that failed, and can be passed back as StartAt to
+// resume.  Hooks and the change feed see every document as usual.
+func (db *DocumentBundle) ImportDocuments(r io.Reader, format Format, opts ImportOptions) (uint64, error) {
+	db.RLock()
+	err := db.checkWritable()
+	db.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	in := bufio.NewReader(r)
+	records := uint64(0)
+	batch := make([][]byte, 0, batchSize)
+	batchRecords := make([]uint64, 0, batchSize)
+
+	//Insert the batch, returning the number of records consumed up to the first
+	//failure, if any
+	flush := func() (uint64, error) {
+		db.Lock()
+		defer db.Unlock()
+		for i, payload := range batch {
+			if _, err := db.doPutDocument(NewDocument(payload)); err != nil {
+				return batchRecords[i] - 1, fmt.Errorf("record %d: %v", batchRecords[i], err)
+			}
+		}
+		batch = batch[:0]
+		batchRecords = batchRecords[:0]
+		if opts.Progress != nil {
+			opts.Progress(records)
+		}
+		return records, nil
+	}
+
+	for {
+		payload, err := readRecord(in, format)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if consumed, flushErr := flush(); flushErr != nil {
+				return consumed, flushErr
+			}
+			return records, fmt.Errorf("record %d: %v", records+1, err)
+		}
+		records++
+		if records <= opts.StartAt || payload == nil {
+			continue
+		}
+		batch = append(batch, payload)
+		batchRecords = append(batchRecords, records)
+		if len(batch) == batchSize {
+			if consumed, err := flush(); err != nil {
+				return consumed, err
+			}
+		}
+	}
+	if consumed, err := flush(); err != nil {
+		return consumed, err
+	}
+
+	for name, keyFn := range opts.Indexes {
+		db.AddIndex(name, keyFn)
+	}
+	return records, nil
+}
+
+// Read the next payload in the given format.  Returns a nil payload for records
+// that should be skipped, such as blank lines of JSON.
+func readRecord(in *bufio.Reader, format Format) ([]byte, error) {
+	if format == LengthPrefixed {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(in, header); err != nil {
+			return nil, err
+		}
+		size := int64(uint32FromBytes(header, 0))
+		if size > maxPayloadSize {
+			return nil, fmt.Errorf("payload of %d bytes is too large for a document", size)
+		}
+		//The buffer grows as the bytes arrive, so a corrupt length can't make us
+		//allocate more than the input holds
+		var payload bytes.Buffer
+		if _, err := io.CopyN(&payload, in, size); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return payload.Bytes(), nil
+	}
+
+	line, err := in.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return nil, io.EOF
+	} else if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	switch format {
+	case JSONLines:
+		if len(bytes.TrimSpace(line)) == 0 {
+			return nil, nil
+		}
+		if !json.Valid(line) {
+			return nil, errors.New("invalid JSON")
+		}
+	case Base64Lines:
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+		n, err := base64.StdEncoding.Decode(decoded, line)
+		if err != nil {
+			return nil, err
+		}
+		line = decoded[:n]
+	}
+	//ReadBytes hands us a fresh slice each time, so no need to copy
+	return line, nil
+}
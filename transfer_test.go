@@ -0,0 +1,114 @@
+package clownshoes
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	db.PutDocument(NewDocument([]byte(`{"name": "alpha"}`)))
+	db.PutDocument(NewDocument([]byte(`{"name": "beta"}`)))
+	db.PutDocument(NewDocument([]byte(`["gamma"]`)))
+
+	var out bytes.Buffer
+	ct, e := db.ExportDocuments(&out, JSONLines, func(b []byte) bool { return b[0] == '{' })
+	if ct != 2 || e != nil || out.String() != "{\"name\":\"alpha\"}\n{\"name\":\"beta\"}\n" {
+		t.Error("Wrong JSON lines export", ct, e, out.String())
+	}
+
+	db.PutDocument(NewDocument([]byte("binary\x00data\nwith newline")))
+	out.Reset()
+	if _, e = db.ExportDocuments(&out, RawLines, nil); e == nil {
+		t.Error("Exported newline in raw lines")
+	}
+
+	for _, format := range []Format{Base64Lines, LengthPrefixed} {
+		out.Reset()
+		if ct, e = db.ExportDocuments(&out, format, nil); ct != 4 || e != nil {
+			t.Error("Export failed", format, ct, e)
+		}
+		f2, _ := ioutil.TempFile("", "ClownshoesDBTest")
+		f2.Close()
+		db2 := NewDB(f2.Name())
+		defer os.Remove(f2.Name())
+		var progress []uint64
+		ct, e = db2.ImportDocuments(&out, format, ImportOptions{
+			BatchSize: 3,
+			Progress:  func(records uint64) { progress = append(progress, records) },
+			Indexes:   map[string]func([]byte) string{"first": func(b []byte) string { return string(b[:1]) }},
+		})
+		if ct != 4 || e != nil || len(progress) != 2 || progress[1] != 4 {
+			t.Error("Import failed", format, ct, e, progress)
+		}
+		if len(db2.GetDocumentsWhere("first", "{")) != 2 || len(db2.GetDocuments(func(b []byte) bool {
+			return bytes.Equal(b, []byte("binary\x00data\nwith newline"))
+		})) != 1 {
+			t.Error("Wrong documents imported", format)
+		}
+	}
+
+	//A trailing carriage return would be lost on import
+	db.PutDocument(NewDocument([]byte("crlf\r")))
+	out.Reset()
+	if _, e = db.ExportDocuments(&out, RawLines, func(b []byte) bool { return b[0] == 'c' }); e == nil {
+		t.Error("Exported trailing carriage return in raw lines")
+	}
+}
+
+func TestImportResume(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	errBad := errors.New("bad record")
+	db.AddHooks(Hooks{BeforePut: func(payload []byte) ([]byte, error) {
+		if string(payload) == "bad" {
+			return nil, errBad
+		}
+		return payload, nil
+	}})
+
+	input := "one\ntwo\nthree\nbad\nfive\n"
+	ct, e := db.ImportDocuments(strings.NewReader(input), RawLines, ImportOptions{BatchSize: 2})
+	if ct != 3 || e == nil {
+		t.Error("Import didn't stop at bad record", ct, e)
+	}
+	if db.Count() != 3 {
+		t.Error("Records before failure not imported", db.Count())
+	}
+
+	//Fix the bad record & resume
+	input = strings.Replace(input, "bad", "four", 1)
+	ct, e = db.ImportDocuments(strings.NewReader(input), RawLines, ImportOptions{BatchSize: 2, StartAt: ct})
+	if ct != 5 || e != nil || db.Count() != 5 {
+		t.Error("Resumed import failed", ct, e, db.Count())
+	}
+
+	if _, e = db.ImportDocuments(strings.NewReader("{}\n\nnot json\n"), JSONLines, ImportOptions{}); e == nil {
+		t.Error("Invalid JSON accepted")
+	}
+	if db.Count() != 6 {
+		t.Error("Records before invalid JSON not imported", db.Count())
+	}
+
+	//A length far beyond the input fails without allocating it
+	if _, e = db.ImportDocuments(strings.NewReader("\xff\xff\xff\xfftruncated"), LengthPrefixed, ImportOptions{}); e == nil {
+		t.Error("Truncated record accepted")
+	}
+}
@@ -0,0 +1,249 @@
+package clownshoes
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// Typed collections wrap a DocumentBundle (or a named collection within one)
+// with a Codec, so that callers deal in values rather than payloads.  Each
+// operation decodes a document at most once for its own purposes.  Index key
+// functions see decoded values too; the two values most recently encoded or
+// decoded are remembered, so maintaining several indexes on a write doesn't
+// decode the document again for each, and updates and removals deindex the
+// values they decoded.
+
+type Collection[T any] struct {
+	DB    *DocumentBundle
+	Codec Codec[T]
+	mu    sync.Mutex
+	cache [2]cachedValue[T] //The values most recently encoded or decoded, newest first
+}
+
+type cachedValue[T any] struct {
+	payload []byte
+	value   T
+}
+
+// Return a typed view of the given DB or collection.
+func NewCollection[T any](db *DocumentBundle, codec Codec[T]) *Collection[T] {
+	return &Collection[T]{DB: db, Codec: codec}
+}
+
+// Remember that payload decodes to v.  payload must not be modified afterwards.
+func (c *Collection[T]) remember(payload []byte, v T) {
+	c.mu.Lock()
+	c.doRemember(payload, v)
+	c.mu.Unlock()
+}
+
+func (c *Collection[T]) doRemember(payload []byte, v T) {
+	c.cache[1], c.cache[0] = c.cache[0], cachedValue[T]{payload, v}
+}
+
+// Decode the payload, or return a remembered value if it's the same.
+func (c *Collection[T]) decodeCached(payload []byte) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cached := range c.cache {
+		if cached.payload != nil && bytes.Equal(payload, cached.payload) {
+			return cached.value, nil
+		}
+	}
+	v, err := c.Codec.Decode(payload)
+	if err == nil {
+		//The payload may point into the mapping
+		c.doRemember(append([]byte(nil), payload...), v)
+	}
+	return v, err
+}
+
+// Encode and insert the value, returning its offset.
+func (c *Collection[T]) Put(v T) (uint64, error) {
+	payload, err := c.Codec.Encode(v)
+	if err != nil {
+		return 0, err
+	}
+	c.remember(payload, v)
+	return c.DB.PutDocument(NewDocument(payload))
+}
+
+// As Put, for a document that expires at the given time.
+func (c *Collection[T]) PutExpiring(v T, expires time.Time) (uint64, error) {
+	payload, err := c.Codec.Encode(v)
+	if err != nil {
+		return 0, err
+	}
+	c.remember(payload, v)
+	return c.DB.PutDocument(NewExpiringDocument(payload, expires))
+}
+
+// Return the value at the given offset.
+func (c *Collection[T]) Get(offset uint64) (v T, err error) {
+	doc, err := c.DB.GetDocumentAt(offset)
+	if err != nil {
+		return v, err
+	}
+	return c.Codec.Decode(doc.Payload)
+}
+
+// Run proc over each value and its offset, stopping early if it returns false.
+// Stops with an error at the first document that can't be decoded.
+func (c *Collection[T]) ForEach(proc func(offset uint64, v T) bool) (err error) {
+	c.DB.ForEachDocument(func(offset uint64, doc Document) bool {
+		var v T
+		if v, err = c.Codec.Decode(doc.Payload); err != nil {
+			return false
+		}
+		return proc(offset, v)
+	})
+	return err
+}
+
+// Return every value for which pred returns true.
+func (c *Collection[T]) Find(pred func(T) bool) (out []T, err error) {
+	err = c.ForEach(func(offset uint64, v T) bool {
+		if pred(v) {
+			out = append(out, v)
+		}
+		return true
+	})
+	return out, err
+}
+
+// Return the values with the given key in the named index.
+func (c *Collection[T]) FindWhere(indexName string, lookupKey string) (out []T, err error) {
+	c.DB.ForEachDocumentWhere(indexName, lookupKey, func(offset uint64, doc Document) bool {
+		var v T
+		if v, err = c.Codec.Decode(doc.Payload); err != nil {
+			return false
+		}
+		out = append(out, v)
+		return true
+	})
+	return out, err
+}
+
+// Wrap a typed updater as a replacer, recording the first codec error in err
+// and leaving everything else alone after it.
+func (c *Collection[T]) replacer(update func(T) (T, bool), err *error) func([]byte) ([]byte, bool) {
+	return func(payload []byte) ([]byte, bool) {
+		if *err != nil {
+			return nil, false
+		}
+		v, decodeErr := c.Codec.Decode(payload)
+		if decodeErr != nil {
+			*err = decodeErr
+			return nil, false
+		}
+		newV, modified := update(v)
+		if !modified {
+			return nil, false
+		}
+		newPayload, encodeErr := c.Codec.Encode(newV)
+		if encodeErr != nil {
+			*err = encodeErr
+			return nil, false
+		}
+		//Deindexing the old payload uses the value already decoded.  The payload
+		//may point into the mapping, which the replacement can overwrite
+		c.mu.Lock()
+		c.doRemember(append([]byte(nil), payload...), v)
+		c.doRemember(newPayload, newV)
+		c.mu.Unlock()
+		return newPayload, true
+	}
+}
+
+// Replace each value for which update returns true with the value it returns.
+// Returns the number replaced, stopping at the first document that can't be
+// decoded or value that can't be encoded.  update mustn't modify anything its
+// argument refers to, since the old value is deindexed from it.
+func (c *Collection[T]) Update(update func(T) (T, bool)) (uint64, error) {
+	var codecErr error
+	counter, err := c.DB.ReplaceDocuments(c.replacer(update, &codecErr))
+	if err == nil {
+		err = codecErr
+	}
+	return counter, err
+}
+
+// As Update, but only for values with the given key in the named index.
+func (c *Collection[T]) UpdateWhere(indexName string, lookupKey string, update func(T) (T, bool)) (uint64, error) {
+	var codecErr error
+	counter, err := c.DB.ReplaceDocumentsWhere(indexName, lookupKey, c.replacer(update, &codecErr))
+	if err == nil {
+		err = codecErr
+	}
+	return counter, err
+}
+
+// Remove each value for which pred returns true.  Documents that can't be
+// decoded are left alone, and the first such error returned.  pred mustn't
+// modify anything its argument refers to, since the value is deindexed from it.
+func (c *Collection[T]) Remove(pred func(T) bool) (uint64, error) {
+	var codecErr error
+	counter, err := c.DB.RemoveDocuments(func(payload []byte) bool {
+		v, decodeErr := c.Codec.Decode(payload)
+		if decodeErr != nil {
+			if codecErr == nil {
+				codecErr = decodeErr
+			}
+			return false
+		}
+		if !pred(v) {
+			return false
+		}
+		//Deindexing uses the value already decoded.  The payload points into
+		//the mapping, so the cache keeps a copy
+		c.remember(append([]byte(nil), payload...), v)
+		return true
+	})
+	if err == nil {
+		err = codecErr
+	}
+	return counter, err
+}
+
+// Add an index keyed by a function of the decoded value.  Documents that can't
+// be decoded get the key "".
+func (c *Collection[T]) AddIndex(indexName string, keyFn func(T) string) {
+	c.DB.AddIndex(indexName, func(payload []byte) string {
+		v, err := c.decodeCached(payload)
+		if err != nil {
+			return ""
+		}
+		return keyFn(v)
+	})
+}
+
+// Add an ordered index keyed by a tuple derived from the decoded value.
+// Documents that can't be decoded get the key "", like those keyFn returns nil
+// for.
+func (c *Collection[T]) AddOrderedIndex(indexName string, keyFn func(T) []interface{}) {
+	c.DB.AddOrderedIndex(indexName, func(payload []byte) []interface{} {
+		v, err := c.decodeCached(payload)
+		if err != nil {
+			return nil
+		}
+		return keyFn(v)
+	})
+}
+
+// Return the values whose keys in the named ordered index are in the range, in
+// key order.
+func (c *Collection[T]) FindInRange(indexName string, r KeyRange) (out []T, err error) {
+	rangeErr := c.DB.ForEachDocumentInRange(indexName, r, func(offset uint64, doc Document) bool {
+		var v T
+		if v, err = c.Codec.Decode(doc.Payload); err != nil {
+			return false
+		}
+		out = append(out, v)
+		return true
+	})
+	if err == nil {
+		err = rangeErr
+	}
+	return out, err
+}
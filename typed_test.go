@@ -0,0 +1,104 @@
+package clownshoes
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+type typedUser struct {
+	Name   string
+	Group  string
+	Logins int
+}
+
+func TestTypedCollection(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	decodes := 0
+	codec := countingCodec{ProtoCodec[typedUser]{}, &decodes}
+	users := NewCollection[typedUser](db.Collection("users"), codec)
+	users.AddIndex("group", func(u typedUser) string { return u.Group })
+	users.AddIndex("name", func(u typedUser) string { return u.Name })
+
+	var firstOffset uint64
+	for i := 0; i < 20; i++ {
+		offset, e := users.Put(typedUser{Name: "user" + strconv.Itoa(i), Group: strconv.Itoa(i % 4)})
+		if e != nil {
+			t.Fatal("Put failed", e)
+		}
+		if i == 0 {
+			firstOffset = offset
+		}
+	}
+	if decodes != 0 {
+		t.Error("Indexing on put decoded documents", decodes)
+	}
+	if u, e := users.Get(firstOffset); e != nil || u.Name != "user0" {
+		t.Error("Get failed", u, e)
+	}
+
+	decodes = 0
+	found, e := users.Find(func(u typedUser) bool { return u.Group == "1" })
+	if e != nil || len(found) != 5 || decodes != 20 {
+		t.Error("Find failed or decoded more than once per document", len(found), decodes, e)
+	}
+	if found, _ := users.FindWhere("name", "user7"); len(found) != 1 || found[0].Group != "3" {
+		t.Error("FindWhere failed", found)
+	}
+
+	decodes = 0
+	ct, e := users.UpdateWhere("group", "2", func(u typedUser) (typedUser, bool) {
+		u.Logins++
+		u.Group = "two"
+		return u, true
+	})
+	if e != nil || ct != 5 || decodes != 5 {
+		t.Error("UpdateWhere failed or decoded more than once per document", ct, decodes, e)
+	}
+	if found, _ := users.FindWhere("group", "two"); len(found) != 5 || found[0].Logins != 1 {
+		t.Error("Updated values not reindexed", found)
+	}
+	ct, e = users.Update(func(u typedUser) (typedUser, bool) { return u, u.Group == "0" })
+	if e != nil || ct != 5 {
+		t.Error("Update failed", ct, e)
+	}
+
+	decodes = 0
+	ct, e = users.Remove(func(u typedUser) bool { return u.Group == "two" })
+	if e != nil || ct != 5 || users.DB.Count() != 15 || decodes != 20 {
+		t.Error("Remove failed or decoded more than once per document", ct, decodes, e)
+	}
+
+	users.AddOrderedIndex("group-name", func(u typedUser) []interface{} { return []interface{}{u.Group, u.Name} })
+	found, e = users.FindInRange("group-name", KeyRange{Lo: []interface{}{"1"}, Hi: []interface{}{"1", "user5"}})
+	if e != nil || len(found) != 4 || found[0].Name != "user1" || found[3].Name != "user5" {
+		t.Error("FindInRange failed", found, e)
+	}
+
+	//Undecodable documents are reported
+	users.DB.PutDocument(NewDocument([]byte{0xff}))
+	if _, e := users.Find(func(u typedUser) bool { return true }); e == nil {
+		t.Error("Decode error not reported")
+	}
+	if _, e := users.Update(func(u typedUser) (typedUser, bool) { return u, false }); e == nil {
+		t.Error("Decode error not reported by Update")
+	}
+}
+
+type countingCodec struct {
+	Codec[typedUser]
+	decodes *int
+}
+
+func (c countingCodec) Decode(payload []byte) (typedUser, error) {
+	*c.decodes++
+	return c.Codec.Decode(payload)
+}
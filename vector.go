@@ -0,0 +1,471 @@
+package clownshoes
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Vector indexes are indexes whose keys are float32 vectors, encoded as their
+// little-endian bits, so they're maintained and dumped like any other.  Each
+// also keeps the vectors by offset for nearest neighbour search, which is exact
+// by comparing against every vector, or approximate by walking a Hierarchical
+// Navigable Small World graph (Malkov & Yashunin, "Efficient and robust
+// approximate nearest neighbor search using Hierarchical Navigable Small World
+// graphs").  The graph is kept in index dumps, so loading doesn't rebuild it.
+
+type VectorMetric int
+
+const (
+	MetricEuclidean VectorMetric = iota //Straight-line distance
+	MetricCosine                        //1 - the cosine of the angle between the vectors
+	MetricDot                           //Negated dot product, so larger products are nearer
+)
+
+type VectorIndexOptions struct {
+	Dimensions     int          //Length of the vectors; others are indexed but never found
+	HNSW           bool         //Search a graph instead of every vector
+	Metric         VectorMetric //The graph's notion of nearness; searches by other metrics compare every vector
+	M              int          //Links per node in the graph, twice that on the bottom layer; 16 if zero
+	EfConstruction int          //Candidates considered when linking a node; 200 if zero
+	EfSearch       int          //Candidates considered when searching, at least k; 64 if zero
+}
+
+type VectorMatch struct {
+	Offset   uint64
+	Doc      Document
+	Distance float64 //By the metric searched with
+}
+
+type vectorIndex struct {
+	opts    VectorIndexOptions
+	vectors map[uint64][]float32
+	links   map[uint64][][]uint64 //Neighbours of each node on each layer it's on, for HNSW
+	inbound map[uint64][][]uint64 //Nodes linking to each node on each layer, so removal needn't look for them
+	upper   []map[uint64]bool     //Nodes on each layer above the bottom, for finding a new entry
+	entry   uint64                //Node on the top layer where searches start
+	rng     *rand.Rand            //Draws the layers of new nodes
+}
+
+func newVectorIndex(opts VectorIndexOptions) *vectorIndex {
+	v := &vectorIndex{opts: opts, vectors: make(map[uint64][]float32), rng: rand.New(rand.NewSource(1))}
+	if opts.HNSW {
+		v.links = make(map[uint64][][]uint64)
+		v.inbound = make(map[uint64][][]uint64)
+	}
+	return v
+}
+
+func encodeVector(vec []float32) string {
+	buf := make([]byte, 4*len(vec))
+	for i, f := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return string(buf)
+}
+
+func decodeVector(key string) []float32 {
+	vec := make([]float32, len(key)/4)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32([]byte(key[4*i : 4*i+4])))
+	}
+	return vec
+}
+
+// Wrap a function returning a document's vector as an index key function.
+// Documents without one, or with NaN or infinite components, get the key "".
+// Use this for the key functions of vector indexes passed to LoadIndexes.
+func VectorKeyFn(vectorFn func(payload []byte) []float32) func([]byte) string {
+	return func(payload []byte) string {
+		vec := vectorFn(payload)
+		for _, f := range vec {
+			if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+				return ""
+			}
+		}
+		return encodeVector(vec)
+	}
+}
+
+// Add an index on each document's vector, for NearestNeighbors.
+func (db *DocumentBundle) AddVectorIndex(indexName string, vectorFn func(payload []byte) []float32, opts VectorIndexOptions) error {
+	if opts.Dimensions <= 0 {
+		return errors.New("clownshoes: vector index needs a number of dimensions")
+	}
+	if opts.M == 0 {
+		opts.M = 16
+	}
+	if opts.EfConstruction == 0 {
+		opts.EfConstruction = 200
+	}
+	if opts.EfSearch == 0 {
+		opts.EfSearch = 64
+	}
+	db.Lock()
+	defer db.Unlock()
+	db.doAddIndexLike(indexName, &index{keyFn: VectorKeyFn(vectorFn), vector: newVectorIndex(opts)})
+	db.publishIndexAdded(indexName)
+	return nil
+}
+
+func vectorDistance(metric VectorMetric, a, b []float32) float64 {
+	var dot, aa, bb float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		switch metric {
+		case MetricEuclidean:
+			aa += (x - y) * (x - y)
+		default:
+			dot += x * y
+			aa += x * x
+			bb += y * y
+		}
+	}
+	switch metric {
+	case MetricEuclidean:
+		return math.Sqrt(aa)
+	case MetricCosine:
+		if aa == 0 || bb == 0 {
+			return 1
+		}
+		return 1 - dot/math.Sqrt(aa*bb)
+	}
+	return -dot
+}
+
+func (v *vectorIndex) add(key string, offset uint64) {
+	if len(key) != 4*v.opts.Dimensions {
+		return
+	}
+	vec := decodeVector(key)
+	v.vectors[offset] = vec
+	if v.links != nil {
+		v.insert(offset, vec)
+	}
+}
+
+func (v *vectorIndex) remove(offset uint64) {
+	if _, found := v.vectors[offset]; !found {
+		return
+	}
+	if v.links != nil {
+		v.unlink(offset)
+	}
+	delete(v.vectors, offset)
+}
+
+// A node and its distance from whatever's being searched for.
+type vectorCandidate struct {
+	offset   uint64
+	distance float64
+}
+
+// Nearest first, or furthest first if far.
+type candidateHeap struct {
+	items []vectorCandidate
+	far   bool
+}
+
+func (h *candidateHeap) Len() int { return len(h.items) }
+func (h *candidateHeap) Less(i, j int) bool {
+	if h.far {
+		return h.items[i].distance > h.items[j].distance
+	}
+	return h.items[i].distance < h.items[j].distance
+}
+func (h *candidateHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *candidateHeap) Push(x interface{}) { h.items = append(h.items, x.(vectorCandidate)) }
+func (h *candidateHeap) Pop() interface{} {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return x
+}
+
+// The ef nodes nearest q found on the layer from the entry points, nearest
+// first.
+func (v *vectorIndex) searchLayer(q []float32, entries []vectorCandidate, ef int, layer int) []vectorCandidate {
+	visited := make(map[uint64]bool)
+	candidates := &candidateHeap{}
+	found := &candidateHeap{far: true}
+	for _, c := range entries {
+		visited[c.offset] = true
+		heap.Push(candidates, c)
+		heap.Push(found, c)
+	}
+	for candidates.Len() != 0 {
+		c := heap.Pop(candidates).(vectorCandidate)
+		if found.Len() >= ef && c.distance > found.items[0].distance {
+			break
+		}
+		for _, n := range v.links[c.offset][layer] {
+			if visited[n] {
+				continue
+			}
+			visited[n] = true
+			d := vectorDistance(v.opts.Metric, q, v.vectors[n])
+			if found.Len() < ef || d < found.items[0].distance {
+				heap.Push(candidates, vectorCandidate{n, d})
+				heap.Push(found, vectorCandidate{n, d})
+				if found.Len() > ef {
+					heap.Pop(found)
+				}
+			}
+		}
+	}
+	out := make([]vectorCandidate, found.Len())
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = heap.Pop(found).(vectorCandidate)
+	}
+	return out
+}
+
+// Maximum links per node on the layer.
+func (v *vectorIndex) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * v.opts.M
+	}
+	return v.opts.M
+}
+
+// The nearest of the nodes to the vector, keeping at most max.
+func (v *vectorIndex) nearest(vec []float32, nodes []uint64, max int) []uint64 {
+	cs := make([]vectorCandidate, len(nodes))
+	for i, n := range nodes {
+		cs[i] = vectorCandidate{n, vectorDistance(v.opts.Metric, vec, v.vectors[n])}
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].distance < cs[j].distance })
+	if len(cs) > max {
+		cs = cs[:max]
+	}
+	out := make([]uint64, len(cs))
+	for i, c := range cs {
+		out[i] = c.offset
+	}
+	return out
+}
+
+// Descend from the top layer to the given one, returning the entry points for
+// searching it.
+func (v *vectorIndex) descend(q []float32, layer int) []vectorCandidate {
+	ep := []vectorCandidate{{v.entry, vectorDistance(v.opts.Metric, q, v.vectors[v.entry])}}
+	for l := len(v.links[v.entry]) - 1; l > layer; l-- {
+		ep = v.searchLayer(q, ep, 1, l)
+	}
+	return ep
+}
+
+func (v *vectorIndex) insert(offset uint64, vec []float32) {
+	layer := int(-math.Log(1-v.rng.Float64()) / math.Log(float64(v.opts.M)))
+	v.addNode(offset, layer+1)
+	if len(v.links) == 1 {
+		v.entry = offset
+		return
+	}
+	top := len(v.links[v.entry]) - 1
+	ep := v.descend(vec, layer)
+	for l := min(layer, top); l >= 0; l-- {
+		ep = v.searchLayer(vec, ep, v.opts.EfConstruction, l)
+		neighbours := make([]uint64, len(ep))
+		for i, c := range ep {
+			neighbours[i] = c.offset
+		}
+		v.setLinks(offset, l, v.nearest(vec, neighbours, v.opts.M))
+		for _, n := range v.links[offset][l] {
+			links := append(v.links[n][l][:len(v.links[n][l]):len(v.links[n][l])], offset)
+			if len(links) > v.maxLinks(l) {
+				links = v.nearest(v.vectors[n], links, v.maxLinks(l))
+			}
+			v.setLinks(n, l, links)
+		}
+	}
+	if layer > top {
+		v.entry = offset
+	}
+}
+
+// Add a node on the given number of layers, without any links.
+func (v *vectorIndex) addNode(offset uint64, layers int) {
+	v.links[offset] = make([][]uint64, layers)
+	v.inbound[offset] = make([][]uint64, layers)
+	for l := 1; l < layers; l++ {
+		if len(v.upper) < l {
+			v.upper = append(v.upper, make(map[uint64]bool))
+		}
+		v.upper[l-1][offset] = true
+	}
+}
+
+// Replace a node's links on a layer, keeping the inbound links in step.
+func (v *vectorIndex) setLinks(offset uint64, layer int, links []uint64) {
+	old := v.links[offset][layer]
+	for _, n := range old {
+		if !containsOffset(links, n) {
+			in := v.inbound[n][layer]
+			for i, c := range in {
+				if c == offset {
+					in[i] = in[len(in)-1]
+					v.inbound[n][layer] = in[:len(in)-1]
+					break
+				}
+			}
+		}
+	}
+	for _, n := range links {
+		if !containsOffset(old, n) {
+			v.inbound[n][layer] = append(v.inbound[n][layer], offset)
+		}
+	}
+	v.links[offset][layer] = links
+}
+
+func containsOffset(offsets []uint64, offset uint64) bool {
+	for _, o := range offsets {
+		if o == offset {
+			return true
+		}
+	}
+	return false
+}
+
+// Work out the inbound links & layers from the links alone, as in a dump.
+func (v *vectorIndex) indexLinks() {
+	links := v.links
+	v.links, v.inbound, v.upper = make(map[uint64][][]uint64), make(map[uint64][][]uint64), nil
+	for offset, layers := range links {
+		v.addNode(offset, len(layers))
+	}
+	for offset, layers := range links {
+		for l, neighbours := range layers {
+			v.setLinks(offset, l, neighbours)
+		}
+	}
+}
+
+// Take a node out of the graph, linking each of its neighbours to the nearest
+// of its other neighbours and theirs, and unlinking it from nodes it doesn't
+// link back to.  Takes time in proportion to its links, in and out.
+func (v *vectorIndex) unlink(offset uint64) {
+	layers := v.links[offset]
+	for l, neighbours := range layers {
+		v.setLinks(offset, l, nil)
+		for _, n := range neighbours {
+			var candidates []uint64
+			seen := map[uint64]bool{n: true}
+			for _, c := range append(v.links[n][l], neighbours...) {
+				if c != offset && !seen[c] {
+					seen[c] = true
+					candidates = append(candidates, c)
+				}
+			}
+			v.setLinks(n, l, v.nearest(v.vectors[n], candidates, v.maxLinks(l)))
+		}
+		for _, n := range append([]uint64(nil), v.inbound[offset][l]...) {
+			links := v.links[n][l]
+			kept := make([]uint64, 0, len(links))
+			for _, c := range links {
+				if c != offset {
+					kept = append(kept, c)
+				}
+			}
+			v.setLinks(n, l, kept)
+		}
+	}
+	delete(v.links, offset)
+	delete(v.inbound, offset)
+	for l := 1; l < len(layers); l++ {
+		delete(v.upper[l-1], offset)
+	}
+	for len(v.upper) != 0 && len(v.upper[len(v.upper)-1]) == 0 {
+		v.upper = v.upper[:len(v.upper)-1]
+	}
+
+	if v.entry != offset {
+		return
+	}
+	//Any node on the top layer will do
+	if len(v.upper) != 0 {
+		for n := range v.upper[len(v.upper)-1] {
+			v.entry = n
+			return
+		}
+	}
+	for n := range v.links {
+		v.entry = n
+		return
+	}
+}
+
+// The k vectors nearest q, nearest first, with their distances.
+func (v *vectorIndex) search(q []float32, k int, metric VectorMetric, live func(offset uint64) bool) []vectorCandidate {
+	if v.links != nil && metric == v.opts.Metric {
+		if len(v.links) == 0 {
+			return nil
+		}
+		out := v.searchLayer(q, v.descend(q, 0), max(v.opts.EfSearch, k), 0)
+		kept := out[:0]
+		for _, c := range out {
+			if live(c.offset) {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) > k {
+			kept = kept[:k]
+		}
+		return kept
+	}
+	found := &candidateHeap{far: true}
+	for offset, vec := range v.vectors {
+		d := vectorDistance(metric, q, vec)
+		if found.Len() < k || d < found.items[0].distance {
+			if !live(offset) {
+				continue
+			}
+			heap.Push(found, vectorCandidate{offset, d})
+			if found.Len() > k {
+				heap.Pop(found)
+			}
+		}
+	}
+	out := make([]vectorCandidate, found.Len())
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = heap.Pop(found).(vectorCandidate)
+	}
+	return out
+}
+
+// Return the k documents whose vectors in the named vector index are nearest
+// vec by the metric, nearest first.  Searches of an HNSW index by its own
+// metric are approximate; others are exact.  Returns nil if there's no such
+// index.
+func (db *DocumentBundle) NearestNeighbors(indexName string, vec []float32, k int, metric VectorMetric) ([]VectorMatch, error) {
+	db.readLock()
+	defer db.RUnlock()
+	idx, found := db.indexes[indexName]
+	if !found {
+		return nil, nil
+	}
+	if idx.vector == nil {
+		return nil, errors.New("clownshoes: index " + indexName + " isn't a vector index")
+	}
+	if len(vec) != idx.vector.opts.Dimensions {
+		return nil, errors.New("clownshoes: vector has the wrong number of dimensions")
+	}
+	if k <= 0 {
+		return nil, nil
+	}
+	now := timeNow().UnixNano()
+	docs := make(map[uint64]Document)
+	live := func(offset uint64) bool {
+		doc := db.doGetDocumentAt(offset)
+		docs[offset] = doc
+		return !doc.expiredAt(now)
+	}
+	var out []VectorMatch
+	for _, c := range idx.vector.search(vec, k, metric, live) {
+		out = append(out, VectorMatch{c.offset, docs[c.offset], c.distance})
+	}
+	return out, nil
+}
@@ -0,0 +1,219 @@
+package clownshoes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestVectorIndex(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	const dims = 12
+	rng := rand.New(rand.NewSource(7))
+	randomVector := func() []float32 {
+		vec := make([]float32, dims)
+		for i := range vec {
+			vec[i] = float32(rng.NormFloat64())
+		}
+		return vec
+	}
+	format := func(id int, vec []float32) []byte {
+		parts := make([]string, len(vec))
+		for i, f := range vec {
+			parts[i] = strconv.FormatFloat(float64(f), 'g', -1, 32)
+		}
+		return []byte(fmt.Sprintf("%d|%s", id, strings.Join(parts, ",")))
+	}
+	parse := func(b []byte) []float32 {
+		fields := strings.Split(strings.SplitN(string(b), "|", 2)[1], ",")
+		if fields[0] == "" {
+			return nil
+		}
+		vec := make([]float32, len(fields))
+		for i, field := range fields {
+			f, _ := strconv.ParseFloat(field, 32)
+			vec[i] = float32(f)
+		}
+		return vec
+	}
+	for i := 0; i < 2000; i++ {
+		db.PutDocument(NewDocument(format(i, randomVector())))
+	}
+	db.PutDocument(NewDocument([]byte("novector|")))
+	db.PutDocument(NewDocument(format(-1, []float32{1, 2, 3})))
+
+	if db.AddVectorIndex("bad", parse, VectorIndexOptions{}) == nil {
+		t.Error("Expected error without dimensions")
+	}
+	db.AddVectorIndex("exact", parse, VectorIndexOptions{Dimensions: dims})
+	db.AddVectorIndex("hnsw", parse, VectorIndexOptions{Dimensions: dims, HNSW: true, Metric: MetricCosine, EfConstruction: 100})
+
+	//The expected neighbours, by sorting everything
+	brute := func(q []float32, k int, metric VectorMetric) []string {
+		type scored struct {
+			payload  string
+			distance float64
+		}
+		var all []scored
+		db.ForEachDocument(func(offset uint64, doc Document) bool {
+			if vec := parse(doc.Payload); len(vec) == dims {
+				all = append(all, scored{string(doc.Payload), vectorDistance(metric, q, vec)})
+			}
+			return true
+		})
+		sort.Slice(all, func(i, j int) bool { return all[i].distance < all[j].distance })
+		var out []string
+		for _, s := range all[:k] {
+			out = append(out, s.payload)
+		}
+		return out
+	}
+	payloads := func(matches []VectorMatch) []string {
+		var out []string
+		for _, m := range matches {
+			out = append(out, string(m.Doc.Payload))
+		}
+		return out
+	}
+	check := func(stage string) {
+		hits, total := 0, 0
+		for i := 0; i < 30; i++ {
+			q := randomVector()
+			for _, metric := range []VectorMetric{MetricEuclidean, MetricCosine, MetricDot} {
+				matches, e := db.NearestNeighbors("exact", q, 10, metric)
+				if want := brute(q, 10, metric); e != nil || !reflect.DeepEqual(payloads(matches), want) {
+					t.Fatal(stage, "exact search by", metric, "found", payloads(matches), "expected", want, e)
+				}
+				for j := 1; j < len(matches); j++ {
+					if matches[j].Distance < matches[j-1].Distance {
+						t.Error(stage, "matches out of order")
+					}
+				}
+			}
+			want := map[string]bool{}
+			for _, p := range brute(q, 10, MetricCosine) {
+				want[p] = true
+			}
+			matches, _ := db.NearestNeighbors("hnsw", q, 10, MetricCosine)
+			for _, m := range matches {
+				if want[string(m.Doc.Payload)] {
+					hits++
+				}
+			}
+			total += 10
+		}
+		if recall := float64(hits) / float64(total); recall < 0.9 {
+			t.Error(stage, "HNSW recall too low", recall)
+		}
+	}
+	check("built")
+
+	//Vectors follow removal & replacement, through the graph too
+	db.RemoveDocuments(func(b []byte) bool {
+		id, _ := strconv.Atoi(strings.Split(string(b), "|")[0])
+		return id%3 == 0
+	})
+	db.ReplaceDocuments(func(b []byte) ([]byte, bool) {
+		id, _ := strconv.Atoi(strings.Split(string(b), "|")[0])
+		if id%5 == 0 {
+			return format(id, randomVector()), true
+		}
+		return nil, false
+	})
+	hnsw := db.indexes["hnsw"].vector
+	for offset, layers := range hnsw.links {
+		if _, found := hnsw.vectors[offset]; !found {
+			t.Fatal("Graph has a removed node")
+		}
+		for _, links := range layers {
+			for _, n := range links {
+				if _, found := hnsw.vectors[n]; !found {
+					t.Fatal("Graph links to a removed node")
+				}
+			}
+		}
+	}
+	//Inbound links mirror the links, and the entry is on the top layer
+	checkGraph := func(stage string, v *vectorIndex) {
+		inbound := 0
+		for offset, layers := range v.inbound {
+			for l, in := range layers {
+				inbound += len(in)
+				for _, n := range in {
+					if !containsOffset(v.links[n][l], offset) {
+						t.Fatal(stage, "inbound link that isn't a link")
+					}
+				}
+			}
+		}
+		links := 0
+		for offset, layers := range v.links {
+			if len(layers) > len(v.links[v.entry]) {
+				t.Fatal(stage, "entry isn't on the top layer")
+			}
+			for l, out := range layers {
+				links += len(out)
+				for _, n := range out {
+					if !containsOffset(v.inbound[n][l], offset) {
+						t.Fatal(stage, "link missing from inbound links")
+					}
+				}
+			}
+		}
+		if links != inbound {
+			t.Fatal(stage, "inbound links don't match", links, inbound)
+		}
+	}
+	checkGraph("changed", hnsw)
+	check("changed")
+
+	db.Compact()
+	check("compacted")
+
+	//The graph survives a dump & load
+	links := db.indexes["hnsw"].vector.links
+	idxFile, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating indexdump", e)
+	}
+	idxFile.Close()
+	defer os.Remove(idxFile.Name())
+	db.dumpIndexes(idxFile.Name())
+	db.RemoveIndex("exact")
+	db.RemoveIndex("hnsw")
+	db.LoadIndexes(map[string]func([]byte) string{"exact": VectorKeyFn(parse), "hnsw": VectorKeyFn(parse)}, idxFile.Name())
+	if loaded := db.indexes["hnsw"].vector; loaded == nil || !reflect.DeepEqual(loaded.links, links) {
+		t.Fatal("Graph wasn't loaded")
+	}
+	checkGraph("loaded", db.indexes["hnsw"].vector)
+	check("loaded")
+	db.RemoveDocuments(func(b []byte) bool {
+		id, _ := strconv.Atoi(strings.Split(string(b), "|")[0])
+		return id%7 == 0
+	})
+	checkGraph("removed after loading", db.indexes["hnsw"].vector)
+
+	if _, e := db.NearestNeighbors("exact", []float32{1, 2, 3}, 5, MetricEuclidean); e == nil {
+		t.Error("Expected error for the wrong number of dimensions")
+	}
+	db.AddIndex("plain", func(b []byte) string { return "" })
+	if _, e := db.NearestNeighbors("plain", randomVector(), 5, MetricEuclidean); e == nil {
+		t.Error("Expected error for a plain index")
+	}
+	if matches, e := db.NearestNeighbors("missing", randomVector(), 5, MetricEuclidean); matches != nil || e != nil {
+		t.Error("Expected nothing for a missing index")
+	}
+}
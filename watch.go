@@ -0,0 +1,248 @@
+package clownshoes
+
+import (
+	"errors"
+	"sync"
+)
+
+// Change feed.  Every mutation made through the do* functions is assigned a
+// sequence number and fanned out to any subscribers whose filter accepts it.
+// There is no persistent log, so resuming is only possible from the in-memory
+// history retained via SetChangeHistory.  All collections in a file share one
+// feed, so sequence numbers are ordered across collections.
+
+type ChangeOp int
+
+const (
+	OpPut            ChangeOp = iota //A new document was inserted at NewOffset
+	OpReplace                        //The document at OldOffset was replaced by the one at NewOffset
+	OpRemove                         //The document at OldOffset was removed
+	OpCompact                        //The DB was compacted; all previously reported offsets are invalid
+	OpAddIndex                       //The index named Index was added to the collection
+	OpRemoveIndex                    //The index named Index was removed from the collection
+	OpDropCollection                 //The collection was dropped
+)
+
+func (op ChangeOp) String() string {
+	switch op {
+	case OpPut:
+		return "put"
+	case OpReplace:
+		return "replace"
+	case OpRemove:
+		return "remove"
+	case OpCompact:
+		return "compact"
+	case OpAddIndex:
+		return "add-index"
+	case OpRemoveIndex:
+		return "remove-index"
+	case OpDropCollection:
+		return "drop-collection"
+	}
+	return "unknown"
+}
+
+type ChangeEvent struct {
+	Seq        uint64   //Monotonically increasing, starting at 1
+	Collection string   //Name of the collection that changed, "" for the default
+	Op         ChangeOp //What happened
+	OldOffset  uint64   //Offset the document was at before the change, or 0
+	NewOffset  uint64   //Offset the document is at after the change, or 0
+	Payload    []byte   //New payload for puts & replaces, removed payload for removes. Shared between subscribers, do not modify.
+	Expires    int64    //Expiry of the new document for puts & replaces, in unix nanoseconds, or 0
+	Index      string   //Name of the index for index changes
+
+	indexMeta *indexMeta //Definition of the index for OpAddIndex, which followers build theirs from
+}
+
+// What to do when a subscriber's buffer is full.  Events are delivered while the
+// writer holds the write lock, so under BlockWriter a consumer that touches the
+// DB, or waits on anything that does, before draining its channel deadlocks
+// with the writer.
+type SlowConsumerPolicy int
+
+const (
+	CloseSubscription SlowConsumerPolicy = iota //The subscription is closed on the first overflow
+	DropEvents                                  //Events that don't fit are discarded and counted
+	BlockWriter                                 //Writers wait until the subscriber catches up
+)
+
+type WatchOptions struct {
+	BufferSize     int                //Capacity of the subscription's channel
+	Policy         SlowConsumerPolicy //Behavior when the buffer is full, CloseSubscription by default
+	Since          uint64             //If nonzero, first replay retained events with a Seq greater than this
+	AllCollections bool               //Receive events from every collection in the file, not just this one
+}
+
+var ErrHistoryUnavailable = errors.New("clownshoes: requested change history is no longer retained")
+
+type Subscription struct {
+	C       <-chan ChangeEvent //Receives the events; closed when the subscription ends
+	c       chan ChangeEvent
+	feed    *changeFeed
+	filter  func(ChangeEvent) bool
+	policy  SlowConsumerPolicy
+	dropped uint64
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Bookkeeping for the change feed, guarded by its own mutex so that consumers
+// can unsubscribe while a writer is blocked delivering to them.
+type changeFeed struct {
+	sync.Mutex
+	seq         uint64
+	history     []ChangeEvent
+	historySize int
+	subscribers map[*Subscription]struct{}
+}
+
+// Return a subscription to all future changes to this collection for which
+// filter returns true.  A nil filter accepts everything.  Uses a 1024-event
+// buffer, and closes the subscription if the consumer falls further behind;
+// writers never wait for it.
+func (db *DocumentBundle) Watch(filter func(ChangeEvent) bool) *Subscription {
+	sub, _ := db.WatchWithOptions(filter, WatchOptions{BufferSize: 1024})
+	return sub
+}
+
+// As Watch, but with control over buffering and resumption.  Returns
+// ErrHistoryUnavailable if Since refers to events that have been discarded.
+func (db *DocumentBundle) WatchWithOptions(filter func(ChangeEvent) bool, opts WatchOptions) (*Subscription, error) {
+	if !opts.AllCollections {
+		userFilter := filter
+		filter = func(ev ChangeEvent) bool {
+			return ev.Collection == db.name && (userFilter == nil || userFilter(ev))
+		}
+	}
+	feed := db.changes
+	feed.Lock()
+	defer feed.Unlock()
+
+	var backlog []ChangeEvent
+	if opts.Since != 0 && opts.Since < feed.seq {
+		if len(feed.history) == 0 || feed.history[0].Seq > opts.Since+1 {
+			return nil, ErrHistoryUnavailable
+		}
+		for _, ev := range feed.history {
+			if ev.Seq > opts.Since && (filter == nil || filter(ev)) {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+
+	bufSize := opts.BufferSize
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	//Backlog is delivered up front, so make sure it fits
+	c := make(chan ChangeEvent, bufSize+len(backlog))
+	for _, ev := range backlog {
+		c <- ev
+	}
+	sub := &Subscription{C: c, c: c, feed: feed, filter: filter, policy: opts.Policy, done: make(chan struct{})}
+	if feed.subscribers == nil {
+		feed.subscribers = make(map[*Subscription]struct{})
+	}
+	feed.subscribers[sub] = struct{}{}
+	return sub, nil
+}
+
+// Stop receiving events and close the subscription's channel.  Safe to call more
+// than once, and from any goroutine.
+func (sub *Subscription) Close() {
+	sub.once.Do(func() {
+		//Unblock any writer waiting on us before contending for the feed lock
+		close(sub.done)
+		feed := sub.feed
+		feed.Lock()
+		defer feed.Unlock()
+		if _, present := feed.subscribers[sub]; present {
+			delete(feed.subscribers, sub)
+			close(sub.c)
+		}
+	})
+}
+
+// Number of events discarded under the DropEvents policy.
+func (sub *Subscription) Dropped() uint64 {
+	feed := sub.feed
+	feed.Lock()
+	defer feed.Unlock()
+	return sub.dropped
+}
+
+// Retain the last n events in memory so that subscribers can resume with
+// WatchOptions.Since.  0 disables retention.
+func (db *DocumentBundle) SetChangeHistory(n int) {
+	feed := db.changes
+	feed.Lock()
+	defer feed.Unlock()
+	feed.historySize = n
+	if len(feed.history) > n {
+		feed.history = append([]ChangeEvent(nil), feed.history[len(feed.history)-n:]...)
+	}
+}
+
+// Sequence number of the most recent change to any collection, or 0 if nothing
+// has changed since the DB was opened.
+func (db *DocumentBundle) LastChangeSeq() uint64 {
+	feed := db.changes
+	feed.Lock()
+	defer feed.Unlock()
+	return feed.seq
+}
+
+// Record a change and deliver it to subscribers, filling in the sequence number
+// and collection.  Called by the mutation paths with the write lock held.
+func (db *DocumentBundle) publishChange(ev ChangeEvent) {
+	feed := db.changes
+	feed.Lock()
+	defer feed.Unlock()
+	feed.seq++
+	if len(feed.subscribers) == 0 && feed.historySize == 0 {
+		return
+	}
+
+	//The payload may point into the mmap'd region, which can move or be overwritten
+	if ev.Payload != nil {
+		ev.Payload = append(make([]byte, 0, len(ev.Payload)), ev.Payload...)
+	}
+	ev.Seq = feed.seq
+	ev.Collection = db.name
+
+	if feed.historySize > 0 {
+		if len(feed.history) >= feed.historySize {
+			copy(feed.history, feed.history[1:])
+			feed.history = feed.history[:len(feed.history)-1]
+		}
+		feed.history = append(feed.history, ev)
+	}
+
+	for sub := range feed.subscribers {
+		if sub.filter != nil && !sub.filter(ev) {
+			continue
+		}
+		switch sub.policy {
+		case BlockWriter:
+			select {
+			case sub.c <- ev:
+			case <-sub.done:
+			}
+		case DropEvents:
+			select {
+			case sub.c <- ev:
+			default:
+				sub.dropped++
+			}
+		case CloseSubscription:
+			select {
+			case sub.c <- ev:
+			default:
+				delete(feed.subscribers, sub)
+				close(sub.c)
+			}
+		}
+	}
+}
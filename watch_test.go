@@ -0,0 +1,115 @@
+package clownshoes
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	all := db.Watch(nil)
+	removals := db.Watch(func(ev ChangeEvent) bool { return ev.Op == OpRemove })
+
+	offset, _ := db.PutDocument(NewDocument([]byte("Spiffy Document 1")))
+	db.PutDocument(NewDocument([]byte("Critical Document 2")))
+	db.ReplaceDocuments(func(payload []byte) ([]byte, bool) {
+		return append([]byte("Very "), payload...), bytes.HasPrefix(payload, []byte("Spiffy"))
+	})
+	db.RemoveDocuments(func(payload []byte) bool {
+		return bytes.HasPrefix(payload, []byte("Critical"))
+	})
+
+	expected := []ChangeOp{OpPut, OpPut, OpReplace, OpRemove}
+	for i, op := range expected {
+		ev := <-all.C
+		if ev.Op != op || ev.Seq != uint64(i+1) {
+			t.Error("Unexpected event", ev)
+		}
+		//Replacement with a longer payload moves the document to the end
+		if ev.Op == OpReplace && (ev.OldOffset != offset || ev.NewOffset <= offset) {
+			t.Error("Wrong offsets for replacement", ev)
+		}
+	}
+	ev := <-removals.C
+	if ev.Op != OpRemove || string(ev.Payload) != "Critical Document 2" {
+		t.Error("Filtered subscription got wrong event", ev)
+	}
+
+	all.Close()
+	all.Close()
+	if _, ok := <-all.C; ok {
+		t.Error("Channel not closed after Close")
+	}
+	removals.Close()
+}
+
+func TestWatchSlowConsumers(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	dropper, _ := db.WatchWithOptions(nil, WatchOptions{BufferSize: 2, Policy: DropEvents})
+	//Closing is the default, so an idle subscriber never blocks writers
+	closer, _ := db.WatchWithOptions(nil, WatchOptions{BufferSize: 2})
+	for i := 0; i < 5; i++ {
+		db.PutDocument(NewDocument([]byte("doc")))
+	}
+	if dropper.Dropped() != 3 {
+		t.Error("Wrong number of dropped events", dropper.Dropped())
+	}
+	n := 0
+	for range closer.C {
+		n++
+	}
+	if n != 2 {
+		t.Error("Overflowing subscription not closed after buffer drained", n)
+	}
+	closer.Close()
+	dropper.Close()
+}
+
+func TestWatchResume(t *testing.T) {
+	f, e := ioutil.TempFile("", "ClownshoesDBTest")
+	if e != nil {
+		t.Error("Problem creating db", e)
+	}
+	f.Close()
+	db := NewDB(f.Name())
+	defer os.Remove(f.Name())
+
+	db.SetChangeHistory(3)
+	for i := 0; i < 5; i++ {
+		db.PutDocument(NewDocument([]byte{byte(i)}))
+	}
+	if db.LastChangeSeq() != 5 {
+		t.Error("Wrong sequence number", db.LastChangeSeq())
+	}
+	if _, e := db.WatchWithOptions(nil, WatchOptions{Since: 1}); e != ErrHistoryUnavailable {
+		t.Error("Resumed from discarded history")
+	}
+	sub, e := db.WatchWithOptions(nil, WatchOptions{Since: 3})
+	if e != nil {
+		t.Error("Could not resume", e)
+	}
+	defer sub.Close()
+	db.PutDocument(NewDocument([]byte{5}))
+	for i := 4; i <= 6; i++ {
+		ev := <-sub.C
+		if ev.Seq != uint64(i) || ev.Payload[0] != byte(i-1) {
+			t.Error("Wrong event on resume", ev)
+		}
+	}
+}